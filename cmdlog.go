@@ -2,10 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kopoli/appkit"
 	cmdlib "github.com/kopoli/cmdlog/lib"
@@ -17,10 +23,12 @@ var (
 	buildGOOS   = "Undefined"
 	buildGOARCH = "Undefined"
 
-	cmdlogFile       = os.ExpandEnv("${HOME}/.cmdlog")
-	cmdlogFilterFile = os.ExpandEnv("${HOME}/.cmdlog-filters")
+	cmdlogFile       = cmdlib.DefaultLogFile()
+	cmdlogFilterFile = cmdlib.DefaultFilterFile()
 
 	maximumLineLength = 160 * 1024
+
+	followPollInterval = 250 * time.Millisecond
 )
 
 type profiler struct {
@@ -78,6 +86,7 @@ func main() {
 	opts.Set("program-buildgoarch", buildGOARCH)
 	opts.Set("cmdlog-file", cmdlogFile)
 	opts.Set("cmdlog-filter-file", cmdlogFilterFile)
+	opts.Set("cmdlog-host", cmdlib.DefaultHost())
 
 	exitValue := 0
 
@@ -103,7 +112,14 @@ func main() {
 		runtime.Goexit()
 	}
 
-	err := cmdlib.Cli(opts, os.Args[1:])
+	// The configuration file gives the defaults of the flags and the
+	// environment variables
+	configFile := cmdlib.ConfigFile()
+	config, err := cmdlib.LoadConfig(configFile)
+	checkErr(err, "Could not load the configuration file", configFile)
+	config.Apply(opts)
+
+	err = cmdlib.Cli(opts, os.Args[1:])
 	checkErr(err, "Parsing command line failed")
 
 	op := opts.Get("cmdline-command", "")
@@ -113,6 +129,20 @@ func main() {
 	}
 	cmdlogFile = opts.Get("cmdlog-file", cmdlogFile)
 	cmdlogFilterFile = opts.Get("cmdlog-filter-file", cmdlogFilterFile)
+
+	relativeTime := time.Duration(-1)
+	if value := opts.Get("cmdlog-relative-time", ""); value != "" {
+		relativeTime, err = cmdlib.ParseDuration(value)
+		checkErr(err, "Parsing the relative time limit failed")
+	}
+	cmdlib.SetTimeDisplay(opts.Get("cmdlog-time-format", ""), relativeTime)
+
+	// In sync mode this host only writes to its own segment
+	syncDir := opts.Get("cmdlog-sync-dir", "")
+	if syncDir != "" {
+		cmdlogFile = cmdlib.SegmentFile(syncDir,
+			opts.Get("cmdlog-host", cmdlib.DefaultHost()))
+	}
 	log := cmdlib.CreateLog(cmdlogFile, cmdlogFilterFile)
 
 	p, err := setupProfiler(opts)
@@ -133,44 +163,482 @@ func main() {
 		}
 	}
 
+	// Files opened for reading the log are closed at exit
+	var openFiles []*os.File
+	var openStores []cmdlib.Store
+	defer func() {
+		for _, fp := range openFiles {
+			fp.Close()
+		}
+		for _, store := range openStores {
+			store.Close()
+		}
+	}()
+
+	// Open the command log for reading. In sync mode the segments of all
+	// hosts are merged. The entries older than since may be skipped.
+	openLogSince := func(reverse bool, since int64) cmdlib.LineReader {
+		openReader := func(fp *os.File) cmdlib.LineReader {
+			if reverse {
+				lr, err := cmdlib.NewReverseReader(fp, maximumLineLength)
+				checkErr(err, "Creating a new reverse reader failed")
+				lr.LongLines = cmdlib.LongLineTruncate
+				lr.Warn = func(err error) {
+					fmt.Fprintf(os.Stderr, "Warning: %v, truncated\n", err)
+				}
+				return lr
+			}
+			return cmdlib.NewBufferedReader(fp, maximumLineLength)
+		}
+
+		if syncDir != "" {
+			files, err := cmdlib.SegmentFiles(syncDir)
+			checkErr(err, "Could not list the sync directory", syncDir)
+
+			inputs := []cmdlib.MergeInput{}
+			for _, file := range files {
+				fp, err := os.Open(file)
+				checkErr(err, "Could not open", file, "for reading.")
+				openFiles = append(openFiles, fp)
+				inputs = append(inputs, cmdlib.MergeInput{
+					Reader: openReader(fp),
+					Host:   cmdlib.SegmentHost(file),
+				})
+			}
+			return cmdlib.NewMergeReader(inputs, true, reverse)
+		}
+
+		if strings.Compare(cmdlogFile, "-") == 0 {
+			return openReader(os.Stdin)
+		}
+		store, err := log.OpenStore("")
+		checkErr(err, "Could not open", cmdlogFile, "for reading.")
+		openStores = append(openStores, store)
+		lr, err := store.Range(since, math.MaxInt64, reverse)
+		checkErr(err, "Could not open", cmdlogFile, "for reading.")
+
+		// The commands pulled from a server are merged by time
+		remote := log.RemoteFile()
+		if !cmdlib.FileExists(remote) {
+			return lr
+		}
+		fp, err := os.Open(remote)
+		checkErr(err, "Could not open", remote, "for reading.")
+		openFiles = append(openFiles, fp)
+		return cmdlib.NewMergeReader([]cmdlib.MergeInput{
+			{Reader: lr},
+			{Reader: openReader(fp)},
+		}, false, reverse)
+	}
+
+	openLog := func(reverse bool) cmdlib.LineReader {
+		return openLogSince(reverse, math.MinInt64)
+	}
+
+	reportArgs := func() cmdlib.ParseArgs {
+		arg := cmdlib.ParseArgs{
+			Session: opts.Get("report-session", ""),
+			Since:   opts.Get("report-since", ""),
+			Grep:    opts.Get("report-grep", ""),
+			Pwd:     opts.IsSet("report-pwd"),
+			Reverse: opts.IsSet("report-reverse"),
+			Tag:     opts.Get("report-tag", ""),
+			Program: opts.Get("report-program", ""),
+			Notes:   opts.IsSet("report-notes"),
+			IDs:     opts.IsSet("report-ids"),
+			Dir:     opts.Get("report-dir", ""),
+			Output:  os.Stdout,
+		}
+		arg.DirRecursive = opts.IsSet("report-recursive")
+		arg.Multiline = opts.IsSet("report-multiline")
+		arg.Limit, _ = strconv.Atoi(opts.Get("report-limit", "0"))
+		arg.Offset, _ = strconv.Atoi(opts.Get("report-offset", "0"))
+		arg.After, _ = strconv.Atoi(opts.Get("report-after", "0"))
+		arg.Before, _ = strconv.Atoi(opts.Get("report-before", "0"))
+		return arg
+	}
+
+	loadStars := func() *cmdlib.StarStore {
+		stars, err := cmdlib.LoadStarStore(log.StarFile())
+		checkErr(err, "Could not load stars from", log.StarFile())
+		return stars
+	}
+
 	switch op {
 	case "log":
 		handleFilters()
 
 		session := opts.Get("log-session", "<unknown>")
-		args := opts.Get("log-args", "<unknown>")
+		if opts.IsSet("log-stdin") {
+			data, err := ioutil.ReadAll(os.Stdin)
+			checkErr(err, "Could not read the command from standard input")
 
-		err = log.AppendLine(session, args)
+			// Only the newline added by print or echo is removed
+			cmd := strings.TrimSuffix(string(data), "\n")
+			err = log.AppendCommand(session, cmd)
+		} else {
+			err = log.AppendLine(session, opts.Get("log-args", "<unknown>"))
+		}
 		checkErr(err, "Could not print to log")
+
+		// The compaction rewrites the whole log, so it is run in the
+		// background to not delay the prompt
+		policy := opts.Get("cmdlog-retention", "")
+		retention, err := cmdlib.ParseRetentionPolicy(policy)
+		if err == nil && !retention.IsEmpty() && log.CompactDue(time.Now()) {
+			var exe string
+			exe, err = os.Executable()
+			if err == nil {
+				err = cmdlib.StartDetached(exe, "--file", log.LogFile,
+					"--retention", policy, "compact", "-if-needed")
+			}
+		}
+		if err != nil {
+			// Failure of compacting is not a fatal error
+			fmt.Fprintf(os.Stderr,
+				"Warning: Compacting the log failed: %v\n", err)
+		}
+	case "migrate":
+		moved, err := cmdlib.MigrateLegacyFiles()
+		for _, file := range moved {
+			fmt.Fprintf(os.Stderr, "Moved %s\n", file)
+		}
+		checkErr(err, "Migrating the files failed")
+		if len(moved) == 0 {
+			fmt.Fprintf(os.Stderr, "Nothing to migrate\n")
+		}
+	case "convert":
+		if syncDir != "" {
+			checkErr(fmt.Errorf("the logs in the sync directory are always in the %s format",
+				cmdlib.FormatText), "Converting the log failed")
+		}
+		format := opts.Get("convert-format", "")
+		if format == "" {
+			format = cmdlib.FormatBinary
+			if cmdlib.StoreFormat(cmdlogFile) == cmdlib.FormatBinary {
+				format = cmdlib.FormatText
+			}
+		}
+		output := opts.Get("convert-output", "")
+		copied, skipped, err := log.Convert(format, output)
+		checkErr(err, "Converting the log failed")
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d malformed lines\n", skipped)
+		}
+		if output == "" {
+			fmt.Fprintf(os.Stderr, "Converted %d commands to the %s format, the previous log is in %s\n",
+				copied, format, log.BackupFile())
+		} else {
+			fmt.Fprintf(os.Stderr, "Converted %d commands to the %s format\n", copied, format)
+		}
 	case "filters":
 		handleFilters()
 		for i := range log.Filters {
 			fmt.Println(log.Filters[i])
 		}
 	case "report":
-		arg := cmdlib.ParseArgs{
-			Session: opts.Get("report-session", ""),
-			Since:   opts.Get("report-since", ""),
-			Grep:    opts.Get("report-grep", ""),
-			Pwd:     opts.IsSet("report-pwd"),
+		arg := reportArgs()
+		arg.Tags, err = cmdlib.LoadTagStore(log.TagFile())
+		checkErr(err, "Could not load tags from", log.TagFile())
+
+		// The entries older than -since are not read, unless they are
+		// needed for tracking the directories. An invalid time is
+		// reported by the report.
+		since := int64(math.MinInt64)
+		if arg.Since != "" && !arg.Pwd && arg.Dir == "" {
+			if t, err := cmdlib.ParseTime(arg.Since); err == nil {
+				since = t
+			}
+		}
+
+		if opts.IsSet("report-starred-first") {
+			if syncDir == "" && cmdlogFile == "-" {
+				checkErr(fmt.Errorf("stdin can be read only once"),
+					"Displaying the starred commands first failed")
+			}
+			arg.Stars = loadStars()
+			err = cmdlib.ParseCmdLogStarredFirst(func() (cmdlib.LineReader, error) {
+				return openLogSince(arg.Reverse, since), nil
+			}, arg)
+			checkErr(err, "Parsing the command log failed")
+			break
+		}
+		if opts.IsSet("report-starred") {
+			arg.Stars = loadStars()
+			arg.Starred = cmdlib.StarredOnly
+		}
+
+		// In sync mode only the segment of this host is followed. Stdin
+		// is read until it is closed.
+		if opts.IsSet("report-follow") {
+			arg.Follow = true
+			if cmdlogFile != "-" {
+				if cmdlib.StoreFormat(cmdlogFile) != cmdlib.FormatText {
+					checkErr(fmt.Errorf("only the %s format can be followed",
+						cmdlib.FormatText), "Following the command log failed")
+				}
+				fr, err := cmdlib.NewFollowReader(cmdlogFile, followPollInterval)
+				checkErr(err, "Could not open", cmdlogFile, "for following.")
+				defer fr.Close()
+				err = cmdlib.ParseCmdLog(fr, arg)
+				checkErr(err, "Following the command log failed")
+				break
+			}
+		}
+
+		err = cmdlib.ParseCmdLog(openLogSince(arg.Reverse, since), arg)
+		checkErr(err, "Parsing the command log failed")
+	case "tag":
+		store, err := cmdlib.LoadTagStore(log.TagFile())
+		checkErr(err, "Could not load tags from", log.TagFile())
+
+		id := opts.Get("tag-entry", "")
+		e, err := cmdlib.FindEntry(openLog(true), opts.Get("tag-session", ""), id)
+		checkErr(err, "Could not find the command")
+
+		tags := []string{}
+		if t := opts.Get("tag-tags", ""); t != "" {
+			tags = appkit.SplitArguments(t)
+		}
+		err = store.Add(e.ID(), tags, opts.Get("tag-note", ""))
+		checkErr(err, "Could not tag the command")
+		fmt.Fprintf(os.Stderr, "Tagged: %s\n", e.Command)
+	case "star":
+		stars := loadStars()
+
+		id := opts.Get("star-entry", "")
+		e, err := cmdlib.FindEntry(openLog(true), opts.Get("star-session", ""), id)
+		checkErr(err, "Could not find the command")
+
+		remove := opts.IsSet("star-remove")
+		err = stars.Star(e.ID(), !remove)
+		checkErr(err, "Could not star the command")
+		if remove {
+			fmt.Fprintf(os.Stderr, "Unstarred: %s\n", e.Command)
+		} else {
+			fmt.Fprintf(os.Stderr, "Starred: %s\n", e.Command)
+		}
+	case "sessions":
+		arg := cmdlib.SessionsArgs{
+			Since:   opts.Get("sessions-since", ""),
+			Grep:    opts.Get("sessions-grep", ""),
+			Reverse: opts.IsSet("sessions-reverse"),
+			JSON:    opts.IsSet("sessions-json"),
 			Output:  os.Stdout,
 		}
-		fp := os.Stdin
-		if strings.Compare(cmdlogFile, "-") != 0 {
-			fp, err = os.Open(cmdlogFile)
-			checkErr(err, "Could not open", cmdlogFile, "for reading.")
-			defer fp.Close()
+		err = cmdlib.ListSessions(openLog(false), arg)
+		checkErr(err, "Listing the sessions failed")
+	case "stats":
+		arg := cmdlib.StatsArgs{
+			Session: opts.Get("stats-session", ""),
+			Since:   opts.Get("stats-since", ""),
+			Program: opts.Get("stats-program", ""),
+			Output:  os.Stdout,
+		}
+		arg.Limit, _ = strconv.Atoi(opts.Get("stats-limit", "0"))
+		err = cmdlib.PrintStats(openLog(false), arg)
+		checkErr(err, "Counting the programs failed")
+	case "suggest-aliases":
+		arg := cmdlib.AliasArgs{
+			Session: opts.Get("suggest-session", ""),
+			Since:   opts.Get("suggest-since", ""),
+			Output:  os.Stdout,
+		}
+		arg.MinCount, _ = strconv.Atoi(opts.Get("suggest-min-count", "3"))
+		arg.MinLength, _ = strconv.Atoi(opts.Get("suggest-min-length", "20"))
+		arg.Limit, _ = strconv.Atoi(opts.Get("suggest-limit", "10"))
+		if file := opts.Get("suggest-aliases", ""); file != "" {
+			fp := os.Stdin
+			if file != "-" {
+				fp, err = os.Open(file)
+				checkErr(err, "Could not open the aliases file")
+				defer fp.Close()
+			}
+			arg.Aliases, err = cmdlib.ParseAliases(fp)
+			checkErr(err, "Could not read the aliases from", file)
+		}
+		err = cmdlib.PrintAliasSuggestions(openLog(false), arg)
+		checkErr(err, "Suggesting aliases failed")
+	case "forget":
+		arg := cmdlib.ForgetArgs{
+			Session: opts.Get("forget-session", ""),
+			Since:   opts.Get("forget-since", ""),
+			Until:   opts.Get("forget-until", ""),
+			Grep:    opts.Get("forget-grep", ""),
+			Filters: opts.IsSet("forget-filters"),
+			DryRun:  opts.IsSet("forget-dry-run"),
+			Backup:  opts.IsSet("forget-backup"),
+			Output:  os.Stdout,
+		}
+		if arg.Filters {
+			handleFilters()
+		}
+
+		removed, err := log.Forget(arg)
+		checkErr(err, "Removing commands from the log failed")
+		if arg.DryRun {
+			fmt.Fprintf(os.Stderr, "Would remove %d commands\n", removed)
+		} else {
+			fmt.Fprintf(os.Stderr, "Removed %d commands\n", removed)
+		}
+	case "compact":
+		retention, err := cmdlib.ParseRetentionPolicy(opts.Get("cmdlog-retention", ""))
+		checkErr(err, "Parsing the retention policy failed")
+		if opts.IsSet("compact-if-needed") {
+			if !log.CompactDue(time.Now()) {
+				break
+			}
+			retention.Keep = loadStars().Keep()
+			removed, err := log.CompactIfNeeded(retention)
+			checkErr(err, "Compacting the log failed")
+			fmt.Fprintf(os.Stderr, "Removed %d commands\n", removed)
+			break
+		}
+
+		retention.Keep = loadStars().Keep()
+		arg := cmdlib.CompactArgs{
+			Policy: retention,
+			DryRun: opts.IsSet("compact-dry-run"),
+			Backup: opts.IsSet("compact-backup"),
+			Output: os.Stdout,
 		}
-		var lr cmdlib.LineReader
-		if opts.IsSet("report-reverse") {
-			lr, err = cmdlib.NewReverseReader(fp, maximumLineLength)
-			checkErr(err, "Creating a new reverse reader failed")
+
+		removed, err := log.Compact(arg)
+		checkErr(err, "Compacting the log failed")
+		if arg.DryRun {
+			fmt.Fprintf(os.Stderr, "Would remove %d commands\n", removed)
 		} else {
-			lr = cmdlib.NewBufferedReader(fp, maximumLineLength)
+			fmt.Fprintf(os.Stderr, "Removed %d commands\n", removed)
+		}
+	case "fsck":
+		arg := cmdlib.FsckArgs{
+			Repair: opts.IsSet("fsck-repair"),
+			Backup: opts.IsSet("fsck-backup"),
+			Output: os.Stdout,
+		}
+		problems, quarantined, err := log.Fsck(arg)
+		checkErr(err, "Checking the log failed")
+		switch {
+		case problems == 0:
+			fmt.Fprintf(os.Stderr, "No problems found\n")
+		case arg.Repair:
+			fmt.Fprintf(os.Stderr, "Repaired %d problems\n", problems)
+			if quarantined > 0 {
+				fmt.Fprintf(os.Stderr, "Moved %d lines or segment ends that could not be repaired to %s\n",
+					quarantined, log.QuarantineFile())
+			}
+		default:
+			checkErr(fmt.Errorf("found %d problems", problems),
+				"The command log has problems, repair them with -repair")
 		}
+	case "merge":
+		arg := cmdlib.MergeArgs{
+			TagHost: opts.IsSet("merge-tag"),
+			Output:  os.Stdout,
+		}
+		output := opts.Get("merge-output", "")
+		outputInfo, _ := os.Stat(output)
+		for _, file := range appkit.SplitArguments(opts.Get("merge-files", "")) {
+			// The host follows the last "=", unless the whole argument
+			// is an existing file
+			host := filepath.Base(file)
+			if idx := strings.LastIndex(file, "="); idx >= 0 && !cmdlib.FileExists(file) {
+				file, host = file[:idx], file[idx+1:]
+			}
+			fp, err := os.Open(file)
+			checkErr(err, "Could not open", file, "for reading.")
+			defer fp.Close()
 
-		err = cmdlib.ParseCmdLog(lr, arg)
-		checkErr(err, "Parsing the command log failed")
+			// Creating the output would truncate the input before it
+			// is read
+			if outputInfo != nil {
+				info, err := fp.Stat()
+				checkErr(err, "Could not stat", file)
+				if os.SameFile(info, outputInfo) {
+					checkErr(fmt.Errorf("the output %s is also an input", output),
+						"Could not merge the logs")
+				}
+			}
+
+			arg.Inputs = append(arg.Inputs, cmdlib.MergeInput{
+				Reader: cmdlib.NewBufferedReader(fp, maximumLineLength),
+				Host:   host,
+			})
+		}
+		if output != "" {
+			fp, err := os.Create(output)
+			checkErr(err, "Could not open", output, "for writing.")
+			defer fp.Close()
+			arg.Output = fp
+		}
+
+		written, duplicates, err := cmdlib.MergeLogs(arg)
+		checkErr(err, "Merging the logs failed")
+		fmt.Fprintf(os.Stderr, "Merged %d commands, dropped %d duplicates\n",
+			written, duplicates)
+	case "serve":
+		tokenFile := opts.Get("serve-tokens", "")
+		fp, err := os.Open(tokenFile)
+		checkErr(err, "Could not open", tokenFile, "for reading.")
+		tokens, err := cmdlib.LoadTokens(fp)
+		fp.Close()
+		checkErr(err, "Could not load tokens from", tokenFile)
+
+		dir := opts.Get("serve-dir", "")
+		err = os.MkdirAll(dir, 0700)
+		checkErr(err, "Could not create directory", dir)
+
+		server := &cmdlib.Server{
+			Dir:    dir,
+			Tokens: tokens,
+		}
+		err = http.ListenAndServe(opts.Get("serve-addr", ""), server)
+		checkErr(err, "Serving failed")
+	case "push":
+		client := &cmdlib.Client{
+			URL:   opts.Get("client-server", ""),
+			Token: opts.Get("client-token", ""),
+		}
+		count, err := log.Push(client, opts.Get("cmdlog-host", ""))
+		checkErr(err, "Pushing to the server failed")
+		fmt.Fprintf(os.Stderr, "Pushed %d commands\n", count)
+	case "search":
+		client := &cmdlib.Client{
+			URL:   opts.Get("client-server", ""),
+			Token: opts.Get("client-token", ""),
+		}
+		err = client.Search(reportArgs(), os.Stdout)
+		checkErr(err, "Searching on the server failed")
+	case "pull":
+		client := &cmdlib.Client{
+			URL:   opts.Get("client-server", ""),
+			Token: opts.Get("client-token", ""),
+		}
+		output := opts.Get("pull-output", "")
+		if output == "" {
+			output = log.RemoteFile()
+		}
+		excludeHost := opts.Get("cmdlog-host", "")
+		if opts.IsSet("pull-all") {
+			excludeHost = ""
+		}
+		count, err := cmdlib.Pull(client, output, excludeHost)
+		checkErr(err, "Pulling from the server failed")
+		fmt.Fprintf(os.Stderr, "Pulled %d commands\n", count)
+	case "unescape":
+		// Without arguments the lines of stdin are unescaped
+		if opts.IsSet("unescape-args") {
+			_, err = fmt.Println(cmdlib.UnescapeCommand(opts.Get("unescape-args", "")))
+		} else {
+			err = cmdlib.UnescapeLines(os.Stdout, os.Stdin)
+		}
+		checkErr(err, "Unescaping failed")
+	case "completion":
+		base, commands := cmdlib.Commands(opts)
+		program := filepath.Base(opts.Get("program-name", "cmdlog"))
+		err = cmdlib.WriteCompletion(os.Stdout, opts.Get("completion-shell", ""),
+			program, base, commands)
+		checkErr(err, "Writing the completion script failed")
 	default:
 		err = fmt.Errorf("invalid command")
 		checkErr(err, "Running cmdlog failed")
@@ -0,0 +1,335 @@
+package cmdlib
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AliasArgs are the arguments for the SuggestAliases function
+type AliasArgs struct {
+	Session string
+	Since   string
+
+	// Suggest commands and prefixes repeated at least this many times
+	// and at least this long
+	MinCount  int
+	MinLength int
+
+	// Suggest at most this many aliases. Zero suggests all.
+	Limit int
+
+	// The existing aliases from their names to the commands, see
+	// ParseAliases. Commands already having an alias are not suggested
+	// and the names are not reused.
+	Aliases map[string]string
+
+	Output io.Writer
+}
+
+// AliasSuggestion is a suggested alias or a function for a command
+type AliasSuggestion struct {
+	Name    string
+	Command string
+
+	// The command is a shell function instead of an alias, because it is
+	// a compound or a multi-line command
+	Function bool
+
+	// The number of times the command or the prefix was run
+	Count int
+
+	// The number of keystrokes saved by using the name
+	Saved int
+}
+
+// Definition returns the alias or the function definition. The definitions
+// work in both zsh and bash.
+func (a *AliasSuggestion) Definition() string {
+	if a.Function {
+		// Multi-line commands are not indented to keep here-documents
+		// intact
+		body := a.Command
+		if !strings.Contains(body, "\n") {
+			body = "    " + body
+		}
+		return a.Name + "() {\n" + body + "\n}"
+	}
+	return "alias " + a.Name + "='" +
+		strings.Replace(a.Command, "'", `'\''`, -1) + "'"
+}
+
+// commandExists returns true if the name is a program in the PATH.
+// Replaced in the tests.
+var commandExists = func(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// Words that cannot be used as alias names
+var aliasReservedNames = map[string]bool{
+	"if": true, "fi": true, "do": true, "done": true, "in": true,
+	"for": true, "case": true, "esac": true, "then": true, "else": true,
+	"elif": true, "while": true, "until": true, "time": true,
+}
+
+// ParseAliases parses the output of the alias command of bash or zsh to a
+// map from the alias names to the commands. The lines are of the form
+// "alias name='command'" or "name='command'".
+func ParseAliases(r io.Reader) (map[string]string, error) {
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "alias "))
+		idx := strings.IndexByte(line, '=')
+		if idx <= 0 {
+			continue
+		}
+		words := []string{}
+		for _, tok := range splitShell(line[idx+1:]) {
+			words = append(words, tok.Value)
+		}
+		ret[line[:idx]] = strings.Join(words, " ")
+	}
+	return ret, scanner.Err()
+}
+
+// shellWords returns the words and operators of the command separated by NUL
+// bytes. The quotes, escapes and extra whitespace are removed.
+func shellWords(cmd string) string {
+	words := []string{}
+	for _, tok := range splitShell(cmd) {
+		words = append(words, tok.Value)
+	}
+	return strings.Join(words, "\x00")
+}
+
+// commandPrefixes returns the prefixes of the command that end at the words
+// of its first simple command. The last prefix is the whole command if it
+// is a simple command.
+func commandPrefixes(cmd string) []string {
+	var ret []string
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case isShellBlank(c):
+			if inWord {
+				ret = append(ret, cmd[:i])
+			}
+			inWord = false
+		case strings.IndexByte(";&|<>()\n", c) >= 0 || c == '#' && !inWord:
+			return ret
+		case c == '\\':
+			inWord = true
+			i++
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return ret
+			}
+			i += end + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(cmd) && cmd[i] != '"'; i++ {
+				if cmd[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(cmd) {
+				return ret
+			}
+		default:
+			inWord = true
+		}
+	}
+	if inWord {
+		ret = append(ret, cmd)
+	}
+	return ret
+}
+
+// aliasName creates a name for the command from the initials of its words.
+// Options and paths are skipped.
+func aliasName(cmd string) string {
+	name := []byte{}
+	first := ""
+	for _, tok := range splitShell(cmd) {
+		w := tok.Value
+		if tok.Operator || w == "" {
+			continue
+		}
+		if first == "" {
+			first = w
+		}
+		c := w[0]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c < 'a' || c > 'z' || strings.ContainsAny(w, "/.=") {
+			continue
+		}
+		if len(name) < 6 {
+			name = append(name, c)
+		}
+	}
+	if len(name) >= 2 {
+		return string(name)
+	}
+
+	// The beginning of the first word
+	name = name[:0]
+	for i := 0; i < len(first) && len(name) < 3; i++ {
+		c := first[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			name = append(name, c)
+		}
+	}
+	if len(name) == 0 {
+		return "cmd"
+	}
+	return string(name)
+}
+
+// SuggestAliases reads the command log and suggests aliases for the long
+// commands and the prefixes of commands that are repeated often. The
+// suggestions are ordered by the number of saved keystrokes.
+//
+// A prefix is not suggested if a longer prefix of the same commands is
+// repeated as many times. Compound and multi-line commands are suggested
+// as functions.
+func SuggestAliases(reader LineReader, arg AliasArgs) ([]AliasSuggestion, error) {
+	// The prefixes of simple commands and the compound commands
+	prefixes := make(map[string]int)
+	compounds := make(map[string]int)
+
+	pa := ParseArgs{
+		Session: arg.Session,
+		Since:   arg.Since,
+	}
+	err := ScanCmdLog(reader, pa, func(e *Entry) error {
+		cmd := strings.TrimSpace(e.Command)
+		if _, start := sessionStart(cmd); start ||
+			len(cmd) < arg.MinLength || cmd == sessionExitCommand {
+			return nil
+		}
+		ps := commandPrefixes(cmd)
+		for _, p := range ps {
+			if len(p) >= arg.MinLength {
+				prefixes[p]++
+			}
+		}
+		if len(ps) == 0 || ps[len(ps)-1] != cmd {
+			compounds[cmd]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The commands of the aliases are compared by their words, so that
+	// differences in quoting and spacing do not matter
+	covered := make(map[string]bool)
+	for _, cmd := range arg.Aliases {
+		covered[shellWords(cmd)] = true
+	}
+
+	// Prefixes with a longer prefix repeated as many times
+	dominated := make(map[string]bool)
+	for p, count := range prefixes {
+		if count < arg.MinCount {
+			continue
+		}
+		ps := commandPrefixes(p)
+		if len(ps) >= 2 && prefixes[ps[len(ps)-2]] == count {
+			dominated[ps[len(ps)-2]] = true
+		}
+	}
+
+	ret := []AliasSuggestion{}
+	add := func(cmd string, count int, function bool) {
+		if count < arg.MinCount || covered[shellWords(cmd)] || dominated[cmd] {
+			return
+		}
+		name := aliasName(cmd)
+		if len(cmd) <= len(name) {
+			return
+		}
+		ret = append(ret, AliasSuggestion{
+			Name:     name,
+			Command:  cmd,
+			Function: function,
+			Count:    count,
+			Saved:    count * (len(cmd) - len(name)),
+		})
+	}
+	for cmd, count := range prefixes {
+		add(cmd, count, false)
+	}
+	for cmd, count := range compounds {
+		add(cmd, count, true)
+	}
+
+	rank := func() {
+		sort.Slice(ret, func(i, j int) bool {
+			if ret[i].Saved != ret[j].Saved {
+				return ret[i].Saved > ret[j].Saved
+			}
+			return ret[i].Command < ret[j].Command
+		})
+	}
+	rank()
+	if arg.Limit > 0 && len(ret) > arg.Limit {
+		ret = ret[:arg.Limit]
+	}
+
+	// The names must not hide programs, aliases or each other
+	used := make(map[string]bool)
+	for name := range arg.Aliases {
+		used[name] = true
+	}
+	for i := range ret {
+		base := ret[i].Name
+		name := base
+		for n := 2; used[name] || aliasReservedNames[name] || commandExists(name); n++ {
+			name = base + strconv.Itoa(n)
+		}
+		used[name] = true
+		ret[i].Name = name
+		ret[i].Saved = ret[i].Count * (len(ret[i].Command) - len(name))
+	}
+
+	// The longer names save fewer keystrokes
+	rank()
+
+	return ret, nil
+}
+
+// PrintAliasSuggestions prints the suggested alias and function
+// definitions, each preceded by a comment of the keystrokes saved
+func PrintAliasSuggestions(reader LineReader, arg AliasArgs) error {
+	suggestions, err := SuggestAliases(reader, arg)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(arg.Output)
+	for _, s := range suggestions {
+		_, err = out.WriteString("# Run " + strconv.Itoa(s.Count) +
+			" times, saves " + strconv.Itoa(s.Saved) + " keystrokes\n" +
+			s.Definition() + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
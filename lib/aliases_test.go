@@ -0,0 +1,149 @@
+package cmdlib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_commandPrefixes(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"", nil},
+		{"ls", []string{"ls"}},
+		{"git  commit -m 'a b'", []string{"git", "git  commit", "git  commit -m",
+			"git  commit -m 'a b'"}},
+		{`echo "a | b" c`, []string{"echo", `echo "a | b"`, `echo "a | b" c`}},
+		{"make all && make install", []string{"make", "make all"}},
+		{"make 2>&1", []string{"make"}},
+		{"ls # comment", []string{"ls"}},
+		{"echo 'unterminated", []string{"echo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			compare(t, "Prefixes differ", strings.Join(tt.want, "\n"),
+				strings.Join(commandPrefixes(tt.cmd), "\n"))
+		})
+	}
+}
+
+func Test_aliasName(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"docker compose -f dev.yml exec web", "dcew"},
+		{"git status", "gs"},
+		{"Make All", "ma"},
+		{"kubectl get pods -n kube-system -o wide --watch", "kgpkw"},
+		{"a b c d e f g h", "abcdef"},
+		{"./build.sh --release", "bui"},
+		{"--", "cmd"},
+	}
+	for _, tt := range tests {
+		compare(t, "Name of "+tt.cmd+" differs", tt.want, aliasName(tt.cmd))
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	aliases, err := ParseAliases(strings.NewReader(
+		"alias ll='ls -l'\n" +
+			"dc='docker compose'\n" +
+			"  alias q='echo '\\''quoted'\\'''\n" +
+			"\n# comment\ninvalid\n" +
+			"g=git\n"))
+	if err != nil {
+		t.Fatal("ParseAliases failed:", err)
+	}
+	compare(t, "Aliases differ", map[string]string{
+		"ll": "ls -l",
+		"dc": "docker compose",
+		"q":  "echo 'quoted'",
+		"g":  "git",
+	}, aliases)
+}
+
+func TestPrintAliasSuggestions(t *testing.T) {
+	orig := commandExists
+	defer func() { commandExists = orig }()
+	commandExists = func(name string) bool {
+		return name == "gs"
+	}
+
+	data := strings.Repeat("1000\tz1\tdocker compose -f dev.yml exec web bash\n", 3) +
+		strings.Repeat("1100\tz1\tdocker compose -f dev.yml exec web sh\n", 2) +
+		strings.Repeat("1200\tz1\tgit status --short\n", 3) +
+		strings.Repeat("1300\tz1\tmake clean && make all\n", 3) +
+		"1400\tz1\tdocker compose -f dev.yml logs --follow\n"
+
+	tests := []struct {
+		name   string
+		arg    AliasArgs
+		output string
+	}{
+		{"Defaults", AliasArgs{MinCount: 3, MinLength: 10},
+			"# Run 5 times, saves 150 keystrokes\n" +
+				"alias dcew='docker compose -f dev.yml exec web'\n" +
+				"# Run 6 times, saves 138 keystrokes\n" +
+				"alias dc='docker compose -f dev.yml'\n" +
+				"# Run 3 times, saves 102 keystrokes\n" +
+				"alias dcewb='docker compose -f dev.yml exec web bash'\n" +
+				"# Run 3 times, saves 54 keystrokes\n" +
+				"mcma() {\n    make clean && make all\n}\n" +
+				"# Run 3 times, saves 45 keystrokes\n" +
+				"alias gs2='git status --short'\n" +
+				"# Run 3 times, saves 24 keystrokes\n" +
+				"alias mc='make clean'\n"},
+		{"Limit and length", AliasArgs{MinCount: 3, MinLength: 30, Limit: 1},
+			"# Run 5 times, saves 150 keystrokes\n" +
+				"alias dcew='docker compose -f dev.yml exec web'\n"},
+		{"Count", AliasArgs{MinCount: 6, MinLength: 10},
+			"# Run 6 times, saves 138 keystrokes\n" +
+				"alias dc='docker compose -f dev.yml'\n"},
+		{"Existing aliases", AliasArgs{MinCount: 6, MinLength: 10,
+			Aliases: map[string]string{"dc": "docker compose"}},
+			"# Run 6 times, saves 132 keystrokes\n" +
+				"alias dc2='docker compose -f dev.yml'\n"},
+		{"Covered by aliases", AliasArgs{MinCount: 6, MinLength: 10,
+			Aliases: map[string]string{"d": "docker compose -f dev.yml"}},
+			""},
+		{"Covered by aliases quoted differently", AliasArgs{MinCount: 6, MinLength: 10,
+			Aliases: map[string]string{"d": `docker  compose -f "dev.yml"`}},
+			""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			tt.arg.Output = out
+			err := PrintAliasSuggestions(&testLineReader{buf: bytes.NewBufferString(data)},
+				tt.arg)
+			if err != nil {
+				t.Fatal("PrintAliasSuggestions failed:", err)
+			}
+			compare(t, "Output differs", tt.output, out.String())
+		})
+	}
+}
+
+// The suggestions are ranked by the keystrokes saved with the final names
+func TestSuggestAliasesRanking(t *testing.T) {
+	orig := commandExists
+	defer func() { commandExists = orig }()
+	commandExists = func(name string) bool {
+		return strings.HasPrefix(name, "gs") && len(name) <= 3
+	}
+
+	data := strings.Repeat("1000\tz1\tgit status --short\n", 3) +
+		strings.Repeat("1100\tz1\tgo test -v ./lib/\n", 3)
+	suggestions, err := SuggestAliases(&testLineReader{buf: bytes.NewBufferString(data)},
+		AliasArgs{MinCount: 3, MinLength: 10})
+	if err != nil {
+		t.Fatal("SuggestAliases failed:", err)
+	}
+	compare(t, "Suggestions differ", []AliasSuggestion{
+		{Name: "gt", Command: "go test -v ./lib/", Count: 3, Saved: 45},
+		{Name: "gs10", Command: "git status --short", Count: 3, Saved: 42},
+	}, suggestions)
+}
@@ -0,0 +1,669 @@
+package cmdlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The binary store is a directory of append-only segment files named
+// 00000001.seg, 00000002.seg and so on. A segment starts with segmentMagic
+// and is followed by records:
+//
+//	session: 's' uvarint(length) name
+//	entry:   'e' varint(time delta) uvarint(session index) uvarint(length) command
+//
+// The session of an entry is an index to the dictionary of the recently
+// used sessions, the most recent first. A session record adds a session to
+// the start of the dictionary and an entry moves its session to the start.
+// The dictionary holds at most maxRecentSessions sessions. The time of an
+// entry is relative to the previous entry in the segment, or to zero for the
+// first one. A new segment is started when the last one grows beyond
+// segmentSize.
+//
+// To append without decoding the last segment, the store keeps the state of
+// the last segment after the previous append in the stateFile: the segment,
+// its size, the time of the last entry and the dictionary. The state is used
+// only if the size still matches the segment, so if it is not updated e.g.
+// after a crash, the segment is decoded instead.
+//
+// The range of the times of the entries of each full segment is kept in the
+// indexFile, one "NAME\tMIN\tMAX" line per segment. The line is added when
+// the next segment is started. Range skips the indexed segments that have no
+// entries in the range and always reads the segments missing from the index.
+const (
+	segmentMagic  = "CMDLOGB\x01"
+	segmentSuffix = ".seg"
+	stateFile     = "state"
+	indexFile     = "index"
+
+	recordSession = 's'
+	recordEntry   = 'e'
+
+	maxRecentSessions = 16
+)
+
+// recentSessions is the dictionary of the recently used sessions
+type recentSessions []string
+
+func (r recentSessions) index(session string) int {
+	for i := range r {
+		if r[i] == session {
+			return i
+		}
+	}
+	return -1
+}
+
+// add adds the session to the start and drops the least recently used
+// session if the dictionary is full
+func (r *recentSessions) add(session string) {
+	if len(*r) < maxRecentSessions {
+		*r = append(*r, "")
+	}
+	copy((*r)[1:], *r)
+	(*r)[0] = session
+}
+
+// use moves the session at the index to the start
+func (r recentSessions) use(i int) {
+	session := r[i]
+	copy(r[1:i+1], r[:i])
+	r[0] = session
+}
+
+// segmentSize is the size after which a new segment is started
+var segmentSize int64 = 4 * 1024 * 1024
+
+// listSegments returns the names of the segment files of the store in order
+func listSegments(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), segmentSuffix) {
+			ret = append(ret, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// segmentName returns the file name of the nth segment
+func segmentName(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", n, segmentSuffix))
+}
+
+// segmentNumber returns the number of the segment file
+func segmentNumber(file string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), segmentSuffix))
+	return n
+}
+
+// segmentRange returns the range of the times of the entries of the segment
+func segmentRange(file string) (min, max int64, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	d, err := newSegmentDecoder(file, data)
+	if err != nil {
+		return 0, 0, err
+	}
+	min, max = maxTime, minTime
+	for {
+		timeint, _, _, err := d.next()
+		if err == io.EOF {
+			return min, max, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if timeint < min {
+			min = timeint
+		}
+		if timeint > max {
+			max = timeint
+		}
+	}
+}
+
+// readIndex returns the time ranges of the indexed segments by their file
+// names. Malformed and incomplete lines are ignored.
+func readIndex(dir string) map[string][2]int64 {
+	ret := map[string][2]int64{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return ret
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		min, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		max, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		ret[fields[0]] = [2]int64{min, max}
+	}
+	return ret
+}
+
+// segmentDecoder reads the entries of a segment
+type segmentDecoder struct {
+	file string
+	data []byte
+	pos  int
+
+	sessions recentSessions
+	time     int64
+
+	// The segment ends in an incomplete record, which was cut short while
+	// appending
+	partial bool
+}
+
+func newSegmentDecoder(file string, data []byte) (*segmentDecoder, error) {
+	d := &segmentDecoder{file: file, data: data, pos: len(segmentMagic)}
+	if len(data) < len(segmentMagic) {
+		if !strings.HasPrefix(segmentMagic, string(data)) {
+			return nil, fmt.Errorf("%s: not a cmdlog segment", file)
+		}
+		d.pos = len(data)
+		d.partial = true
+	} else if string(data[:len(segmentMagic)]) != segmentMagic {
+		return nil, fmt.Errorf("%s: not a cmdlog segment", file)
+	}
+	return d, nil
+}
+
+// errPartialRecord is returned when the data ends in the middle of a record
+var errPartialRecord = fmt.Errorf("partial record")
+
+func (d *segmentDecoder) uvarint(pos *int) (uint64, error) {
+	v, n := binary.Uvarint(d.data[*pos:])
+	if n == 0 {
+		return 0, errPartialRecord
+	}
+	if n < 0 {
+		return 0, d.corrupted(*pos)
+	}
+	*pos += n
+	return v, nil
+}
+
+func (d *segmentDecoder) bytes(pos *int) ([]byte, error) {
+	length, err := d.uvarint(pos)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(d.data)-*pos) {
+		return nil, errPartialRecord
+	}
+	ret := d.data[*pos : *pos+int(length)]
+	*pos += int(length)
+	return ret, nil
+}
+
+func (d *segmentDecoder) corrupted(pos int) error {
+	return fmt.Errorf("%s: corrupted record at offset %d", d.file, pos)
+}
+
+// next decodes the next entry. The command refers to the segment data.
+// Returns io.EOF at the end of the segment. An incomplete record at the end
+// sets partial and also ends the segment.
+func (d *segmentDecoder) next() (timeint int64, session string, cmd []byte, err error) {
+	for d.pos < len(d.data) {
+		pos := d.pos
+		kind := d.data[pos]
+		pos++
+
+		switch kind {
+		case recordSession:
+			var name []byte
+			name, err = d.bytes(&pos)
+			if err == nil {
+				d.sessions.add(string(name))
+				d.pos = pos
+				continue
+			}
+		case recordEntry:
+			delta, n := binary.Varint(d.data[pos:])
+			switch {
+			case n == 0:
+				err = errPartialRecord
+			case n < 0:
+				err = d.corrupted(d.pos)
+			default:
+				pos += n
+			}
+			var index uint64
+			if err == nil {
+				index, err = d.uvarint(&pos)
+			}
+			if err == nil && index >= uint64(len(d.sessions)) {
+				err = d.corrupted(d.pos)
+			}
+			if err == nil {
+				cmd, err = d.bytes(&pos)
+			}
+			if err == nil {
+				d.sessions.use(int(index))
+				d.time += delta
+				d.pos = pos
+				return d.time, d.sessions[0], cmd, nil
+			}
+		default:
+			err = d.corrupted(d.pos)
+		}
+
+		if err != errPartialRecord {
+			return 0, "", nil, err
+		}
+		d.partial = true
+		break
+	}
+	return 0, "", nil, io.EOF
+}
+
+// segmentReader reads the entries of the segments of a store as log lines
+type segmentReader struct {
+	files   []string
+	reverse bool
+
+	// The range of the returned entries
+	since int64
+	until int64
+
+	// The remaining lines of the current segment in the order they are
+	// returned
+	lines []string
+}
+
+// readSegment reads the lines of the next segment
+func (r *segmentReader) readSegment() error {
+	var file string
+	if r.reverse {
+		file = r.files[len(r.files)-1]
+		r.files = r.files[:len(r.files)-1]
+	} else {
+		file = r.files[0]
+		r.files = r.files[1:]
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	d, err := newSegmentDecoder(file, data)
+	if err != nil {
+		return err
+	}
+	for {
+		timeint, session, cmd, err := d.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if timeint >= r.since && timeint < r.until {
+			r.lines = append(r.lines, formatLogLine(timeint, session, string(cmd)))
+		}
+	}
+
+	if r.reverse {
+		for i, j := 0, len(r.lines)-1; i < j; i, j = i+1, j-1 {
+			r.lines[i], r.lines[j] = r.lines[j], r.lines[i]
+		}
+	}
+	return nil
+}
+
+func (r *segmentReader) ReadLine() (string, error) {
+	for len(r.lines) == 0 {
+		if len(r.files) == 0 {
+			return "", io.EOF
+		}
+		err := r.readSegment()
+		if err != nil {
+			return "", err
+		}
+	}
+	line := r.lines[0]
+	r.lines = r.lines[1:]
+	return line, nil
+}
+
+// binaryStore is the log in the binary segment format
+type binaryStore struct {
+	dir  string
+	lock lockFunc
+
+	// The last segment opened for appending and its state after the
+	// previous append
+	out      *os.File
+	segment  string
+	size     int64
+	sessions recentSessions
+	time     int64
+
+	// The state has changed since it was written to the stateFile
+	dirty bool
+}
+
+// openSegment opens the last segment for appending and reads its state. If
+// the last segment is full, a new one is started. An incomplete record at
+// the end of the segment is removed.
+func (s *binaryStore) openSegment() error {
+	if s.out != nil {
+		s.out.Close()
+		s.out = nil
+	}
+
+	files, err := listSegments(s.dir)
+	if err != nil {
+		return err
+	}
+
+	s.sessions = nil
+	s.time = 0
+
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		info, err := os.Stat(last)
+		if err != nil {
+			return err
+		}
+		if info.Size() < segmentSize {
+			if s.readState(last, info.Size()) {
+				s.out, err = os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0600)
+				s.segment = last
+				s.size = info.Size()
+				return err
+			}
+			return s.readSegment(last)
+		}
+		// If the range cannot be read, the segment is not indexed
+		// and Range always reads it
+		if min, max, err := segmentRange(last); err == nil {
+			err = s.indexSegment(last, min, max)
+			if err != nil {
+				return err
+			}
+		}
+		s.segment = segmentName(s.dir, segmentNumber(last)+1)
+	} else {
+		s.segment = segmentName(s.dir, 1)
+	}
+
+	s.out, err = os.OpenFile(s.segment, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.WriteString(s.out, segmentMagic)
+	s.size = int64(n)
+	return err
+}
+
+// readSegment opens the segment for appending and reads its state
+func (s *binaryStore) readSegment(file string) error {
+	fp, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(fp)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	d, err := newSegmentDecoder(file, data)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	for {
+		_, _, _, err = d.next()
+		if err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		fp.Close()
+		return err
+	}
+
+	if d.partial {
+		err = fp.Truncate(int64(d.pos))
+		if err == nil && d.pos < len(segmentMagic) {
+			_, err = io.WriteString(fp, segmentMagic[d.pos:])
+			d.pos = len(segmentMagic)
+		}
+		if err != nil {
+			fp.Close()
+			return err
+		}
+	}
+
+	s.sessions = d.sessions
+	s.time = d.time
+	s.out = fp
+	s.segment = file
+	s.size = int64(d.pos)
+	return nil
+}
+
+// indexSegment adds the range of the times of the full segment to the
+// indexFile
+func (s *binaryStore) indexSegment(file string, min, max int64) error {
+	fp, err := os.OpenFile(filepath.Join(s.dir, indexFile),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fp, "%s\t%d\t%d\n", filepath.Base(file), min, max)
+	cerr := fp.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readState reads the state of the segment from the stateFile. Returns false
+// if the state is missing or it is not for the segment of the given size.
+func (s *binaryStore) readState(file string, size int64) bool {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, stateFile))
+	if err != nil {
+		return false
+	}
+	if !bytes.HasSuffix(data, []byte{'\n'}) {
+		return false
+	}
+	lines := strings.Split(string(data[:len(data)-1]), "\n")
+	fields := strings.Split(lines[0], "\t")
+	if len(fields) != 3 || fields[0] != filepath.Base(file) ||
+		len(lines)-1 > maxRecentSessions {
+		return false
+	}
+	stateSize, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || stateSize != size {
+		return false
+	}
+	timeint, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return false
+	}
+	s.time = timeint
+	s.sessions = lines[1:]
+	return true
+}
+
+// writeState writes the state after the previous append to the stateFile.
+// The file is replaced with a rename so that it is never partially written.
+func (s *binaryStore) writeState() error {
+	if !s.dirty {
+		return nil
+	}
+	if s.lock != nil {
+		unlock, err := s.lock(true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, stateFile+".tmp")
+	if err != nil {
+		return err
+	}
+	state := fmt.Sprintf("%s\t%d\t%d\n", filepath.Base(s.segment), s.size, s.time)
+	for _, session := range s.sessions {
+		state += session + "\n"
+	}
+	_, err = io.WriteString(tmp, state)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, stateFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// isCurrent returns true if the segment opened for appending is the last
+// one and no one else has appended to it
+func (s *binaryStore) isCurrent() bool {
+	if s.out == nil || s.lock == nil {
+		return s.out != nil
+	}
+	info, err := s.out.Stat()
+	if err != nil || info.Size() != s.size || s.size >= segmentSize {
+		return false
+	}
+	return !FileExists(segmentName(s.dir, segmentNumber(s.segment)+1))
+}
+
+func (s *binaryStore) Append(timeint int64, session string, cmd string) error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if s.lock != nil {
+		unlock, err := s.lock(true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if !s.isCurrent() || s.size >= segmentSize {
+		// The state of the previous segment is not needed anymore
+		s.dirty = false
+		err := s.openSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	buf := bytes.Buffer{}
+	sessions := append(recentSessions{}, s.sessions...)
+	index := sessions.index(session)
+	if index < 0 {
+		buf.WriteByte(recordSession)
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(session)))])
+		buf.WriteString(session)
+		sessions.add(session)
+		index = 0
+	}
+	sessions.use(index)
+	buf.WriteByte(recordEntry)
+	buf.Write(tmp[:binary.PutVarint(tmp[:], timeint-s.time)])
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(index))])
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(cmd)))])
+	buf.WriteString(cmd)
+
+	n, err := s.out.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		// The state is read again on the next append
+		s.out.Close()
+		s.out = nil
+		s.dirty = false
+		return err
+	}
+
+	s.sessions = sessions
+	s.time = timeint
+	s.dirty = true
+	return nil
+}
+
+func (s *binaryStore) Scan(reverse bool) (LineReader, error) {
+	return s.Range(minTime, maxTime, reverse)
+}
+
+func (s *binaryStore) Range(since, until int64, reverse bool) (LineReader, error) {
+	files, err := listSegments(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	if since != minTime || until != maxTime {
+		index := readIndex(s.dir)
+		inRange := files[:0]
+		for _, file := range files {
+			r, ok := index[filepath.Base(file)]
+			if !ok || r[1] >= since && r[0] < until {
+				inRange = append(inRange, file)
+			}
+		}
+		files = inRange
+	}
+	return &segmentReader{
+		files:   files,
+		reverse: reverse,
+		since:   since,
+		until:   until,
+	}, nil
+}
+
+func (s *binaryStore) Close() error {
+	if s.out == nil {
+		return nil
+	}
+	err := s.writeState()
+	cerr := s.out.Close()
+	if err == nil {
+		err = cerr
+	}
+	s.out = nil
+	return err
+}
+
+// The limits of the timestamps for scanning the whole store
+const (
+	minTime = -1 << 63
+	maxTime = 1<<63 - 1
+)
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/kopoli/appkit"
@@ -17,7 +19,199 @@ func EnvStringFlag(set *flag.FlagSet, name, defvalue, usage, envVar string) *str
 	return set.String(name, val, fmt.Sprintf("%s ($%s)", usage, envVar))
 }
 
+// parseDefaults parses the default arguments to the flags that were not set
+// on the command line
+func parseDefaults(fs *flag.FlagSet, defaults string) error {
+	if defaults == "" {
+		return nil
+	}
+
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	args := []string{}
+	for _, tok := range splitShell(defaults) {
+		args = append(args, tok.Value)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	for name, value := range set {
+		err = fs.Set(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportFlags are the flags that select and format the commands of a report
+type reportFlags struct {
+	pwd, reverse, notes, ids, here, recursive, multiline *bool
+	follow, starred, starredFirst                        *bool
+	session, since, grep, tag, program, dir              *string
+	limit, offset, after, before, context                *int
+}
+
+// addReportFlags adds the report flags to fs. The flags that need the local
+// log file and stars are added only if local is set.
+func addReportFlags(fs *flag.FlagSet, local bool) *reportFlags {
+	f := &reportFlags{
+		follow:       new(bool),
+		starred:      new(bool),
+		starredFirst: new(bool),
+	}
+	f.pwd = fs.Bool("pwd", false,
+		"Print also the current directory where the command was run")
+	f.session = fs.String("session", "",
+		"Display commands of the given session")
+	f.since = fs.String("since", "",
+		"Display commands starting from given date")
+	f.reverse = fs.Bool("reverse", false,
+		"Display commands in reverse")
+	f.grep = fs.String("grep", "",
+		"Display commands matching given regular expression")
+	f.tag = fs.String("tag", "",
+		"Display commands with the given tag")
+	f.program = fs.String("program", "",
+		"Display commands running the given program, also after sudo, env, time or a pipe")
+	f.notes = fs.Bool("notes", false,
+		"Display the tags and notes of the commands")
+	f.ids = fs.Bool("ids", false,
+		"Display the IDs of the commands")
+	f.limit = fs.Int("limit", 0,
+		"Display at most the given number of commands")
+	f.offset = fs.Int("offset", 0,
+		"Skip the given number of commands before displaying")
+	f.after = fs.Int("A", 0,
+		"Display the given number of commands of the same session after each -grep match")
+	f.before = fs.Int("B", 0,
+		"Display the given number of commands of the same session before each -grep match")
+	f.context = fs.Int("C", 0,
+		"Display the given number of commands of the same session around each -grep match")
+	f.dir = fs.String("dir", "",
+		"Display commands run in the given directory")
+	f.here = fs.Bool("here", false,
+		"Display commands run in the current directory")
+	f.recursive = fs.Bool("recursive", false,
+		"Display also commands run in the subdirectories of -dir or -here")
+	if local {
+		f.follow = fs.Bool("follow", false,
+			"Keep displaying new commands as they are logged")
+		f.starred = fs.Bool("starred", false,
+			"Display only the starred commands")
+		f.starredFirst = fs.Bool("starred-first", false,
+			"Display the starred commands before the others")
+	}
+	f.multiline = fs.Bool("multiline", false,
+		"Display the commands as they were typed instead of escaping newlines and tabs")
+	return f
+}
+
+// set checks the report flags and sets them to the report-* options
+func (f *reportFlags) set(opts appkit.Options) error {
+	if *f.pwd {
+		opts.Set("report-pwd", "t")
+	}
+	if *f.reverse {
+		opts.Set("report-reverse", "t")
+	}
+	opts.Set("report-session", *f.session)
+	opts.Set("report-since", *f.since)
+	opts.Set("report-grep", *f.grep)
+	opts.Set("report-tag", *f.tag)
+	opts.Set("report-program", *f.program)
+	if *f.notes {
+		opts.Set("report-notes", "t")
+	}
+	if *f.ids {
+		opts.Set("report-ids", "t")
+	}
+	if *f.limit < 0 || *f.offset < 0 {
+		return fmt.Errorf("-limit and -offset must not be negative")
+	}
+	opts.Set("report-limit", strconv.Itoa(*f.limit))
+	opts.Set("report-offset", strconv.Itoa(*f.offset))
+	if *f.after < 0 || *f.before < 0 || *f.context < 0 {
+		return fmt.Errorf("-A, -B and -C must not be negative")
+	}
+	if (*f.after > 0 || *f.before > 0 || *f.context > 0) && *f.grep == "" {
+		return fmt.Errorf("-A, -B and -C require -grep")
+	}
+	if *f.after == 0 {
+		*f.after = *f.context
+	}
+	if *f.before == 0 {
+		*f.before = *f.context
+	}
+	opts.Set("report-after", strconv.Itoa(*f.after))
+	opts.Set("report-before", strconv.Itoa(*f.before))
+	if *f.dir != "" && *f.here {
+		return fmt.Errorf("-dir and -here are mutually exclusive")
+	}
+	if *f.here {
+		*f.dir = os.Getenv("PWD")
+		if *f.dir == "" {
+			var err error
+			*f.dir, err = os.Getwd()
+			if err != nil {
+				return fmt.Errorf("could not determine the current directory: %v", err)
+			}
+		}
+	}
+	if *f.dir != "" {
+		dir, err := filepath.Abs(*f.dir)
+		if err != nil {
+			return fmt.Errorf("invalid directory %s: %v", *f.dir, err)
+		}
+		opts.Set("report-dir", dir)
+	}
+	if *f.recursive {
+		opts.Set("report-recursive", "t")
+	}
+	if *f.follow && (*f.reverse || *f.starredFirst) {
+		return fmt.Errorf("-follow cannot be used with -reverse or -starred-first")
+	}
+	if *f.follow {
+		opts.Set("report-follow", "t")
+	}
+	if *f.starred && *f.starredFirst {
+		return fmt.Errorf("-starred and -starred-first are mutually exclusive")
+	}
+	if *f.starred {
+		opts.Set("report-starred", "t")
+	}
+	if *f.starredFirst {
+		opts.Set("report-starred-first", "t")
+	}
+	if *f.multiline {
+		opts.Set("report-multiline", "t")
+	}
+	return nil
+}
+
+// Commands returns the base command and the commands of the command line,
+// e.g. for writing the completion scripts
+func Commands(opts appkit.Options) (*appkit.Command, []*appkit.Command) {
+	base, commands, _ := newCli(opts)
+	return base, commands
+}
+
 func Cli(opts appkit.Options, argsin []string) error {
+	_, _, parse := newCli(opts)
+	return parse(argsin)
+}
+
+// newCli creates the commands of the command line. The returned parse
+// function parses the arguments and sets them to the options.
+func newCli(opts appkit.Options) (*appkit.Command, []*appkit.Command, func(argsin []string) error) {
 	help := fmt.Sprintf("Command logging and reporting."+
 		"\n\nUsage: %s [OPTIONS] <COMMAND>", opts.Get("program-name", "cmdlog"))
 	base := appkit.NewCommand(nil, "", help)
@@ -30,6 +224,21 @@ func Cli(opts appkit.Options, argsin []string) error {
 	optCmdFilterFile := EnvStringFlag(base.Flags, "filter",
 		opts.Get("cmdlog-filter-file", "cmdlog-filter.debug"),
 		"File name of the command line filter file", "CMDLOG_FILTERS")
+	optSyncDir := EnvStringFlag(base.Flags, "sync-dir",
+		opts.Get("cmdlog-sync-dir", ""),
+		"Directory of per-host command log segments", "CMDLOG_SYNC_DIR")
+	optHost := EnvStringFlag(base.Flags, "host",
+		opts.Get("cmdlog-host", ""),
+		"Host name of the segment in the sync directory", "CMDLOG_HOST")
+	optRetention := EnvStringFlag(base.Flags, "retention",
+		opts.Get("cmdlog-retention", ""),
+		"Retention policy of the command log, e.g. \"90d,5y\"", "CMDLOG_RETENTION")
+	optTimeFormat := EnvStringFlag(base.Flags, "time-format",
+		opts.Get("cmdlog-time-format", ""),
+		"Format of the displayed times as a Go time layout", "CMDLOG_TIME_FORMAT")
+	optRelativeTime := EnvStringFlag(base.Flags, "relative-time",
+		opts.Get("cmdlog-relative-time", ""),
+		"Display times more recent than this relative to now, e.g. \"7d\"", "CMDLOG_RELATIVE_TIME")
 	optCPUProfile := EnvStringFlag(base.Flags, "profile",
 		"",
 		"File name to save CPU profile", "CMDLOG_CPUPROFILE")
@@ -38,64 +247,418 @@ func Cli(opts appkit.Options, argsin []string) error {
 		"File name to save memory profile", "CMDLOG_MEMPROFILE")
 
 	log := appkit.NewCommand(base, "log", "Log a new command line")
+	optLogStdin := log.Flags.Bool("stdin", false,
+		"Read the command line verbatim from the standard input instead of ARGS")
 
 	log.Flags.Usage = func() {
 		out := log.Flags.Output()
 		fmt.Fprintf(out, "Command: log [OPTIONS] SESSION ARGS[...]\n\n"+
 			"%s\n\nParameters:\n"+
 			"  SESSION   Command session identifier\n"+
-			"  ARGS      Command line arguments\n", log.Help)
+			"  ARGS      Command line arguments. Multiple arguments are joined\n"+
+			"            with spaces, a single argument is logged verbatim\n"+
+			"\nOptions:\n", log.Help)
+		log.Flags.PrintDefaults()
 	}
 
 	report := appkit.NewCommand(base, "report", "Generate a report from the command log")
-	optPwd := report.Flags.Bool("pwd", false,
-		"Print also the current directory where the command was run")
-	optSession := report.Flags.String("session", "",
-		"Display commands of the given session")
-	optSince := report.Flags.String("since", "",
-		"Display commands starting from given date")
-	optReverse := report.Flags.Bool("reverse", false,
-		"Display commands in reverse")
-	optGrep := report.Flags.String("grep", "",
-		"Display commands matching given regular expression")
+	optReport := addReportFlags(report.Flags, true)
 
-	_ = appkit.NewCommand(base, "filters", "Print log line filters")
+	filters := appkit.NewCommand(base, "filters", "Print log line filters")
 
-	err := base.Parse(argsin, opts)
-	if err == flag.ErrHelp || *optVersion {
-		if *optVersion {
-			fmt.Println(appkit.VersionString(opts))
-		}
-		opts.Set("cmdline-command", "done")
-		return nil
+	tag := appkit.NewCommand(base, "tag", "Add tags and a note to a command")
+	optTagSession := tag.Flags.String("session", "",
+		"Session of the command")
+	optTagNote := tag.Flags.String("note", "",
+		"Note of the command")
+
+	tag.Flags.Usage = func() {
+		out := tag.Flags.Output()
+		fmt.Fprintf(out, "Command: tag [OPTIONS] ENTRY [TAG...]\n\n"+
+			"%s\n\nParameters:\n"+
+			"  ENTRY     ID of the command from \"report -ids\" or \"last\"\n"+
+			"            for the last command of -session\n"+
+			"  TAG       Tag for the command\n"+
+			"\nOptions:\n", tag.Help)
+		tag.Flags.PrintDefaults()
 	}
 
-	opts.Set("cmdlog-file", *optCmdFile)
-	opts.Set("cmdlog-filter-file", *optCmdFilterFile)
-	opts.Set("profile-cpu-file", *optCPUProfile)
-	opts.Set("profile-mem-file", *optMemProfile)
+	star := appkit.NewCommand(base, "star", "Star a command as a favorite")
+	optStarSession := star.Flags.String("session", "",
+		"Session of the command")
+	optStarRemove := star.Flags.Bool("remove", false,
+		"Remove the star of the command")
 
-	cmd := opts.Get("cmdline-command", "")
-	switch cmd {
-	case "log":
-		args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
-		if len(args) < 2 {
-			return fmt.Errorf("invalid arguments for log: %s",
-				strings.Join(args, " "))
-		}
-		opts.Set("log-session", args[0])
-		opts.Set("log-args", strings.Join(args[1:], " "))
-	case "report":
-		if *optPwd {
-			opts.Set("report-pwd", "t")
+	star.Flags.Usage = func() {
+		out := star.Flags.Output()
+		fmt.Fprintf(out, "Command: star [OPTIONS] [ENTRY]\n\n"+
+			"%s\n\nParameters:\n"+
+			"  ENTRY     ID of the command from \"report -ids\" or \"last\"\n"+
+			"            for the last command of -session. Default is \"last\"\n"+
+			"\nOptions:\n", star.Help)
+		star.Flags.PrintDefaults()
+	}
+
+	sessions := appkit.NewCommand(base, "sessions", "List the sessions in the command log")
+	optSessionsSince := sessions.Flags.String("since", "",
+		"Display sessions with commands starting from given date")
+	optSessionsGrep := sessions.Flags.String("grep", "",
+		"Display sessions with commands matching given regular expression")
+	optSessionsReverse := sessions.Flags.Bool("reverse", false,
+		"Display the most recently active sessions first")
+	optSessionsJSON := sessions.Flags.Bool("json", false,
+		"Display the sessions in JSON")
+
+	stats := appkit.NewCommand(base, "stats", "Count how many times each program was run")
+	optStatsSession := stats.Flags.String("session", "",
+		"Count the programs of the given session")
+	optStatsSince := stats.Flags.String("since", "",
+		"Count the programs starting from given date")
+	optStatsProgram := stats.Flags.String("program", "",
+		"Count the subcommands of the given program")
+	optStatsLimit := stats.Flags.Int("limit", 0,
+		"Display at most the given number of programs")
+
+	suggest := appkit.NewCommand(base, "suggest-aliases",
+		"Suggest aliases for frequently repeated long commands")
+	optSuggestSession := suggest.Flags.String("session", "",
+		"Suggest aliases for the commands of the given session")
+	optSuggestSince := suggest.Flags.String("since", "",
+		"Suggest aliases for the commands starting from given date")
+	optSuggestAliases := suggest.Flags.String("aliases", "",
+		"File of the existing aliases in the output format of the alias command, or - for the standard input")
+	optSuggestMinCount := suggest.Flags.Int("min-count", 3,
+		"Suggest commands repeated at least the given number of times")
+	optSuggestMinLength := suggest.Flags.Int("min-length", 20,
+		"Suggest commands of at least the given length")
+	optSuggestLimit := suggest.Flags.Int("limit", 10,
+		"Suggest at most the given number of aliases, 0 for all")
+
+	forget := appkit.NewCommand(base, "forget", "Remove matching commands from the command log")
+	optForgetSession := forget.Flags.String("session", "",
+		"Remove commands of the given session")
+	optForgetSince := forget.Flags.String("since", "",
+		"Remove commands starting from given date")
+	optForgetUntil := forget.Flags.String("until", "",
+		"Remove commands up to given date")
+	optForgetGrep := forget.Flags.String("grep", "",
+		"Remove commands matching given regular expression")
+	optForgetFilters := forget.Flags.Bool("filters", false,
+		"Remove commands matching the log line filters")
+	optForgetDryRun := forget.Flags.Bool("dry-run", false,
+		"Only print the commands that would be removed")
+	optForgetBackup := forget.Flags.Bool("backup", false,
+		"Keep the previous command log in a backup file")
+
+	compact := appkit.NewCommand(base, "compact", "Compact the command log according to the retention policy")
+	optCompactDryRun := compact.Flags.Bool("dry-run", false,
+		"Only print the commands that would be removed")
+	optCompactBackup := compact.Flags.Bool("backup", false,
+		"Keep the previous command log in a backup file")
+	optCompactIfNeeded := compact.Flags.Bool("if-needed", false,
+		"Compact only if the log has not been compacted during the last day")
+
+	fsck := appkit.NewCommand(base, "fsck", "Check the command log for malformed lines and repair them")
+	optFsckRepair := fsck.Flags.Bool("repair", false,
+		"Repair the problems and move the lines that cannot be repaired to a quarantine file")
+	optFsckBackup := fsck.Flags.Bool("backup", false,
+		"Keep the previous command log in a backup file when repairing")
+
+	merge := appkit.NewCommand(base, "merge", "Merge command logs by time")
+	optMergeTag := merge.Flags.Bool("tag", false,
+		"Prefix the sessions with the host of the log")
+	optMergeOutput := merge.Flags.String("output", "",
+		"File name to write the merged log to instead of stdout")
+
+	merge.Flags.Usage = func() {
+		out := merge.Flags.Output()
+		fmt.Fprintf(out, "Command: merge [OPTIONS] FILE[=HOST] [...]\n\n"+
+			"%s\n\nParameters:\n"+
+			"  FILE      Command log file\n"+
+			"  HOST      Host of the log. Default is the file name\n"+
+			"\nOptions:\n", merge.Help)
+		merge.Flags.PrintDefaults()
+	}
+
+	serve := appkit.NewCommand(base, "serve", "Serve command logs over HTTP")
+	optServeAddr := serve.Flags.String("addr", "localhost:8080",
+		"Address to listen to")
+	optServeDir := serve.Flags.String("dir", "",
+		"Directory to store the command logs of the users")
+	optServeTokens := serve.Flags.String("tokens", "",
+		"File with lines of authentication tokens and users: TOKEN USER")
+
+	push := appkit.NewCommand(base, "push", "Push new commands to a cmdlog server")
+	optPushServer := EnvStringFlag(push.Flags, "server", "",
+		"URL of the cmdlog server", "CMDLOG_SERVER")
+	optPushToken := EnvStringFlag(push.Flags, "token", "",
+		"Authentication token for the cmdlog server", "CMDLOG_TOKEN")
+
+	search := appkit.NewCommand(base, "search", "Generate a report from the command log on a cmdlog server")
+	optSearchServer := EnvStringFlag(search.Flags, "server", "",
+		"URL of the cmdlog server", "CMDLOG_SERVER")
+	optSearchToken := EnvStringFlag(search.Flags, "token", "",
+		"Authentication token for the cmdlog server", "CMDLOG_TOKEN")
+	optSearch := addReportFlags(search.Flags, false)
+
+	pull := appkit.NewCommand(base, "pull", "Pull new commands from a cmdlog server")
+	optPullServer := EnvStringFlag(pull.Flags, "server", "",
+		"URL of the cmdlog server", "CMDLOG_SERVER")
+	optPullToken := EnvStringFlag(pull.Flags, "token", "",
+		"Authentication token for the cmdlog server", "CMDLOG_TOKEN")
+	optPullOutput := pull.Flags.String("output", "",
+		"File name to append the pulled commands to (default: the command log file with .remote suffix, which report reads)")
+	optPullAll := pull.Flags.Bool("all", false,
+		"Pull also the commands pushed from this host")
+
+	migrate := appkit.NewCommand(base, "migrate",
+		"Move the command log and filters from the home directory to the XDG directories")
+
+	convert := appkit.NewCommand(base, "convert", "Convert the command log to another storage format")
+	optConvertFormat := convert.Flags.String("format", "",
+		"Format to convert to: "+strings.Join(StoreFormats, " or ")+" (default: the other format)")
+	optConvertOutput := convert.Flags.String("output", "",
+		"File name to write the converted log to instead of replacing the command log")
+
+	unescape := appkit.NewCommand(base, "unescape", "Print the original text of escaped commands")
+
+	unescape.Flags.Usage = func() {
+		out := unescape.Flags.Output()
+		fmt.Fprintf(out, "Command: unescape [COMMAND...]\n\n"+
+			"%s\n\nParameters:\n"+
+			"  COMMAND   Escaped command as displayed by report. Without\n"+
+			"            arguments the lines of the standard input are unescaped.\n",
+			unescape.Help)
+	}
+
+	completion := appkit.NewCommand(base, "completion", "Print a shell completion script")
+
+	completion.Flags.Usage = func() {
+		out := completion.Flags.Output()
+		fmt.Fprintf(out, "Command: completion SHELL\n\n"+
+			"%s\n\nParameters:\n"+
+			"  SHELL     One of: %s\n", completion.Help,
+			strings.Join(completionShells, ", "))
+	}
+
+	commands := []*appkit.Command{log, report, filters, tag, star, sessions,
+		stats, suggest, forget, compact, fsck, merge, serve, push, search, pull, migrate, convert, unescape, completion}
+
+	parse := func(argsin []string) error {
+		err := base.Parse(argsin, opts)
+		if err == flag.ErrHelp || *optVersion {
+			if *optVersion {
+				fmt.Println(appkit.VersionString(opts))
+			}
+			opts.Set("cmdline-command", "done")
+			return nil
 		}
-		if *optReverse {
-			opts.Set("report-reverse", "t")
+
+		opts.Set("cmdlog-file", *optCmdFile)
+		opts.Set("cmdlog-filter-file", *optCmdFilterFile)
+		opts.Set("cmdlog-sync-dir", *optSyncDir)
+		opts.Set("cmdlog-host", *optHost)
+		opts.Set("cmdlog-retention", *optRetention)
+		opts.Set("cmdlog-time-format", *optTimeFormat)
+		opts.Set("cmdlog-relative-time", *optRelativeTime)
+		opts.Set("profile-cpu-file", *optCPUProfile)
+		opts.Set("profile-mem-file", *optMemProfile)
+
+		cmd := opts.Get("cmdline-command", "")
+		switch cmd {
+		case "log":
+			args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
+			if *optLogStdin {
+				if len(args) != 1 || args[0] == "" {
+					return fmt.Errorf("give only the session with -stdin")
+				}
+				opts.Set("log-session", args[0])
+				opts.Set("log-stdin", "t")
+				break
+			}
+			if len(args) < 2 {
+				return fmt.Errorf("invalid arguments for log: %s",
+					strings.Join(args, " "))
+			}
+			opts.Set("log-session", args[0])
+			opts.Set("log-args", strings.Join(args[1:], " "))
+		case "report":
+			err = parseDefaults(report.Flags, opts.Get("cmdlog-report-args", ""))
+			if err != nil {
+				return fmt.Errorf("invalid default report flags: %v", err)
+			}
+			err = optReport.set(opts)
+			if err != nil {
+				return err
+			}
+		case "tag":
+			args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
+			if len(args) < 1 || args[0] == "" {
+				return fmt.Errorf("no entry given to tag")
+			}
+			if len(args) < 2 && *optTagNote == "" {
+				return fmt.Errorf("no tags or note given")
+			}
+			if args[0] == "last" && *optTagSession == "" {
+				return fmt.Errorf("last requires -session")
+			}
+			opts.Set("tag-entry", args[0])
+			opts.Set("tag-tags", appkit.JoinArguments(args[1:]))
+			opts.Set("tag-session", *optTagSession)
+			opts.Set("tag-note", *optTagNote)
+		case "star":
+			entry := "last"
+			args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
+			if len(args) > 1 {
+				return fmt.Errorf("too many arguments for star: %s",
+					strings.Join(args, " "))
+			}
+			if args[0] != "" {
+				entry = args[0]
+			}
+			if entry == "last" && *optStarSession == "" {
+				return fmt.Errorf("last requires -session")
+			}
+			if *optStarRemove {
+				opts.Set("star-remove", "t")
+			}
+			opts.Set("star-entry", entry)
+			opts.Set("star-session", *optStarSession)
+		case "sessions":
+			if *optSessionsReverse {
+				opts.Set("sessions-reverse", "t")
+			}
+			if *optSessionsJSON {
+				opts.Set("sessions-json", "t")
+			}
+			opts.Set("sessions-since", *optSessionsSince)
+			opts.Set("sessions-grep", *optSessionsGrep)
+		case "stats":
+			if *optStatsLimit < 0 {
+				return fmt.Errorf("-limit must not be negative")
+			}
+			opts.Set("stats-session", *optStatsSession)
+			opts.Set("stats-since", *optStatsSince)
+			opts.Set("stats-program", *optStatsProgram)
+			opts.Set("stats-limit", strconv.Itoa(*optStatsLimit))
+		case "suggest-aliases":
+			if *optSuggestMinCount < 1 || *optSuggestMinLength < 1 {
+				return fmt.Errorf("-min-count and -min-length must be positive")
+			}
+			if *optSuggestLimit < 0 {
+				return fmt.Errorf("-limit must not be negative")
+			}
+			opts.Set("suggest-session", *optSuggestSession)
+			opts.Set("suggest-since", *optSuggestSince)
+			opts.Set("suggest-aliases", *optSuggestAliases)
+			opts.Set("suggest-min-count", strconv.Itoa(*optSuggestMinCount))
+			opts.Set("suggest-min-length", strconv.Itoa(*optSuggestMinLength))
+			opts.Set("suggest-limit", strconv.Itoa(*optSuggestLimit))
+		case "forget":
+			if *optForgetFilters {
+				opts.Set("forget-filters", "t")
+			}
+			if *optForgetDryRun {
+				opts.Set("forget-dry-run", "t")
+			}
+			if *optForgetBackup {
+				opts.Set("forget-backup", "t")
+			}
+			opts.Set("forget-session", *optForgetSession)
+			opts.Set("forget-since", *optForgetSince)
+			opts.Set("forget-until", *optForgetUntil)
+			opts.Set("forget-grep", *optForgetGrep)
+		case "merge":
+			args := opts.Get("cmdline-args", "")
+			if args == "" {
+				return fmt.Errorf("no files given to merge")
+			}
+			if *optMergeTag {
+				opts.Set("merge-tag", "t")
+			}
+			opts.Set("merge-files", args)
+			opts.Set("merge-output", *optMergeOutput)
+		case "serve":
+			if *optServeDir == "" || *optServeTokens == "" {
+				return fmt.Errorf("serve requires -dir and -tokens")
+			}
+			opts.Set("serve-addr", *optServeAddr)
+			opts.Set("serve-dir", *optServeDir)
+			opts.Set("serve-tokens", *optServeTokens)
+		case "push":
+			if *optPushServer == "" {
+				return fmt.Errorf("push requires -server")
+			}
+			opts.Set("client-server", *optPushServer)
+			opts.Set("client-token", *optPushToken)
+		case "search":
+			if *optSearchServer == "" {
+				return fmt.Errorf("search requires -server")
+			}
+			err = optSearch.set(opts)
+			if err != nil {
+				return err
+			}
+			opts.Set("client-server", *optSearchServer)
+			opts.Set("client-token", *optSearchToken)
+		case "pull":
+			if *optPullServer == "" {
+				return fmt.Errorf("pull requires -server")
+			}
+			if *optPullAll {
+				opts.Set("pull-all", "t")
+			}
+			opts.Set("client-server", *optPullServer)
+			opts.Set("client-token", *optPullToken)
+			opts.Set("pull-output", *optPullOutput)
+		case "convert":
+			if *optConvertFormat != "" {
+				valid := false
+				for _, format := range StoreFormats {
+					valid = valid || format == *optConvertFormat
+				}
+				if !valid {
+					return fmt.Errorf("invalid format \"%s\", expected one of: %s",
+						*optConvertFormat, strings.Join(StoreFormats, ", "))
+				}
+			}
+			opts.Set("convert-format", *optConvertFormat)
+			opts.Set("convert-output", *optConvertOutput)
+		case "unescape":
+			args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
+			if len(args) != 1 || args[0] != "" {
+				opts.Set("unescape-args", strings.Join(args, " "))
+			}
+		case "completion":
+			args := appkit.SplitArguments(opts.Get("cmdline-args", ""))
+			if len(args) != 1 || args[0] == "" {
+				return fmt.Errorf("give one shell to print the completion for")
+			}
+			opts.Set("completion-shell", args[0])
+		case "fsck":
+			if *optFsckBackup && !*optFsckRepair {
+				return fmt.Errorf("-backup requires -repair")
+			}
+			if *optFsckRepair {
+				opts.Set("fsck-repair", "t")
+			}
+			if *optFsckBackup {
+				opts.Set("fsck-backup", "t")
+			}
+		case "compact":
+			if *optCompactDryRun {
+				opts.Set("compact-dry-run", "t")
+			}
+			if *optCompactBackup {
+				opts.Set("compact-backup", "t")
+			}
+			if *optCompactIfNeeded {
+				opts.Set("compact-if-needed", "t")
+			}
 		}
-		opts.Set("report-session", *optSession)
-		opts.Set("report-since", *optSince)
-		opts.Set("report-grep", *optGrep)
+
+		return nil
 	}
 
-	return nil
+	return base, commands, parse
 }
@@ -0,0 +1,269 @@
+package cmdlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Client accesses the API of a cmdlog Server.
+type Client struct {
+	URL   string
+	Token string
+
+	// The HTTP client to use. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func (c *Client) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := strings.TrimSuffix(c.URL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Append sends the log lines read from r to the server. The sessions are
+// tagged with the host.
+func (c *Client) Append(host string, r io.Reader) error {
+	query := url.Values{}
+	if host != "" {
+		query.Set("host", host)
+	}
+	resp, err := c.do(http.MethodPost, apiEntries, query, r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Fetch writes the log lines starting from the cursor to w. Lines pushed
+// from excludeHost are skipped. Returns the cursor for the next fetch.
+func (c *Client) Fetch(cursor int64, excludeHost string, w io.Writer) (int64, error) {
+	query := url.Values{}
+	query.Set("cursor", strconv.FormatInt(cursor, 10))
+	if excludeHost != "" {
+		query.Set("exclude-host", excludeHost)
+	}
+	resp, err := c.do(http.MethodGet, apiEntries, query, nil)
+	if err != nil {
+		return cursor, err
+	}
+	defer resp.Body.Close()
+
+	next, err := strconv.ParseInt(resp.Header.Get(CursorHeader), 10, 64)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor from server: %v", err)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return cursor, err
+	}
+	return next, nil
+}
+
+// Search writes a report from the log on the server to w. The arguments
+// are the same as for ParseCmdLog, except that the stars, Follow, Output
+// and Control are not used. The tags are read from the store on the server.
+func (c *Client) Search(arg ParseArgs, w io.Writer) error {
+	resp, err := c.do(http.MethodGet, apiSearch, searchQuery(arg), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// PushCursorFile returns the name of the file recording how much of the log
+// has been pushed to a server.
+func (l *Log) PushCursorFile() string {
+	return l.LogFile + ".push"
+}
+
+// RemoteFile returns the name of the file the commands pulled from a
+// server are appended to by default. The report merges it with the log.
+func (l *Log) RemoteFile() string {
+	return l.LogFile + ".remote"
+}
+
+// readCursor reads a cursor file. The file contains the cursor and the line
+// that ended at the cursor.
+func readCursor(file string) (cursor int64, lastLine string, err error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	parts := strings.SplitN(string(data), "\n", 2)
+	cursor, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid cursor file %s: %v", file, err)
+	}
+	if len(parts) == 2 {
+		lastLine = parts[1]
+	}
+	return cursor, lastLine, nil
+}
+
+func writeCursor(file string, cursor int64, lastLine string) error {
+	data := strconv.FormatInt(cursor, 10) + "\n" + lastLine
+	return ioutil.WriteFile(file, []byte(data), 0600)
+}
+
+// Push sends the entries that have not yet been pushed to the server.
+// Returns the number of pushed entries.
+//
+// If the log has been rewritten since the last push, e.g. by forget or
+// compact, the entries newer than the last pushed entry are sent.
+func (l *Log) Push(c *Client, host string) (int, error) {
+	if StoreFormat(l.LogFile) != FormatText {
+		return 0, fmt.Errorf("pushing requires the %s log format", FormatText)
+	}
+
+	cursor, lastLine, err := readCursor(l.PushCursorFile())
+	if err != nil {
+		return 0, err
+	}
+
+	// The opened log stays the same even if it is rewritten during the
+	// push
+	unlock, err := l.lock(false)
+	if err != nil {
+		return 0, err
+	}
+	fp, err := os.Open(l.LogFile)
+	unlock()
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	// Check that the log still has the last pushed line at the cursor
+	start := cursor - int64(len(lastLine))
+	valid := cursor <= size && start >= 0
+	if valid {
+		buf := make([]byte, len(lastLine))
+		_, err = fp.ReadAt(buf, start)
+		valid = err == nil && string(buf) == lastLine
+	}
+
+	// Only complete lines are pushed
+	end, err := completeLinesEnd(fp, 0, size)
+	if err != nil {
+		return 0, err
+	}
+
+	if !valid {
+		cursor = 0
+	}
+	if cursor >= end {
+		return 0, nil
+	}
+	lastTime, _, _, err := SplitLogLine(lastLine)
+	if valid || err != nil {
+		lastTime = -1
+	}
+
+	// Malformed lines are not pushed. The lines are sent as they are read.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	count := 0
+	last := ""
+	go func() {
+		out := bufio.NewWriter(pw)
+		err := ForEachLine(NewBufferedReader(io.NewSectionReader(fp, cursor, end-cursor), rewriteBufferSize),
+			func(line string) error {
+				last = line
+				timeint, _, _, err := SplitLogLine(line)
+				if err != nil || timeint <= lastTime {
+					return nil
+				}
+				count++
+				_, err = out.WriteString(line)
+				return err
+			})
+		if err == nil {
+			err = out.Flush()
+		}
+		pw.CloseWithError(err)
+		close(done)
+	}()
+
+	err = c.Append(host, pr)
+	pr.Close()
+	<-done
+	if err != nil {
+		return 0, err
+	}
+
+	return count, writeCursor(l.PushCursorFile(), end, last)
+}
+
+// Pull fetches the entries that have been pushed to the server after the
+// previous pull and appends them to the given file. Entries pushed from
+// excludeHost are skipped. Returns the number of pulled entries.
+func Pull(c *Client, file string, excludeHost string) (int, error) {
+	cursorFile := file + ".cursor"
+	cursor, _, err := readCursor(cursorFile)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	next, err := c.Fetch(cursor, excludeHost, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if buf.Len() > 0 {
+		err = CreateLog(file, "").appendData(buf.Bytes())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return bytes.Count(buf.Bytes(), []byte{'\n'}), writeCursor(cursorFile, next, "")
+}
@@ -0,0 +1,181 @@
+package cmdlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compactInterval is the minimum time between opportunistic compactions.
+const compactInterval = day
+
+// RetentionPolicy determines which entries are kept when the log is
+// compacted.
+type RetentionPolicy struct {
+	// All entries newer than this are kept. Older entries are thinned out
+	// to one entry per unique command per month. Zero disables thinning.
+	KeepDays int
+
+	// Entries older than this are dropped. Zero disables dropping.
+	DropYears int
+
+	// Entries for which Keep returns true are never removed.
+	Keep func(timeint int64, session, cmd string) bool
+
+	Now time.Time
+}
+
+// ParseRetentionPolicy parses a comma-separated policy string such as
+// "90d,5y". The "d" item is the RetentionPolicy.KeepDays and the "y" item is
+// the RetentionPolicy.DropYears.
+func ParseRetentionPolicy(policy string) (ret RetentionPolicy, err error) {
+	for _, item := range strings.Split(policy, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(item[:len(item)-1])
+		if err != nil || value < 0 {
+			return ret, fmt.Errorf("invalid retention policy item: \"%s\"", item)
+		}
+
+		switch item[len(item)-1] {
+		case 'd':
+			ret.KeepDays = value
+		case 'y':
+			ret.DropYears = value
+		default:
+			return ret, fmt.Errorf("invalid retention policy item: \"%s\"", item)
+		}
+	}
+	return ret, nil
+}
+
+// IsEmpty returns true if the policy does not remove anything.
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p.KeepDays == 0 && p.DropYears == 0
+}
+
+// CompactArgs are the arguments for the Compact function
+type CompactArgs struct {
+	Policy RetentionPolicy
+
+	// Only print the entries that would be removed
+	DryRun bool
+
+	// Keep the previous log in the file BackupFile
+	Backup bool
+
+	// The removed entries are printed here if DryRun is set
+	Output io.Writer
+}
+
+// Compact removes the entries from the log according to the retention
+// policy. Returns the number of removed entries. Malformed lines are never
+// removed.
+func (l *Log) Compact(arg CompactArgs) (removed int, err error) {
+	policy := arg.Policy
+	if policy.IsEmpty() {
+		return 0, fmt.Errorf("retention policy is empty")
+	}
+	if policy.Now == (time.Time{}) {
+		policy.Now = time.Now()
+	}
+
+	var thinBefore, dropBefore int64
+	if policy.KeepDays > 0 {
+		thinBefore = policy.Now.AddDate(0, 0, -policy.KeepDays).Unix()
+	}
+	if policy.DropYears > 0 {
+		dropBefore = policy.Now.AddDate(-policy.DropYears, 0, 0).Unix()
+	}
+
+	// The commands already seen in each month
+	seen := make(map[string]struct{})
+
+	matches := func(line string) bool {
+		timeint, session, cmd, err := SplitLogLine(line)
+		if err != nil {
+			return false
+		}
+		cmd = decodeLogCommand(cmd)
+		if policy.Keep != nil && policy.Keep(timeint, session, cmd) {
+			return false
+		}
+		if policy.DropYears > 0 && timeint < dropBefore {
+			return true
+		}
+		if policy.KeepDays > 0 && timeint < thinBefore {
+			key := time.Unix(timeint, 0).Format("2006-01") + "\t" + cmd
+			if _, ok := seen[key]; ok {
+				return true
+			}
+			seen[key] = struct{}{}
+		}
+		return false
+	}
+
+	return l.removeLines(matches, minTime, maxTime, arg.DryRun, arg.Backup, arg.Output)
+}
+
+// CompactFile returns the name of the file whose modification time records
+// the last compaction of the log.
+func (l *Log) CompactFile() string {
+	return l.LogFile + ".compacted"
+}
+
+// CompactDue returns true if the log has not been compacted during the
+// last day
+func (l *Log) CompactDue(now time.Time) bool {
+	info, err := os.Stat(l.CompactFile())
+	return err != nil || now.Sub(info.ModTime()) >= compactInterval
+}
+
+// CompactIfNeeded compacts the log if it has not been compacted during the
+// last day. This is meant to be called opportunistically when logging. The
+// attempt is recorded before compacting, so a failed compaction is not
+// retried until the next day.
+func (l *Log) CompactIfNeeded(policy RetentionPolicy) (removed int, err error) {
+	if policy.IsEmpty() {
+		return 0, nil
+	}
+	now := policy.Now
+	if now == (time.Time{}) {
+		now = time.Now()
+	}
+	if !l.CompactDue(now) {
+		return 0, nil
+	}
+
+	fp, err := os.OpenFile(l.CompactFile(), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	err = fp.Close()
+	if err != nil {
+		return 0, err
+	}
+	err = os.Chtimes(l.CompactFile(), now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return l.Compact(CompactArgs{Policy: policy})
+}
+
+// StartDetached starts the program in the background without waiting for
+// it. The program is not connected to the standard streams or the terminal.
+func StartDetached(program string, args ...string) error {
+	cmd := exec.Command(program, args...)
+	setDetached(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
@@ -0,0 +1,195 @@
+package cmdlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		keepDays  int
+		dropYears int
+		wantErr   bool
+	}{
+		{"", 0, 0, false},
+		{"90d", 90, 0, false},
+		{"5y", 0, 5, false},
+		{"90d,5y", 90, 5, false},
+		{" 5y , 30d ", 30, 5, false},
+		{"d", 0, 0, true},
+		{"5w", 0, 0, true},
+		{"-5d", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			p, err := ParseRetentionPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRetentionPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			compare(t, "KeepDays differs", tt.keepDays, p.KeepDays)
+			compare(t, "DropYears differs", tt.dropYears, p.DropYears)
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	testdir := "test-compact"
+	logfile := filepath.Join(testdir, "log")
+
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.Local)
+	line := func(tm time.Time, session, cmd string) string {
+		return fmt.Sprintf("%d\t%s\t%s\n", tm.Unix(), session, cmd)
+	}
+
+	ancient := now.AddDate(-6, 0, 0)
+	old := now.AddDate(-1, 0, 0)
+	recent := now.AddDate(0, 0, -1)
+
+	logData := line(ancient, "s1", "make") +
+		line(ancient, "s1", "important") +
+		line(old, "s1", "make") +
+		line(old.Add(time.Hour), "s2", "make") +
+		line(old.AddDate(0, 1, 0), "s2", "make") +
+		"invalid line\n" +
+		line(recent, "s3", "make") +
+		line(recent.Add(time.Hour), "s3", "make")
+
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		removed int
+		logData string
+		wantErr bool
+	}{
+		{"Empty policy", RetentionPolicy{}, 0, logData, true},
+		{"Drop old", RetentionPolicy{DropYears: 5}, 2,
+			strings.Join(strings.SplitAfter(logData, "\n")[2:], ""), false},
+		{"Thin out", RetentionPolicy{KeepDays: 30}, 1,
+			line(ancient, "s1", "make") +
+				line(ancient, "s1", "important") +
+				line(old, "s1", "make") +
+				line(old.AddDate(0, 1, 0), "s2", "make") +
+				"invalid line\n" +
+				line(recent, "s3", "make") +
+				line(recent.Add(time.Hour), "s3", "make"),
+			false},
+		{"Thin out and drop, keep important", RetentionPolicy{
+			KeepDays: 30, DropYears: 5,
+			Keep: func(timeint int64, session, cmd string) bool {
+				return cmd == "important"
+			}}, 2,
+			line(ancient, "s1", "important") +
+				line(old, "s1", "make") +
+				line(old.AddDate(0, 1, 0), "s2", "make") +
+				"invalid line\n" +
+				line(recent, "s3", "make") +
+				line(recent.Add(time.Hour), "s3", "make"),
+			false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(err error, msg string) {
+				if err != nil {
+					t.Fatalf("%s: %v", msg, err)
+				}
+			}
+
+			err := os.RemoveAll(testdir)
+			check(err, "Could not remove test directory")
+			err = os.MkdirAll(testdir, 0755)
+			check(err, "Could not create test directory")
+			defer os.RemoveAll(testdir)
+
+			err = ioutil.WriteFile(logfile, []byte(logData), 0600)
+			check(err, "Could not create logfile")
+
+			log := CreateLog(logfile, "")
+			tt.policy.Now = now
+			removed, err := log.Compact(CompactArgs{Policy: tt.policy})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compact() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			compare(t, "Removed count differs", tt.removed, removed)
+
+			data, err := ioutil.ReadFile(logfile)
+			check(err, "Could not read logfile")
+			compare(t, "Log contents differ", tt.logData, string(data))
+		})
+	}
+}
+
+func TestCompactIfNeeded(t *testing.T) {
+	testdir := "test-compact-needed"
+	logfile := filepath.Join(testdir, "log")
+
+	err := os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	now := time.Now()
+	data := fmt.Sprintf("%d\ts\tmake\n", now.AddDate(-6, 0, 0).Unix())
+	write := func() {
+		err := ioutil.WriteFile(logfile, []byte(data), 0600)
+		if err != nil {
+			t.Fatal("Could not create logfile:", err)
+		}
+	}
+
+	log := CreateLog(logfile, "")
+	policy := RetentionPolicy{DropYears: 5, Now: now}
+
+	write()
+	removed, err := log.CompactIfNeeded(policy)
+	if err != nil {
+		t.Fatal("Compacting failed:", err)
+	}
+	compare(t, "Expected compaction", 1, removed)
+
+	write()
+	removed, err = log.CompactIfNeeded(policy)
+	if err != nil {
+		t.Fatal("Compacting failed:", err)
+	}
+	compare(t, "Expected no compaction", 0, removed)
+
+	policy.Now = now.Add(compactInterval + time.Minute)
+	removed, err = log.CompactIfNeeded(policy)
+	if err != nil {
+		t.Fatal("Compacting failed:", err)
+	}
+	compare(t, "Expected compaction after interval", 1, removed)
+
+	// A failed compaction is not retried until the interval has passed
+	err = os.Remove(logfile)
+	if err != nil {
+		t.Fatal("Could not remove logfile:", err)
+	}
+	err = os.Mkdir(logfile, 0755)
+	if err != nil {
+		t.Fatal("Could not create directory:", err)
+	}
+	err = ioutil.WriteFile(segmentName(logfile, 1), []byte("not a segment"), 0600)
+	if err != nil {
+		t.Fatal("Could not create segment:", err)
+	}
+	policy.Now = now.Add(2 * (compactInterval + time.Minute))
+	_, err = log.CompactIfNeeded(policy)
+	if err == nil {
+		t.Error("Expected compaction to fail")
+	}
+	if log.CompactDue(policy.Now) {
+		t.Error("Expected the failed compaction to be recorded")
+	}
+}
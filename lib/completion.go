@@ -0,0 +1,339 @@
+package cmdlib
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kopoli/appkit"
+)
+
+// Shells supported by WriteCompletion
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Kinds of values that are completed for flags and arguments
+const (
+	completeNone    = ""
+	completeFile    = "file"
+	completeDir     = "dir"
+	completeSession = "session"
+	completeEntry   = "entry"
+	completeShell   = "shell"
+)
+
+// Kinds of values of the flags with the given names
+var flagCompletions = map[string]string{
+	"file":       completeFile,
+	"filter":     completeFile,
+	"profile":    completeFile,
+	"memprofile": completeFile,
+	"output":     completeFile,
+	"tokens":     completeFile,
+	"sync-dir":   completeDir,
+	"dir":        completeDir,
+	"session":    completeSession,
+}
+
+// Kinds of the positional arguments of the commands
+var argCompletions = map[string]string{
+	"merge":      completeFile,
+	"tag":        completeEntry,
+	"star":       completeEntry,
+	"completion": completeShell,
+}
+
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+	kind   string
+}
+
+type completionCommand struct {
+	name  string
+	help  string
+	flags []completionFlag
+	args  string
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	ret := []completionFlag{}
+	fs.VisitAll(func(f *flag.Flag) {
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		ret = append(ret, completionFlag{
+			name:   f.Name,
+			usage:  f.Usage,
+			isBool: ok && bf.IsBoolFlag(),
+			kind:   flagCompletions[f.Name],
+		})
+	})
+	return ret
+}
+
+// valueFlags returns the names of the flags that take a value, grouped by
+// the kind of the value
+func valueFlags(cmds []completionCommand) map[string][]string {
+	seen := map[string]bool{}
+	ret := map[string][]string{}
+	for _, cmd := range cmds {
+		for _, f := range cmd.flags {
+			if f.isBool || seen[f.name] {
+				continue
+			}
+			seen[f.name] = true
+			ret[f.kind] = append(ret[f.kind], "-"+f.name)
+		}
+	}
+	return ret
+}
+
+// Shell commands that print the dynamic values
+func sessionsCommand(program string) string {
+	return program + " sessions -reverse 2>/dev/null | cut -f1"
+}
+
+func writeBashCompletion(out io.Writer, program string, global completionCommand,
+	cmds []completionCommand) {
+	name := strings.ReplaceAll(program, "-", "_")
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.name)
+	}
+	flagWords := func(cmd completionCommand) string {
+		ret := []string{}
+		for _, f := range cmd.flags {
+			ret = append(ret, "-"+f.name)
+		}
+		return strings.Join(ret, " ")
+	}
+
+	fmt.Fprintf(out, "# bash completion for %s\n", program)
+	fmt.Fprintf(out, "_%s() {\n", name)
+	fmt.Fprintf(out, "    local cur prev cmd words i\n")
+	fmt.Fprintf(out, "    cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(out, "    prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(out, "    cmd=\"\"\n")
+	fmt.Fprintf(out, "    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(out, "        case \"${COMP_WORDS[i]}\" in\n")
+	fmt.Fprintf(out, "            %s)\n", strings.Join(names, "|"))
+	fmt.Fprintf(out, "                cmd=\"${COMP_WORDS[i]}\"\n")
+	fmt.Fprintf(out, "                break\n")
+	fmt.Fprintf(out, "                ;;\n")
+	fmt.Fprintf(out, "        esac\n")
+	fmt.Fprintf(out, "    done\n\n")
+
+	// Values of the flags
+	fmt.Fprintf(out, "    case \"$prev\" in\n")
+	values := valueFlags(append([]completionCommand{global}, cmds...))
+	for _, kind := range []string{completeSession, completeDir, completeFile, completeNone} {
+		if len(values[kind]) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "        %s)\n", strings.Join(values[kind], "|"))
+		switch kind {
+		case completeSession:
+			fmt.Fprintf(out, "            COMPREPLY=($(compgen -W \"$(%s)\" -- \"$cur\"))\n",
+				sessionsCommand(program))
+		case completeDir:
+			fmt.Fprintf(out, "            COMPREPLY=($(compgen -d -- \"$cur\"))\n")
+		case completeFile:
+			fmt.Fprintf(out, "            COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+		default:
+			fmt.Fprintf(out, "            COMPREPLY=()\n")
+		}
+		fmt.Fprintf(out, "            return\n")
+		fmt.Fprintf(out, "            ;;\n")
+	}
+	fmt.Fprintf(out, "    esac\n\n")
+
+	// Flags and arguments of the commands
+	fmt.Fprintf(out, "    case \"$cmd\" in\n")
+	fmt.Fprintf(out, "        \"\")\n")
+	fmt.Fprintf(out, "            words=\"%s %s\"\n", flagWords(global), strings.Join(names, " "))
+	fmt.Fprintf(out, "            ;;\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(out, "        %s)\n", cmd.name)
+		args := ""
+		switch cmd.args {
+		case completeFile:
+			fmt.Fprintf(out, "            if [[ \"$cur\" != -* ]]; then\n")
+			fmt.Fprintf(out, "                COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+			fmt.Fprintf(out, "                return\n")
+			fmt.Fprintf(out, "            fi\n")
+		case completeEntry:
+			args = " last"
+		case completeShell:
+			args = " " + strings.Join(completionShells, " ")
+		}
+		fmt.Fprintf(out, "            words=\"%s%s\"\n", flagWords(cmd), args)
+		fmt.Fprintf(out, "            ;;\n")
+	}
+	fmt.Fprintf(out, "    esac\n")
+	fmt.Fprintf(out, "    COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(out, "}\n")
+	fmt.Fprintf(out, "complete -F _%s %s\n", name, program)
+}
+
+// zshQuote escapes the string for a single quoted _arguments spec
+func zshQuote(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func writeZshCompletion(out io.Writer, program string, global completionCommand,
+	cmds []completionCommand) {
+	name := strings.ReplaceAll(program, "-", "_")
+	writeFlags := func(indent string, flags []completionFlag) {
+		for _, f := range flags {
+			spec := fmt.Sprintf("-%s[%s]", f.name, zshQuote(f.usage))
+			if !f.isBool {
+				action := " "
+				switch f.kind {
+				case completeSession:
+					action = fmt.Sprintf("_%s_sessions", name)
+				case completeDir:
+					action = "_files -/"
+				case completeFile:
+					action = "_files"
+				}
+				spec += fmt.Sprintf(":%s:%s", f.name, action)
+			}
+			fmt.Fprintf(out, "%s'%s' \\\n", indent, spec)
+		}
+	}
+
+	fmt.Fprintf(out, "#compdef %s\n\n", program)
+	fmt.Fprintf(out, "_%s_sessions() {\n", name)
+	fmt.Fprintf(out, "    local -a sessions\n")
+	fmt.Fprintf(out, "    sessions=(${(f)\"$(%s)\"})\n", sessionsCommand(program))
+	fmt.Fprintf(out, "    compadd -a sessions\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "_%s() {\n", name)
+	fmt.Fprintf(out, "    local curcontext=\"$curcontext\" state line\n")
+	fmt.Fprintf(out, "    typeset -A opt_args\n\n")
+	fmt.Fprintf(out, "    _arguments -C \\\n")
+	writeFlags("        ", global.flags)
+	fmt.Fprintf(out, "        '1:command:->command' \\\n")
+	fmt.Fprintf(out, "        '*::arg:->args'\n\n")
+
+	fmt.Fprintf(out, "    case $state in\n")
+	fmt.Fprintf(out, "        command)\n")
+	fmt.Fprintf(out, "            local -a commands\n")
+	fmt.Fprintf(out, "            commands=(\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(out, "                '%s:%s'\n", cmd.name,
+			strings.ReplaceAll(cmd.help, "'", `'\''`))
+	}
+	fmt.Fprintf(out, "            )\n")
+	fmt.Fprintf(out, "            _describe 'command' commands\n")
+	fmt.Fprintf(out, "            ;;\n")
+	fmt.Fprintf(out, "        args)\n")
+	fmt.Fprintf(out, "            case $line[1] in\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(out, "                %s)\n", cmd.name)
+		fmt.Fprintf(out, "                    _arguments \\\n")
+		writeFlags("                        ", cmd.flags)
+		switch cmd.args {
+		case completeFile:
+			fmt.Fprintf(out, "                        '*:file:_files'\n")
+		case completeEntry:
+			fmt.Fprintf(out, "                        '1:entry:(last)' '*:tag: '\n")
+		case completeShell:
+			fmt.Fprintf(out, "                        '1:shell:(%s)'\n",
+				strings.Join(completionShells, " "))
+		default:
+			fmt.Fprintf(out, "                        '*: :'\n")
+		}
+		fmt.Fprintf(out, "                    ;;\n")
+	}
+	fmt.Fprintf(out, "            esac\n")
+	fmt.Fprintf(out, "            ;;\n")
+	fmt.Fprintf(out, "    esac\n")
+	fmt.Fprintf(out, "}\n\n")
+	fmt.Fprintf(out, "_%s \"$@\"\n", name)
+}
+
+// fishQuote quotes the string for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writeFishCompletion(out io.Writer, program string, global completionCommand,
+	cmds []completionCommand) {
+	names := []string{}
+	for _, cmd := range cmds {
+		names = append(names, cmd.name)
+	}
+	writeFlags := func(condition string, flags []completionFlag) {
+		for _, f := range flags {
+			value := ""
+			if !f.isBool {
+				switch f.kind {
+				case completeSession:
+					value = fmt.Sprintf(" -x -a %s", fishQuote("("+sessionsCommand(program)+")"))
+				case completeDir:
+					value = " -x -a '(__fish_complete_directories)'"
+				case completeFile:
+					value = " -r -F"
+				default:
+					value = " -x"
+				}
+			}
+			fmt.Fprintf(out, "complete -c %s -n %s -o %s%s -d %s\n", program,
+				fishQuote(condition), f.name, value, fishQuote(f.usage))
+		}
+	}
+
+	fmt.Fprintf(out, "# fish completion for %s\n", program)
+	fmt.Fprintf(out, "complete -c %s -f\n", program)
+	writeFlags("__fish_use_subcommand", global.flags)
+	for _, cmd := range cmds {
+		fmt.Fprintf(out, "complete -c %s -n '__fish_use_subcommand' -a %s -d %s\n",
+			program, cmd.name, fishQuote(cmd.help))
+	}
+	for _, cmd := range cmds {
+		condition := "__fish_seen_subcommand_from " + cmd.name
+		writeFlags(condition, cmd.flags)
+		switch cmd.args {
+		case completeFile:
+			fmt.Fprintf(out, "complete -c %s -n %s -F\n", program, fishQuote(condition))
+		case completeEntry:
+			fmt.Fprintf(out, "complete -c %s -n %s -a last\n", program, fishQuote(condition))
+		case completeShell:
+			fmt.Fprintf(out, "complete -c %s -n %s -a %s\n", program, fishQuote(condition),
+				fishQuote(strings.Join(completionShells, " ")))
+		}
+	}
+}
+
+// WriteCompletion writes a completion script for the given shell. The
+// script completes the flags of the base command and the given commands and
+// their flags. The sessions are completed dynamically from the log by
+// running the program.
+func WriteCompletion(out io.Writer, shell string, program string, base *appkit.Command,
+	commands []*appkit.Command) error {
+	global := completionCommand{flags: completionFlags(base.Flags)}
+	cmds := []completionCommand{}
+	for _, c := range commands {
+		cmds = append(cmds, completionCommand{
+			name:  c.Cmd[0],
+			help:  c.Help,
+			flags: completionFlags(c.Flags),
+			args:  argCompletions[c.Cmd[0]],
+		})
+	}
+
+	switch shell {
+	case "bash":
+		writeBashCompletion(out, program, global, cmds)
+	case "zsh":
+		writeZshCompletion(out, program, global, cmds)
+	case "fish":
+		writeFishCompletion(out, program, global, cmds)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected one of: %s", shell,
+			strings.Join(completionShells, ", "))
+	}
+	return nil
+}
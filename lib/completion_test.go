@@ -0,0 +1,79 @@
+package cmdlib
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	base := appkit.NewCommand(nil, "", "")
+	base.Flags.String("file", "", "File name of the command log")
+	report := appkit.NewCommand(base, "report", "Generate a report")
+	report.Flags.String("session", "", "Display commands of the session")
+	report.Flags.Bool("pwd", false, "Print also the directory")
+	report.Flags.String("grep", "", "Display commands matching [regexp]")
+	merge := appkit.NewCommand(base, "merge", "Merge command logs")
+	commands := []*appkit.Command{report, merge}
+
+	tests := []struct {
+		shell    string
+		contains []string
+	}{
+		{"bash", []string{
+			"report|merge)",
+			"-session)\n            COMPREPLY=($(compgen -W \"$(cmdlog sessions",
+			"-grep)\n            COMPREPLY=()",
+			"words=\"-grep -pwd -session\"",
+			"complete -F _cmdlog cmdlog",
+		}},
+		{"zsh", []string{
+			"#compdef cmdlog",
+			"'-file[File name of the command log]:file:_files'",
+			"'-session[Display commands of the session]:session:_cmdlog_sessions'",
+			"'-grep[Display commands matching \\[regexp\\]]:grep: '",
+			"'-pwd[Print also the directory]'",
+			"'report:Generate a report'",
+			"'*:file:_files'",
+		}},
+		{"fish", []string{
+			"complete -c cmdlog -n '__fish_use_subcommand' -o file -r -F",
+			"complete -c cmdlog -n '__fish_use_subcommand' -a merge -d 'Merge command logs'",
+			"-o session -x -a '(cmdlog sessions",
+			"-o pwd -d 'Print also the directory'",
+			"complete -c cmdlog -n '__fish_seen_subcommand_from merge' -F",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := WriteCompletion(buf, tt.shell, "cmdlog", base, commands)
+			if err != nil {
+				t.Fatal("WriteCompletion failed:", err)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("Completion does not contain %q:\n%s", s, buf.String())
+				}
+			}
+
+			// Check the syntax if the shell is available
+			if path, err := exec.LookPath(tt.shell); err == nil && tt.shell != "fish" {
+				cmd := exec.Command(path, "-n")
+				cmd.Stdin = buf
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Errorf("Syntax check failed: %v: %s", err, out)
+				}
+			}
+		})
+	}
+
+	err := WriteCompletion(&bytes.Buffer{}, "csh", "cmdlog", base, commands)
+	if err == nil {
+		t.Error("Expected an error from an unsupported shell")
+	}
+}
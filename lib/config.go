@@ -0,0 +1,208 @@
+package cmdlib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kopoli/appkit"
+)
+
+// The options set from the keys of the configuration file
+var configOptions = map[string]string{
+	"file":          "cmdlog-file",
+	"filter":        "cmdlog-filter-file",
+	"sync-dir":      "cmdlog-sync-dir",
+	"host":          "cmdlog-host",
+	"retention":     "cmdlog-retention",
+	"time-format":   "cmdlog-time-format",
+	"relative-time": "cmdlog-relative-time",
+	"report":        "cmdlog-report-args",
+}
+
+// Config is the configuration file of cmdlog. Each line of the file is of
+// the form "key = value". Empty lines and lines starting with # are ignored.
+type Config map[string]string
+
+// xdgDir returns the directory in the XDG environment variable or the
+// fallback directory under home
+func xdgDir(env, fallback string) string {
+	dir := os.Getenv(env)
+	if dir == "" || !filepath.IsAbs(dir) {
+		dir = filepath.Join(homeDir, fallback)
+	}
+	return filepath.Join(dir, "cmdlog")
+}
+
+// ConfigDir returns the directory for the configuration files
+func ConfigDir() string {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// DataDir returns the directory for the command log
+func DataDir() string {
+	return xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+}
+
+// ConfigFile returns the name of the configuration file. It can be set with
+// the CMDLOG_CONFIG environment variable.
+func ConfigFile() string {
+	if file := os.Getenv("CMDLOG_CONFIG"); file != "" {
+		return file
+	}
+	return filepath.Join(ConfigDir(), "config")
+}
+
+// Locations of the files before the XDG directories were used
+func legacyLogFile() string {
+	return filepath.Join(homeDir, ".cmdlog")
+}
+
+func legacyFilterFile() string {
+	return filepath.Join(homeDir, ".cmdlog-filters")
+}
+
+// defaultFile returns the file if it or the legacy file does not exist, or
+// else the legacy file
+func defaultFile(file, legacy string) string {
+	if !FileExists(file) && FileExists(legacy) {
+		return legacy
+	}
+	return file
+}
+
+// DefaultLogFile returns the default command log file under DataDir. If only
+// the log in the legacy location ~/.cmdlog exists, it is returned instead.
+func DefaultLogFile() string {
+	return defaultFile(filepath.Join(DataDir(), "log"), legacyLogFile())
+}
+
+// DefaultFilterFile returns the default filter file under ConfigDir. If only
+// the legacy ~/.cmdlog-filters exists, it is returned instead.
+func DefaultFilterFile() string {
+	return defaultFile(filepath.Join(ConfigDir(), "filters"), legacyFilterFile())
+}
+
+// LoadConfig loads the configuration from the given file. A missing file is
+// an empty configuration.
+func LoadConfig(file string) (Config, error) {
+	ret := Config{}
+
+	fp, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"key = value\"", file, lineno)
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := configOptions[key]; !ok {
+			return nil, fmt.Errorf("%s:%d: unknown key \"%s\"", file, lineno, key)
+		}
+		ret[key] = os.ExpandEnv(strings.TrimSpace(parts[1]))
+	}
+	return ret, scanner.Err()
+}
+
+// Apply sets the options from the configuration. These are the defaults of
+// the command line flags and environment variables.
+func (c Config) Apply(opts appkit.Options) {
+	for key, value := range c {
+		opts.Set(configOptions[key], value)
+	}
+}
+
+// migratedSuffixes are the suffixes of the files next to the command log
+// that are moved with it
+var migratedSuffixes = []string{"", ".tags", ".stars", ".compacted", ".push",
+	".bak", ".remote", ".remote.cursor", ".quarantine"}
+
+// MigrateLog moves the command log and the files next to it to a new
+// location. Returns the names of the moved files. Fails if a file exists in
+// the new location.
+func MigrateLog(from, to string) (moved []string, err error) {
+	if !FileExists(from) {
+		return nil, nil
+	}
+	for _, suffix := range migratedSuffixes {
+		if FileExists(from+suffix) && FileExists(to+suffix) {
+			return nil, fmt.Errorf("file %s already exists", to+suffix)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(to), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands are not appended while the log is moved
+	l := CreateLog(from, "")
+	unlock, err := l.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		uerr := unlock()
+		if err == nil {
+			err = uerr
+		}
+		_ = os.Remove(l.LockFile())
+	}()
+
+	for _, suffix := range migratedSuffixes {
+		if !FileExists(from + suffix) {
+			continue
+		}
+		err = os.Rename(from+suffix, to+suffix)
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, from+suffix)
+	}
+	return moved, nil
+}
+
+// MigrateLegacyFiles moves the command log and the filter file from the
+// legacy locations in the home directory to the XDG directories. Returns the
+// names of the moved files.
+func MigrateLegacyFiles() (moved []string, err error) {
+	filters := filepath.Join(ConfigDir(), "filters")
+	if FileExists(legacyFilterFile()) && FileExists(filters) {
+		return nil, fmt.Errorf("file %s already exists", filters)
+	}
+
+	moved, err = MigrateLog(legacyLogFile(), filepath.Join(DataDir(), "log"))
+	if err != nil {
+		return moved, err
+	}
+
+	if FileExists(legacyFilterFile()) {
+		err = os.MkdirAll(filepath.Dir(filters), 0700)
+		if err != nil {
+			return moved, err
+		}
+		err = os.Rename(legacyFilterFile(), filters)
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, legacyFilterFile())
+	}
+	return moved, nil
+}
@@ -0,0 +1,167 @@
+package cmdlib
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestLoadConfig(t *testing.T) {
+	testdir := "test-config"
+	file := filepath.Join(testdir, "config")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	tests := []struct {
+		name    string
+		data    string
+		opts    map[string]string
+		wantErr bool
+	}{
+		{"Empty", "# comment\n\n", map[string]string{}, false},
+		{"Values", "file = $HOME/log\nreport=-pwd -reverse\n  retention =  90d \n",
+			map[string]string{
+				"cmdlog-file":        homeDir + "/log",
+				"cmdlog-report-args": "-pwd -reverse",
+				"cmdlog-retention":   "90d",
+			}, false},
+		{"Unknown key", "colour = red\n", nil, true},
+		{"Missing value", "file\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ioutil.WriteFile(file, []byte(tt.data), 0600)
+			if err != nil {
+				t.Fatal("Could not write config:", err)
+			}
+			config, err := LoadConfig(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			opts := appkit.NewOptions()
+			config.Apply(opts)
+			for key, value := range tt.opts {
+				compare(t, "Option "+key+" differs", value, opts.Get(key, ""))
+			}
+			compare(t, "Option count differs", len(tt.opts), len(config))
+		})
+	}
+
+	config, err := LoadConfig(filepath.Join(testdir, "missing"))
+	if err != nil || len(config) != 0 {
+		t.Error("Missing config should be empty:", err)
+	}
+}
+
+func TestDefaultFilesAndMigration(t *testing.T) {
+	testdir, err := filepath.Abs("test-xdg")
+	if err != nil {
+		t.Fatal("Could not determine test directory:", err)
+	}
+	err = os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	origHome := homeDir
+	homeDir = testdir
+	defer func() { homeDir = origHome }()
+	for _, env := range []string{"XDG_CONFIG_HOME", "XDG_DATA_HOME"} {
+		orig, ok := os.LookupEnv(env)
+		os.Unsetenv(env)
+		if ok {
+			defer os.Setenv(env, orig)
+		}
+	}
+
+	newLog := filepath.Join(testdir, ".local", "share", "cmdlog", "log")
+	newFilters := filepath.Join(testdir, ".config", "cmdlog", "filters")
+	compare(t, "Log file differs", newLog, DefaultLogFile())
+	compare(t, "Filter file differs", newFilters, DefaultFilterFile())
+
+	// The legacy files are used until they are migrated
+	for _, file := range []string{".cmdlog", ".cmdlog.tags", ".cmdlog-filters"} {
+		err = ioutil.WriteFile(filepath.Join(testdir, file), []byte(file), 0600)
+		if err != nil {
+			t.Fatal("Could not write file:", err)
+		}
+	}
+	compare(t, "Legacy log file differs", legacyLogFile(), DefaultLogFile())
+	compare(t, "Legacy filter file differs", legacyFilterFile(), DefaultFilterFile())
+
+	moved, err := MigrateLegacyFiles()
+	if err != nil {
+		t.Fatal("Migration failed:", err)
+	}
+	compare(t, "Moved files differ", strings.Join([]string{
+		legacyLogFile(), legacyLogFile() + ".tags", legacyFilterFile(),
+	}, ","), strings.Join(moved, ","))
+	compare(t, "Migrated log file differs", newLog, DefaultLogFile())
+	compare(t, "Migrated filter file differs", newFilters, DefaultFilterFile())
+	data, err := ioutil.ReadFile(newLog + ".tags")
+	if err != nil {
+		t.Fatal("Could not read migrated file:", err)
+	}
+	compare(t, "Migrated data differs", ".cmdlog.tags", string(data))
+	if FileExists(legacyLogFile() + ".lock") {
+		t.Error("Lock file of the legacy log should be removed")
+	}
+
+	// Existing files are not overwritten
+	err = ioutil.WriteFile(legacyLogFile(), []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Could not write file:", err)
+	}
+	_, err = MigrateLegacyFiles()
+	if err == nil {
+		t.Error("Expected an error when the migrated file exists")
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	pwd := fs.Bool("pwd", false, "")
+	reverse := fs.Bool("reverse", false, "")
+	grep := fs.String("grep", "", "")
+	session := fs.String("session", "", "")
+
+	err := fs.Parse([]string{"-reverse=false", "-session", "s1"})
+	if err != nil {
+		t.Fatal("Parsing failed:", err)
+	}
+	err = parseDefaults(fs, `-pwd -reverse -grep "go test" -session s2`)
+	if err != nil {
+		t.Fatal("Parsing defaults failed:", err)
+	}
+	compare(t, "Default flag differs", true, *pwd)
+	compare(t, "Overridden flag differs", false, *reverse)
+	compare(t, "Quoted default differs", "go test", *grep)
+	compare(t, "Given flag differs", "s1", *session)
+
+	err = parseDefaults(fs, "-pwd extra")
+	if err == nil {
+		t.Error("Expected an error from positional arguments")
+	}
+}
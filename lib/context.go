@@ -0,0 +1,122 @@
+package cmdlib
+
+import (
+	"regexp"
+)
+
+// contextSeparator is written between non-adjacent groups of entries, like
+// grep does
+const contextSeparator = "--\n"
+
+// sessionContext is the context state of a single session
+type sessionContext struct {
+	// Entries preceding the next match
+	before []*Entry
+
+	// The group of entries around matches that is not yet complete
+	group []*Entry
+
+	// Number of entries still to add to the group after a match
+	afterLeft int
+
+	// Index of the latest entry in the session
+	index int
+}
+
+// grepContext selects the entries matching a regexp and the entries of the
+// same session around them. The entries are given in the order they are
+// displayed. A group of entries is returned once its context is complete, so
+// the groups of different sessions are not interleaved.
+type grepContext struct {
+	re     *regexp.Regexp
+	before int
+	after  int
+
+	sessions map[string]*sessionContext
+
+	// Sessions in the order they were seen
+	order []string
+
+	// The session and the index of the last returned entry
+	returned    bool
+	lastSession string
+	lastIndex   int
+}
+
+// newGrepContext creates a context for displaying before and after entries
+// around each match. In reverse order the before entries come after the
+// match.
+func newGrepContext(re *regexp.Regexp, before, after int, reverse bool) *grepContext {
+	if reverse {
+		before, after = after, before
+	}
+	return &grepContext{
+		re:       re,
+		before:   before,
+		after:    after,
+		sessions: make(map[string]*sessionContext),
+	}
+}
+
+// flush returns the group of the session. A nil entry is returned before
+// the group if it is not adjacent to the previously returned entries.
+func (g *grepContext) flush(session string, sc *sessionContext) (ret []*Entry) {
+	if len(sc.group) == 0 {
+		return nil
+	}
+	first := sc.index - len(sc.group) + 1
+	if g.returned && (g.lastSession != session || g.lastIndex != first-1) {
+		ret = append(ret, nil)
+	}
+	ret = append(ret, sc.group...)
+
+	g.returned = true
+	g.lastSession = session
+	g.lastIndex = first + len(sc.group) - 1
+	sc.group = nil
+	return ret
+}
+
+// Add returns the entries that are selected when the given entry is read. A
+// nil entry denotes a separator between groups that are not adjacent.
+func (g *grepContext) Add(e *Entry) []*Entry {
+	sc, ok := g.sessions[e.Session]
+	if !ok {
+		sc = &sessionContext{}
+		g.sessions[e.Session] = sc
+		g.order = append(g.order, e.Session)
+	}
+	sc.index++
+
+	switch {
+	case g.re.MatchString(e.Command):
+		sc.group = append(sc.group, sc.before...)
+		sc.group = append(sc.group, e)
+		sc.before = nil
+		sc.afterLeft = g.after
+	case sc.afterLeft > 0:
+		sc.group = append(sc.group, e)
+		sc.afterLeft--
+	default:
+		if g.before > 0 {
+			if len(sc.before) == g.before {
+				sc.before = sc.before[1:]
+			}
+			sc.before = append(sc.before, e)
+		}
+		return nil
+	}
+
+	if sc.afterLeft > 0 {
+		return nil
+	}
+	return g.flush(e.Session, sc)
+}
+
+// Finish returns the groups that are still incomplete at the end of the log.
+func (g *grepContext) Finish() (ret []*Entry) {
+	for _, session := range g.order {
+		ret = append(ret, g.flush(session, g.sessions[session])...)
+	}
+	return ret
+}
@@ -0,0 +1,103 @@
+package cmdlib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCmdLogContext(t *testing.T) {
+	data := `1	s1	export TOKEN=x
+2	s1	cd project
+3	s2	ls
+4	s1	make deploy
+5	s1	git status
+6	s1	vim main.go
+7	s1	go test
+8	s1	make deploy
+9	s2	make deploy
+10	s1	exit
+`
+	tests := []struct {
+		name    string
+		arg     ParseArgs
+		reverse bool
+		output  string
+	}{
+		{"No context", ParseArgs{Grep: "deploy"}, false,
+			"make deploy\nmake deploy\nmake deploy\n"},
+		{"Before", ParseArgs{Grep: "deploy", Before: 2}, false, `export TOKEN=x
+cd project
+make deploy
+--
+vim main.go
+go test
+make deploy
+--
+ls
+make deploy
+`},
+		{"After", ParseArgs{Grep: "deploy", After: 1}, false, `make deploy
+git status
+--
+make deploy
+exit
+--
+make deploy
+`},
+		{"Overlapping groups", ParseArgs{Grep: "deploy", Before: 1, After: 3}, false, `cd project
+make deploy
+git status
+vim main.go
+go test
+make deploy
+exit
+--
+ls
+make deploy
+`},
+		{"Session", ParseArgs{Grep: "deploy", Before: 1, Session: "s2"}, false,
+			"ls\nmake deploy\n"},
+		{"Reverse", ParseArgs{Grep: "deploy", Before: 1, Reverse: true}, true, `make deploy
+go test
+--
+make deploy
+ls
+--
+make deploy
+cd project
+`},
+		{"Limit", ParseArgs{Grep: "deploy", Before: 1, Limit: 3}, false,
+			"cd project\nmake deploy\n--\ngo test\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r LineReader = &testLineReader{buf: bytes.NewBufferString(data)}
+			if tt.reverse {
+				var err error
+				r, err = NewReverseReader(strings.NewReader(data), 1024)
+				if err != nil {
+					t.Fatal("Creating reverse reader failed:", err)
+				}
+			}
+
+			buf := &bytes.Buffer{}
+			tt.arg.Control = controlArgs{Now: time.Unix(10, 0)}
+			tt.arg.Output = buf
+			err := ParseCmdLog(r, tt.arg)
+			if err != nil {
+				t.Fatal("ParseCmdLog failed:", err)
+			}
+
+			got := []string{}
+			for _, line := range strings.SplitAfter(buf.String(), "\n") {
+				if i := strings.LastIndex(line, "\t"); i >= 0 {
+					line = line[i+1:]
+				}
+				got = append(got, line)
+			}
+			compare(t, "Output differs", tt.output, strings.Join(got, ""))
+		})
+	}
+}
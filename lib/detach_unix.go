@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package cmdlib
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
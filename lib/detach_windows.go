@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package cmdlib
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
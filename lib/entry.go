@@ -0,0 +1,39 @@
+package cmdlib
+
+import (
+	"time"
+)
+
+// Entry is a single command in the command log
+type Entry struct {
+	// Time when the command was run. Zero if the timestamp in the log is
+	// invalid.
+	Time time.Time
+
+	// Session where the command was run
+	Session string
+
+	// The command line
+	Command string
+
+	// Working directory of the command. Only determined if
+	// ParseArgs.Pwd or ParseArgs.Dir is set.
+	Pwd string
+
+	// Tags and a note of the command. Only determined if the entries are
+	// annotated, see ParseArgs.Annotate.
+	Tags []string
+	Note string
+
+	// Starred is set if the entry is starred in ParseArgs.Stars
+	Starred bool
+
+	// The entry is filtered out, but it is still needed for tracking the
+	// working directories
+	hidden bool
+}
+
+// HasValidTime returns true if the entry had a valid timestamp in the log.
+func (e *Entry) HasValidTime() bool {
+	return !e.Time.IsZero()
+}
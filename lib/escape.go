@@ -0,0 +1,136 @@
+package cmdlib
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// The commands are displayed escaped to a single line, as the report lines
+// are separated by newlines and the fields by tabs. Newlines, carriage
+// returns and tabs are escaped as \n, \r and \t. A backslash is escaped as
+// \\ only if it would otherwise be read as the start of an escape sequence,
+// so the backslashes of most commands are displayed as is.
+//
+// The commands containing newlines, carriage returns or tabs are stored in
+// the log escaped the same way after escapedPrefix. The other commands are
+// stored as they are, like all the commands logged by earlier versions.
+
+// escapedPrefix starts the command field of a log line whose command is
+// escaped. An unescaped command never starts with a tab, since a tab is
+// always escaped. Only a command logged by an earlier version starting with
+// a tab is misread as escaped.
+const escapedPrefix = "\t"
+
+// encodeLogCommand returns the command field of the log line for the
+// command
+func encodeLogCommand(cmd string) string {
+	if !strings.ContainsAny(cmd, "\n\r\t") {
+		return cmd
+	}
+	return escapedPrefix + EscapeCommand(cmd)
+}
+
+// decodeLogCommand returns the command of the command field of a log line
+func decodeLogCommand(field string) string {
+	if !strings.HasPrefix(field, escapedPrefix) {
+		return field
+	}
+	return UnescapeCommand(field[len(escapedPrefix):])
+}
+
+// needsEscape returns true if the character is escaped, or if a backslash
+// before it must be escaped
+func needsEscape(c byte) bool {
+	switch c {
+	case '\n', '\r', '\t', '\\', 'n', 'r', 't':
+		return true
+	}
+	return false
+}
+
+// EscapeCommand escapes the command to a single line without tabs
+func EscapeCommand(cmd string) string {
+	if !strings.ContainsAny(cmd, "\n\r\t\\") {
+		return cmd
+	}
+
+	sb := strings.Builder{}
+	sb.Grow(len(cmd) + 8)
+	for i := 0; i < len(cmd); i++ {
+		switch c := cmd[i]; c {
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\\':
+			if i+1 < len(cmd) && needsEscape(cmd[i+1]) {
+				sb.WriteString(`\\`)
+			} else {
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// UnescapeCommand returns the original command of an escaped command.
+// Backslashes that do not start an escape sequence are kept.
+func UnescapeCommand(cmd string) string {
+	idx := strings.IndexByte(cmd, '\\')
+	if idx < 0 {
+		return cmd
+	}
+
+	sb := strings.Builder{}
+	sb.Grow(len(cmd))
+	sb.WriteString(cmd[:idx])
+	for i := idx; i < len(cmd); i++ {
+		c := cmd[i]
+		if c != '\\' || i+1 == len(cmd) {
+			sb.WriteByte(c)
+			continue
+		}
+		switch cmd[i+1] {
+		case 'n':
+			c = '\n'
+		case 'r':
+			c = '\r'
+		case 't':
+			c = '\t'
+		case '\\':
+		default:
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte(c)
+		i++
+	}
+	return sb.String()
+}
+
+// UnescapeLines writes the original text of each escaped line of the input
+// to the output
+func UnescapeLines(out io.Writer, in io.Reader) error {
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			line = UnescapeCommand(strings.TrimSuffix(line, "\n"))
+			_, werr := io.WriteString(out, line+"\n")
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
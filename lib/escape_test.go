@@ -0,0 +1,99 @@
+package cmdlib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEscapeCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		escaped string
+	}{
+		{"Plain", "go test ./...", "go test ./..."},
+		{"Empty", "", ""},
+		{"Newlines", "for a in b; do\n  echo $a\ndone", `for a in b; do\n  echo $a\ndone`},
+		{"Tabs and carriage returns", "a\tb\r\n", `a\tb\r\n`},
+		{"Plain backslashes", `grep 'a\|b' x\ y \`, `grep 'a\|b' x\ y \`},
+		{"Backslash before escape letters", `printf "a\n\t\\"`, `printf "a\\n\\t\\\"`},
+		{"Backslash before a newline", "make \\\n  all", `make \\\n  all`},
+		{"Backslash before a tab", "\\\t", `\\\t`},
+		{"Backslashes only", `\\\`, `\\\\\`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			escaped := EscapeCommand(tt.cmd)
+			compare(t, "Escaped command differs", tt.escaped, escaped)
+			if strings.ContainsAny(escaped, "\n\r\t") {
+				t.Errorf("Escaped command %q contains newlines or tabs", escaped)
+			}
+			compare(t, "Unescaped command differs", tt.cmd, UnescapeCommand(escaped))
+		})
+	}
+}
+
+// Backslashes that do not start an escape sequence are kept
+func TestUnescapeCommand(t *testing.T) {
+	tests := []struct {
+		escaped string
+		cmd     string
+	}{
+		{`ls`, "ls"},
+		{`sed 's/\./x/' \`, `sed 's/\./x/' \`},
+		{`a\nb`, "a\nb"},
+		{`a\qb\`, `a\qb\`},
+		{`\\\\`, `\\`},
+	}
+	for _, tt := range tests {
+		compare(t, "Unescaped command differs", tt.cmd, UnescapeCommand(tt.escaped))
+	}
+}
+
+func TestLogCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   string
+		field string
+	}{
+		{"Plain", "go test ./...", "go test ./..."},
+		{"Backslashes", `printf 'a\tb\n' \\`, `printf 'a\tb\n' \\`},
+		{"Newlines", "for a in b; do\n  echo $a\ndone", "\t" + `for a in b; do\n  echo $a\ndone`},
+		{"Leading tab", "\tls", "\t" + `\tls`},
+		{"Tab and backslashes", "printf '\\t'\t", "\t" + `printf '\\t'\t`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := encodeLogCommand(tt.cmd)
+			compare(t, "Command field differs", tt.field, field)
+			compare(t, "Decoded command differs", tt.cmd, decodeLogCommand(field))
+		})
+	}
+}
+
+// The commands logged before escaping was added are read as they are
+func TestDecodeLogCommandLegacy(t *testing.T) {
+	for _, field := range []string{`ls`, `printf 'a\tb\n'`, `echo a\\b`, `a\qb\`} {
+		compare(t, "Decoded command differs", field, decodeLogCommand(field))
+	}
+}
+
+func TestUnescapeLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := UnescapeLines(out, strings.NewReader(`a\nb`+"\n"+`c\td`))
+	if err != nil {
+		t.Fatal("UnescapeLines failed:", err)
+	}
+	compare(t, "Output differs", "a\nb\nc\td\n", out.String())
+}
+
+func TestFormatEntryMultiline(t *testing.T) {
+	e := &Entry{Session: "zsh-1", Command: "for a in b; do\n\tls\ndone"}
+	arg := &ParseArgs{}
+	compare(t, "Escaped entry differs",
+		"zsh-1 <invalid>\tfor a in b; do\\n\\tls\\ndone\n", FormatEntry(e, arg))
+	arg.Multiline = true
+	compare(t, "Multi-line entry differs",
+		"zsh-1 <invalid>\tfor a in b; do\n\tls\ndone\n", FormatEntry(e, arg))
+}
@@ -0,0 +1,151 @@
+package cmdlib
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FollowReader is a LineReader that keeps reading a file after its end as
+// new lines are appended to it, like "tail -f". The file is polled for new
+// data. If the file is truncated, it is read again from the start. If the
+// file is replaced, e.g. by log rotation, the new file is read from the
+// start after the rest of the old file has been read.
+type FollowReader struct {
+	File         string
+	PollInterval time.Duration
+
+	fp     *os.File
+	reader *bufio.Reader
+
+	// Number of bytes read from fp
+	offset int64
+
+	// The read part of a line that is not yet complete
+	partial string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFollowReader opens the file for following. The file is read from the
+// start.
+func NewFollowReader(file string, pollInterval time.Duration) (*FollowReader, error) {
+	ret := &FollowReader{
+		File:         file,
+		PollInterval: pollInterval,
+		stop:         make(chan struct{}),
+	}
+	err := ret.open()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (f *FollowReader) open() error {
+	fp, err := os.Open(f.File)
+	if err != nil {
+		return err
+	}
+	if f.fp != nil {
+		f.fp.Close()
+	}
+	f.fp = fp
+	f.reader = bufio.NewReader(fp)
+	f.offset = 0
+	return nil
+}
+
+// reopen checks if the file has been truncated or replaced at the end of the
+// file and starts reading it from the start if needed. Returns true if the
+// file is read again.
+func (f *FollowReader) reopen() (bool, error) {
+	current, err := f.fp.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// The file has been truncated. The incomplete line is dropped.
+	if current.Size() < f.offset {
+		_, err = f.fp.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, err
+		}
+		f.reader.Reset(f.fp)
+		f.offset = 0
+		f.partial = ""
+		return true, nil
+	}
+
+	// A missing file is probably being rotated, so wait for the new one
+	fi, err := os.Stat(f.File)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The file has been replaced
+	if !os.SameFile(current, fi) {
+		return true, f.open()
+	}
+	return false, nil
+}
+
+// ReadLine returns the next line of the file. If there are no more lines, it
+// waits until a line is appended to the file. Returns io.EOF after Stop has
+// been called.
+func (f *FollowReader) ReadLine() (string, error) {
+	for {
+		data, err := f.reader.ReadString('\n')
+		f.offset += int64(len(data))
+		f.partial += data
+		if err == nil {
+			line := f.partial
+			f.partial = ""
+			return line, nil
+		}
+		if err != io.EOF {
+			return "", err
+		}
+
+		// At the end of the file
+		reopened, err := f.reopen()
+		if err != nil {
+			return "", err
+		}
+		if reopened {
+			// The incomplete last line of a replaced file is still
+			// returned
+			if f.partial != "" {
+				line := f.partial
+				f.partial = ""
+				return line, nil
+			}
+			continue
+		}
+
+		select {
+		case <-f.stop:
+			return "", io.EOF
+		case <-time.After(f.PollInterval):
+		}
+	}
+}
+
+// Stop makes ReadLine return io.EOF when it reaches the end of the file. It
+// can be called concurrently with ReadLine.
+func (f *FollowReader) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+}
+
+// Close closes the file. It should be called after the reading has ended.
+func (f *FollowReader) Close() error {
+	return f.fp.Close()
+}
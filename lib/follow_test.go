@@ -0,0 +1,177 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFollowReader(t *testing.T) {
+	testdir := "test-follow"
+	file := filepath.Join(testdir, "log")
+
+	check := func(err error, msg string) {
+		if err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+	}
+	appendData := func(data string) {
+		fp, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		check(err, "Could not open log")
+		_, err = fp.WriteString(data)
+		check(err, "Could not append to log")
+		check(fp.Close(), "Could not close log")
+	}
+
+	err := os.RemoveAll(testdir)
+	check(err, "Could not remove test directory")
+	err = os.MkdirAll(testdir, 0755)
+	check(err, "Could not create test directory")
+	defer os.RemoveAll(testdir)
+
+	appendData("first\n")
+	r, err := NewFollowReader(file, time.Millisecond)
+	check(err, "Could not create follow reader")
+	defer r.Close()
+
+	readLines := func(count int) string {
+		lines := []string{}
+		for i := 0; i < count; i++ {
+			line, err := r.ReadLine()
+			check(err, "Reading failed")
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "")
+	}
+
+	compare(t, "Existing line differs", "first\n", readLines(1))
+
+	// A line that is appended in parts
+	go func() {
+		appendData("sec")
+		time.Sleep(10 * time.Millisecond)
+		appendData("ond\nthird\n")
+	}()
+	compare(t, "Appended lines differ", "second\nthird\n", readLines(2))
+
+	// Truncation
+	err = ioutil.WriteFile(file, []byte("new\n"), 0600)
+	check(err, "Could not truncate log")
+	compare(t, "Line after truncation differs", "new\n", readLines(1))
+
+	// Rotation with an incomplete last line in the old file
+	appendData("incomplete")
+	time.Sleep(10 * time.Millisecond)
+	err = os.Rename(file, file+".1")
+	check(err, "Could not rotate log")
+	appendData("rotated\n")
+	compare(t, "Lines after rotation differ", "incomplete"+"rotated\n", readLines(2))
+
+	// Stopping
+	done := make(chan error)
+	go func() {
+		_, err := r.ReadLine()
+		done <- err
+	}()
+	r.Stop()
+	select {
+	case err = <-done:
+		compare(t, "Expected EOF after stop", io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("ReadLine did not return after stop")
+	}
+}
+
+func TestParseCmdLogFollow(t *testing.T) {
+	testdir := "test-follow-report"
+	file := filepath.Join(testdir, "log")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	now := time.Now().Unix()
+	log := CreateLog(file, "")
+	err = log.appendData([]byte(formatLogLine(now-10, "s1", "cd /work")))
+	if err != nil {
+		t.Fatal("Could not append to log:", err)
+	}
+
+	r, err := NewFollowReader(file, time.Millisecond)
+	if err != nil {
+		t.Fatal("Could not create follow reader:", err)
+	}
+	defer r.Close()
+
+	out := &syncBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- ParseCmdLog(r, ParseArgs{
+			Session: "s1",
+			Pwd:     true,
+			Follow:  true,
+			Control: controlArgs{Now: time.Unix(now, 0)},
+			Output:  out,
+		})
+	}()
+
+	for _, cmd := range []string{"ls", "make"} {
+		err = log.appendData([]byte(formatLogLine(now, "s1", cmd)))
+		if err != nil {
+			t.Fatal("Could not append to log:", err)
+		}
+	}
+
+	// The entries are written out as they are read
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(out.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if strings.Count(out.String(), "\n") < 2 {
+		t.Error("Entries were not written out while following")
+	}
+	r.Stop()
+	err = <-done
+	if err != nil {
+		t.Fatal("ParseCmdLog failed:", err)
+	}
+
+	got := []string{}
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if i := strings.Index(line, "\t"); i >= 0 {
+			got = append(got, line[i+1:])
+		}
+	}
+	compare(t, "Followed output differs", "/work\tls\n/work\tmake\n",
+		strings.Join(got, ""))
+}
+
+// syncBuffer is a bytes.Buffer that can be read while it is written to
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.String()
+}
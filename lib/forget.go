@@ -0,0 +1,111 @@
+package cmdlib
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// ForgetArgs selects the entries that are removed from the log. An entry is
+// removed if it matches all of the given criteria.
+type ForgetArgs struct {
+	Session string
+	Since   string
+	Until   string
+	Grep    string
+
+	// Remove entries matching the current filters of the Log
+	Filters bool
+
+	// Only print the entries that would be removed
+	DryRun bool
+
+	// Keep the previous log in the file BackupFile
+	Backup bool
+
+	// The removed entries are printed here if DryRun is set
+	Output io.Writer
+}
+
+// BackupFile returns the name of the file where the previous log is stored
+// when the log is rewritten with a backup.
+func (l *Log) BackupFile() string {
+	return l.LogFile + ".bak"
+}
+
+// Forget removes the entries matching the given arguments from the log. The
+// log is rewritten atomically. Returns the number of removed entries.
+// Malformed lines are never removed.
+func (l *Log) Forget(arg ForgetArgs) (removed int, err error) {
+	if arg.Session == "" && arg.Since == "" && arg.Until == "" &&
+		arg.Grep == "" && !arg.Filters {
+		return 0, fmt.Errorf("no criteria given for removing entries")
+	}
+
+	var grepRe *regexp.Regexp
+	if arg.Grep != "" {
+		grepRe, err = regexp.Compile(arg.Grep)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compile regexp \"%s\": %s", arg.Grep, err)
+		}
+	}
+
+	var filters []*regexp.Regexp
+	if arg.Filters {
+		for _, filter := range l.Filters {
+			re, err := regexp.Compile(filter)
+			if err != nil {
+				return 0, fmt.Errorf("failed to compile filter \"%s\": %s", filter, err)
+			}
+			filters = append(filters, re)
+		}
+	}
+
+	since, until := int64(minTime), int64(maxTime)
+	if arg.Since != "" {
+		since, err = ParseTime(arg.Since)
+		if err != nil {
+			return 0, fmt.Errorf("parsing given since failed: %s", err)
+		}
+	}
+	if arg.Until != "" {
+		until, err = ParseTime(arg.Until)
+		if err != nil {
+			return 0, fmt.Errorf("parsing given until failed: %s", err)
+		}
+		// The until time is included
+		until++
+	}
+
+	matches := func(line string) bool {
+		timeint, session, cmd, err := SplitLogLine(line)
+		if err != nil {
+			return false
+		}
+		cmd = decodeLogCommand(cmd)
+		if arg.Session != "" && arg.Session != session {
+			return false
+		}
+		if timeint < since || timeint >= until {
+			return false
+		}
+		if grepRe != nil && !grepRe.MatchString(cmd) {
+			return false
+		}
+		if arg.Filters {
+			found := false
+			for _, re := range filters {
+				if re.MatchString(cmd) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	return l.removeLines(matches, since, until, arg.DryRun, arg.Backup, arg.Output)
+}
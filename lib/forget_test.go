@@ -0,0 +1,124 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForget(t *testing.T) {
+	testdir := "test-forget"
+	logfile := filepath.Join(testdir, "log")
+
+	logData := `1450120005	zsh-1	go test
+1450120010	zsh-1	export PASSWORD=secret
+1450120020	zsh-2	go build
+invalid line
+1450120030	zsh-2	ls
+`
+
+	tests := []struct {
+		name     string
+		arg      ForgetArgs
+		removed  int
+		output   string
+		logData  string
+		filters  []string
+		wantErr  bool
+		backedUp bool
+	}{
+		{"No criteria", ForgetArgs{}, 0, "", logData, nil, true, false},
+		{"Invalid regexp", ForgetArgs{Grep: "["}, 0, "", logData, nil, true, false},
+		{"Invalid since", ForgetArgs{Since: "jeejee"}, 0, "", logData, nil, true, false},
+		{"Grep", ForgetArgs{Grep: "PASSWORD"}, 1, "",
+			`1450120005	zsh-1	go test
+1450120020	zsh-2	go build
+invalid line
+1450120030	zsh-2	ls
+`, nil, false, false},
+		{"Dry run", ForgetArgs{Grep: "PASSWORD", DryRun: true}, 1,
+			"1450120010\tzsh-1\texport PASSWORD=secret\n",
+			logData, nil, false, false},
+		{"Session", ForgetArgs{Session: "zsh-2"}, 2, "",
+			`1450120005	zsh-1	go test
+1450120010	zsh-1	export PASSWORD=secret
+invalid line
+`, nil, false, false},
+		{"Session and grep", ForgetArgs{Session: "zsh-2", Grep: "^go"}, 1, "",
+			`1450120005	zsh-1	go test
+1450120010	zsh-1	export PASSWORD=secret
+invalid line
+1450120030	zsh-2	ls
+`, nil, false, false},
+		{"Time range", ForgetArgs{Since: time.Unix(1450120006, 0).Format(timeFormat),
+			Until: time.Unix(1450120020, 0).Format(timeFormat)}, 2, "",
+			`1450120005	zsh-1	go test
+invalid line
+1450120030	zsh-2	ls
+`, nil, false, false},
+		{"Time range without matches", ForgetArgs{
+			Since:  time.Unix(1450120031, 0).Format(timeFormat),
+			Backup: true}, 0, "", logData, nil, false, false},
+		{"Dry run of time range", ForgetArgs{
+			Until:  time.Unix(1450120010, 0).Format(timeFormat),
+			DryRun: true}, 2,
+			"1450120005\tzsh-1\tgo test\n1450120010\tzsh-1\texport PASSWORD=secret\n",
+			logData, nil, false, false},
+		{"Filters", ForgetArgs{Filters: true}, 2, "",
+			`1450120005	zsh-1	go test
+1450120020	zsh-2	go build
+invalid line
+`, []string{"^ls$", "PASSWORD"}, false, false},
+		{"Backup", ForgetArgs{Grep: ".", Backup: true}, 4, "",
+			"invalid line\n", nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(err error, msg string) {
+				if err != nil {
+					t.Fatalf("%s: %v", msg, err)
+				}
+			}
+
+			err := os.RemoveAll(testdir)
+			check(err, "Could not remove test directory")
+			err = os.MkdirAll(testdir, 0755)
+			check(err, "Could not create test directory")
+			defer os.RemoveAll(testdir)
+
+			err = ioutil.WriteFile(logfile, []byte(logData), 0600)
+			check(err, "Could not create logfile")
+
+			log := CreateLog(logfile, "")
+			if tt.filters != nil {
+				log.Filters = tt.filters
+			}
+
+			buf := &bytes.Buffer{}
+			tt.arg.Output = buf
+			removed, err := log.Forget(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Forget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			compare(t, "Removed count differs", tt.removed, removed)
+			compare(t, "Output differs", tt.output, buf.String())
+
+			data, err := ioutil.ReadFile(logfile)
+			check(err, "Could not read logfile")
+			compare(t, "Log contents differ", tt.logData, string(data))
+
+			if FileExists(log.BackupFile()) != tt.backedUp {
+				t.Errorf("Backup file existence expected to be %v", tt.backedUp)
+			}
+			if tt.backedUp {
+				data, err = ioutil.ReadFile(log.BackupFile())
+				check(err, "Could not read backup file")
+				compare(t, "Backup contents differ", logData, string(data))
+			}
+		})
+	}
+}
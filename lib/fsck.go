@@ -0,0 +1,280 @@
+package cmdlib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FsckArgs are the arguments for the Fsck function
+type FsckArgs struct {
+	// Repair the problems and rewrite the log
+	Repair bool
+
+	// Keep the previous log in the file BackupFile when repairing
+	Backup bool
+
+	// The problems are printed here
+	Output io.Writer
+}
+
+// FsckProblem is a problem found in the log
+type FsckProblem struct {
+	// The file and the line number of the problem. The line is zero for
+	// the segments of the binary store.
+	File string
+	Line int
+
+	// Byte offset of the line or the record in the file
+	Offset int64
+
+	Message string
+}
+
+func (p FsckProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: offset %d: %s", p.File, p.Line, p.Offset, p.Message)
+	}
+	return fmt.Sprintf("%s: offset %d: %s", p.File, p.Offset, p.Message)
+}
+
+// QuarantineFile returns the name of the file where Fsck moves the lines
+// that could not be repaired, or the corrupted bytes of a binary segment
+func (l *Log) QuarantineFile() string {
+	return l.LogFile + ".quarantine"
+}
+
+// fsckEntry is a valid entry of the log
+type fsckEntry struct {
+	timeint int64
+	line    string
+}
+
+// fsckState collects the valid entries and the problems of the log
+type fsckState struct {
+	entries    []fsckEntry
+	quarantine []string
+	problems   int
+	unsorted   bool
+	output     io.Writer
+}
+
+func (s *fsckState) report(p FsckProblem) error {
+	s.problems++
+	if s.output == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(s.output, p.String())
+	return err
+}
+
+// add adds a valid entry. Reports a problem if the time goes backwards.
+func (s *fsckState) add(p FsckProblem, timeint int64, line string) error {
+	if n := len(s.entries); n > 0 && timeint < s.entries[n-1].timeint {
+		s.unsorted = true
+		p.Message = fmt.Sprintf("timestamp %d is earlier than the previous %d",
+			timeint, s.entries[n-1].timeint)
+		err := s.report(p)
+		if err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, fsckEntry{timeint, line})
+	return nil
+}
+
+// checkText checks the lines of a text log
+func (s *fsckState) checkText(file string, r LineReader) error {
+	lineno := 0
+	var offset int64
+	return ForEachLine(r, func(line string) error {
+		lineno++
+		p := FsckProblem{File: file, Line: lineno, Offset: offset}
+		offset += int64(len(line))
+
+		problem := func(msg string) error {
+			p.Message = msg
+			return s.report(p)
+		}
+
+		if strings.IndexByte(line, 0) >= 0 {
+			err := problem("NUL bytes in the line")
+			if err != nil {
+				return err
+			}
+			line = strings.Replace(line, "\x00", "", -1)
+		}
+		if !strings.HasSuffix(line, "\n") {
+			err := problem("incomplete last line")
+			if err != nil {
+				return err
+			}
+			line += "\n"
+		}
+
+		pos, ok := logFieldPositions(line)
+		if !ok {
+			s.quarantine = append(s.quarantine, line)
+			return problem("missing tab separated fields")
+		}
+		timeint, err := strconv.ParseInt(line[:pos[0]-1], 10, 64)
+		if err != nil {
+			s.quarantine = append(s.quarantine, line)
+			return problem(fmt.Sprintf("invalid timestamp %q", line[:pos[0]-1]))
+		}
+		return s.add(p, timeint, line)
+	})
+}
+
+// checkBinary checks the segments of a binary store. The rest of a segment
+// is skipped after a corrupted record, and the skipped bytes are
+// quarantined as they are.
+func (s *fsckState) checkBinary(dir string) error {
+	files, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		d, err := newSegmentDecoder(file, data)
+		if err != nil {
+			s.quarantine = append(s.quarantine, string(data))
+			err = s.report(FsckProblem{File: file, Message: err.Error()})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for {
+			offset := int64(d.pos)
+			timeint, session, cmd, err := d.next()
+			if err == io.EOF {
+				break
+			}
+			p := FsckProblem{File: file, Offset: offset}
+			if err != nil {
+				s.quarantine = append(s.quarantine, string(data[offset:]))
+				p.Message = "corrupted record, the rest of the segment is skipped"
+				err = s.report(p)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			err = s.add(p, timeint, formatLogLine(timeint, session, string(cmd)))
+			if err != nil {
+				return err
+			}
+		}
+		if d.partial {
+			if d.pos < len(data) {
+				s.quarantine = append(s.quarantine, string(data[d.pos:]))
+			}
+			err = s.report(FsckProblem{File: file, Offset: int64(d.pos),
+				Message: "incomplete record at the end of the segment"})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check checks the log and collects its valid entries
+func (s *fsckState) check(l *Log) error {
+	if StoreFormat(l.LogFile) == FormatBinary {
+		return s.checkBinary(l.LogFile)
+	}
+
+	fp, err := os.Open(l.LogFile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return s.checkText(l.LogFile, NewBufferedReader(fp, rewriteBufferSize))
+}
+
+// errNothingToRepair stops the rewrite if the log has no problems
+var errNothingToRepair = errors.New("nothing to repair")
+
+// Fsck checks the log for malformed lines, NUL bytes and timestamps that go
+// backwards, and prints the problems to the Output. Returns the number of
+// problems.
+//
+// If Repair is set, the log is rewritten atomically with the NUL bytes
+// stripped and the entries sorted by time. The lines that cannot be
+// repaired and the corrupted ends of binary segments are appended to the
+// QuarantineFile. Returns also the number of quarantined lines and segment
+// ends.
+func (l *Log) Fsck(arg FsckArgs) (problems int, quarantined int, err error) {
+	if !FileExists(l.LogFile) {
+		return 0, 0, nil
+	}
+	state := &fsckState{output: arg.Output}
+
+	if !arg.Repair {
+		unlock, err := l.lock(false)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer unlock()
+		err = state.check(l)
+		return state.problems, 0, err
+	}
+
+	filter := func(_ LineReader, w io.Writer) error {
+		err := state.check(l)
+		if err != nil {
+			return err
+		}
+		if state.problems == 0 {
+			return errNothingToRepair
+		}
+		if state.unsorted {
+			sort.SliceStable(state.entries, func(i, j int) bool {
+				return state.entries[i].timeint < state.entries[j].timeint
+			})
+		}
+		for _, e := range state.entries {
+			_, err = io.WriteString(w, e.line)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The lines are quarantined before the log is replaced, so
+		// they are not lost if the rewrite fails
+		if len(state.quarantine) == 0 {
+			return nil
+		}
+		fp, err := os.OpenFile(l.QuarantineFile(),
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(fp, strings.Join(state.quarantine, ""))
+		cerr := fp.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	backup := ""
+	if arg.Backup {
+		backup = l.BackupFile()
+	}
+	err = l.rewrite(filter, backup)
+	if err == errNothingToRepair {
+		return 0, 0, nil
+	}
+	return state.problems, len(state.quarantine), err
+}
@@ -0,0 +1,176 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	testdir := "test-fsck"
+	logfile := filepath.Join(testdir, "log")
+
+	logData := "1450120005\tzsh-1\tgo test\n" +
+		"1450120020\tzsh-2\tgo\x00 build\n" +
+		"garbage\n" +
+		"1450120010\tzsh-1\tmake\n" +
+		"abc\tzsh-1\tls\n" +
+		"1450120030\tzsh-2\tgit status"
+	problems := "test-fsck/log:2: offset 25: NUL bytes in the line\n" +
+		"test-fsck/log:3: offset 52: missing tab separated fields\n" +
+		"test-fsck/log:4: offset 60: timestamp 1450120010 is earlier than the previous 1450120020\n" +
+		"test-fsck/log:5: offset 82: invalid timestamp \"abc\"\n" +
+		"test-fsck/log:6: offset 95: incomplete last line\n"
+	repaired := "1450120005\tzsh-1\tgo test\n" +
+		"1450120010\tzsh-1\tmake\n" +
+		"1450120020\tzsh-2\tgo build\n" +
+		"1450120030\tzsh-2\tgit status\n"
+
+	tests := []struct {
+		name        string
+		arg         FsckArgs
+		problems    int
+		quarantined int
+		logData     string
+		quarantine  string
+	}{
+		{"Check", FsckArgs{}, 5, 0, logData, ""},
+		{"Repair", FsckArgs{Repair: true}, 5, 2, repaired, "garbage\nabc\tzsh-1\tls\n"},
+		{"Repair with backup", FsckArgs{Repair: true, Backup: true}, 5, 2, repaired,
+			"garbage\nabc\tzsh-1\tls\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.RemoveAll(testdir)
+			if err != nil {
+				t.Fatal("Could not remove test directory:", err)
+			}
+			err = os.MkdirAll(testdir, 0755)
+			if err != nil {
+				t.Fatal("Could not create test directory:", err)
+			}
+			defer os.RemoveAll(testdir)
+			err = ioutil.WriteFile(logfile, []byte(logData), 0600)
+			if err != nil {
+				t.Fatal("Could not write log:", err)
+			}
+
+			log := CreateLog(logfile, "")
+			out := &bytes.Buffer{}
+			tt.arg.Output = out
+			count, quarantined, err := log.Fsck(tt.arg)
+			if err != nil {
+				t.Fatal("Fsck failed:", err)
+			}
+			compare(t, "Problem count differs", tt.problems, count)
+			compare(t, "Quarantined count differs", tt.quarantined, quarantined)
+			compare(t, "Problems differ", problems, out.String())
+
+			data, err := ioutil.ReadFile(logfile)
+			if err != nil {
+				t.Fatal("Could not read log:", err)
+			}
+			compare(t, "Log differs", tt.logData, string(data))
+
+			data, _ = ioutil.ReadFile(log.QuarantineFile())
+			compare(t, "Quarantine differs", tt.quarantine, string(data))
+			compare(t, "Backup existence differs", tt.arg.Backup,
+				FileExists(log.BackupFile()))
+
+			// The result has no problems
+			count, _, err = log.Fsck(FsckArgs{Repair: tt.arg.Repair})
+			if err != nil {
+				t.Fatal("Second fsck failed:", err)
+			}
+			if tt.arg.Repair && count != 0 {
+				t.Errorf("Expected no problems after repair, got %d", count)
+			}
+		})
+	}
+}
+
+func TestFsckBinary(t *testing.T) {
+	testdir := "test-fsck-binary"
+	dir := filepath.Join(testdir, "log")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	log := CreateLog(dir, "")
+	store, err := log.OpenStore(FormatBinary)
+	if err != nil {
+		t.Fatal("Could not open store:", err)
+	}
+	for _, timeint := range []int64{1450120005, 1450120020, 1450120010} {
+		err = store.Append(timeint, "zsh-1", "make")
+		if err != nil {
+			t.Fatal("Append failed:", err)
+		}
+	}
+	store.Close()
+
+	// A partial record at the end of the segment
+	segment := segmentName(dir, 1)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal("Could not read segment:", err)
+	}
+	err = ioutil.WriteFile(segment, append(data, recordEntry), 0600)
+	if err != nil {
+		t.Fatal("Could not write segment:", err)
+	}
+
+	out := &bytes.Buffer{}
+	count, quarantined, err := log.Fsck(FsckArgs{Repair: true, Output: out})
+	if err != nil {
+		t.Fatal("Fsck failed:", err)
+	}
+	compare(t, "Problem count differs", 2, count)
+	compare(t, "Quarantined count differs", 1, quarantined)
+	compare(t, "Problems differ",
+		segment+": offset 35: timestamp 1450120010 is earlier than the previous 1450120020\n"+
+			segment+": offset 43: incomplete record at the end of the segment\n",
+		out.String())
+
+	store, err = log.OpenStore("")
+	if err != nil {
+		t.Fatal("Could not open store:", err)
+	}
+	defer store.Close()
+	r, err := store.Scan(false)
+	if err != nil {
+		t.Fatal("Scanning failed:", err)
+	}
+	compare(t, "Repaired log differs",
+		"1450120005\tzsh-1\tmake\n1450120010\tzsh-1\tmake\n1450120020\tzsh-1\tmake\n",
+		readAll(t, r))
+
+	// A corrupted record is quarantined with the rest of the segment
+	data, err = ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal("Could not read segment:", err)
+	}
+	err = ioutil.WriteFile(segment, append(data, "xjunk"...), 0600)
+	if err != nil {
+		t.Fatal("Could not write segment:", err)
+	}
+	out.Reset()
+	count, quarantined, err = log.Fsck(FsckArgs{Repair: true, Output: out})
+	if err != nil {
+		t.Fatal("Fsck failed:", err)
+	}
+	compare(t, "Problem count differs", 1, count)
+	compare(t, "Quarantined count differs", 1, quarantined)
+	compare(t, "Problems differ",
+		segment+": offset "+strconv.Itoa(len(data))+
+			": corrupted record, the rest of the segment is skipped\n",
+		out.String())
+	data, _ = ioutil.ReadFile(log.QuarantineFile())
+	compare(t, "Quarantine differs", string([]byte{recordEntry})+"xjunk", string(data))
+}
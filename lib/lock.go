@@ -0,0 +1,36 @@
+package cmdlib
+
+import (
+	"os"
+)
+
+// LockFile returns the name of the file that is used to coordinate access to
+// the log between concurrent cmdlog processes.
+func (l *Log) LockFile() string {
+	return l.LogFile + ".lock"
+}
+
+// lock takes a lock on the log. Appending to the log uses a shared lock as
+// O_APPEND writes do not interfere with each other. Rewriting the log
+// requires an exclusive lock.
+func (l *Log) lock(exclusive bool) (unlock func() error, err error) {
+	fp, err := os.OpenFile(l.LockFile(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(fp, exclusive)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return func() error {
+		err := unlockFile(fp)
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		return fp.Close()
+	}, nil
+}
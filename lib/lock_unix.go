@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package cmdlib
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(fp *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(fp.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
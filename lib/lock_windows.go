@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package cmdlib
+
+import (
+	"os"
+)
+
+// File locking is not supported on Windows. Concurrent rewrites of the log
+// are not coordinated.
+
+func lockFile(fp *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(fp *os.File) error {
+	return nil
+}
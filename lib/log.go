@@ -5,9 +5,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -38,14 +41,30 @@ func CreateLog(logfile, filterfile string) *Log {
 	return ret
 }
 
+// sanitizeCommand removes NUL bytes from the command and replaces invalid
+// UTF-8 sequences with the Unicode replacement character
+func sanitizeCommand(cmd string) string {
+	if strings.IndexByte(cmd, 0) >= 0 {
+		cmd = strings.Replace(cmd, "\x00", "", -1)
+	}
+	if !utf8.ValidString(cmd) {
+		cmd = strings.ToValidUTF8(cmd, string(utf8.RuneError))
+	}
+	return cmd
+}
+
 // AppendLine creates a log line to the given logfile
 func (l *Log) AppendLine(session string, args string) error {
-	// change to single line command
-	re := regexp.MustCompile("[\r\n]+")
-	args = re.ReplaceAllString(args, " ")
-
 	// delete trailing whitespace
-	args = strings.TrimRight(args, " ")
+	args = strings.TrimRight(sanitizeCommand(args), " \r\n")
+
+	return l.AppendCommand(session, args)
+}
+
+// AppendCommand creates a log line of the command as it is, including
+// trailing whitespace
+func (l *Log) AppendCommand(session string, args string) error {
+	args = sanitizeCommand(args)
 
 	// Filter out unlogged commands
 	for _, filter := range l.Filters {
@@ -55,6 +74,33 @@ func (l *Log) AppendLine(session string, args string) error {
 		}
 	}
 
+	store, err := l.OpenStore("")
+	if err != nil {
+		return err
+	}
+	// The newlines and tabs are escaped, see encodeLogCommand
+	err = store.Append(time.Now().Unix(), session, encodeLogCommand(args))
+	cerr := store.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// appendData appends the given complete log lines to the log
+func (l *Log) appendData(data []byte) error {
+	// The log directory is created on the first append
+	err := os.MkdirAll(filepath.Dir(l.LogFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := l.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	fp, err := os.OpenFile(l.LogFile,
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
@@ -62,8 +108,7 @@ func (l *Log) AppendLine(session string, args string) error {
 	}
 	defer fp.Close()
 
-	_, err = fmt.Fprintf(fp, "%d\t%s\t%s\n", time.Now().Unix(),
-		session, args)
+	_, err = fp.Write(data)
 	if err != nil {
 		return err
 	}
@@ -71,6 +116,29 @@ func (l *Log) AppendLine(session string, args string) error {
 	return fp.Close()
 }
 
+// formatLogLine creates a log line from the given fields
+func formatLogLine(timeint int64, session string, cmd string) string {
+	return strconv.FormatInt(timeint, 10) + "\t" + session + "\t" + cmd + "\n"
+}
+
+// SplitLogLine splits a log line to the timestamp, session and command
+// fields. The fields are located the same way as in ParseCmdLogLineNoAlloc.
+// The trailing newline is not part of the command.
+func SplitLogLine(line string) (timeint int64, session string, cmd string, err error) {
+	line = strings.TrimSuffix(line, "\n")
+	pos, ok := logFieldPositions(line)
+	if !ok {
+		return 0, "", "", fmt.Errorf("invalid log line: %q", line)
+	}
+
+	timeint, err = strconv.ParseInt(line[:pos[0]-1], 10, 64)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("invalid timestamp in log line: %q", line)
+	}
+
+	return timeint, line[pos[0] : pos[1]-1], line[pos[1]:], nil
+}
+
 // SaveDefaultFilters saves the default filters as an example if such file
 // does not yet exist.
 func (l *Log) SaveDefaultFilters() error {
@@ -88,6 +156,11 @@ func (l *Log) SaveDefaultFilters() error {
 		_, _ = sb.WriteString("\n")
 	}
 
+	err := os.MkdirAll(filepath.Dir(l.FilterFile), 0700)
+	if err != nil {
+		return err
+	}
+
 	out := []byte(sb.String())
 	return ioutil.WriteFile(l.FilterFile, out, 0600)
 }
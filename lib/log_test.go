@@ -65,6 +65,12 @@ func TestLog(t *testing.T) {
 		}
 	}
 
+	opAppendCommand := func(session, args string) func() error {
+		return func() error {
+			return log.AppendCommand(session, args)
+		}
+	}
+
 	opAppendLongLine := func(session, args string, times int) func() error {
 		return func() error {
 			sb := strings.Builder{}
@@ -249,6 +255,43 @@ func TestLog(t *testing.T) {
 			},
 			[]string{"abc.*"},
 		},
+		{"Logfile multi-line command escaped",
+			contentsForRemoval,
+			"",
+			[]opfunc{
+				opAppendLine("ses", "for a in b; do\n\techo \"\\n\"\ndone\n"),
+				opExpectLogfile(`^[0-9]+\tses\t\tfor a in b; do\\n\\techo "\\\\n"\\ndone\n$`),
+			},
+			defaultFilters,
+		},
+		{"Logfile backslashes not escaped",
+			contentsForRemoval,
+			"",
+			[]opfunc{
+				opAppendLine("ses", `printf "a\n" \\`),
+				opExpectLogfile(`^[0-9]+\tses\tprintf "a\\n" \\\\\n$`),
+			},
+			defaultFilters,
+		},
+		{"Logfile trailing whitespace kept",
+			contentsForRemoval,
+			"",
+			[]opfunc{
+				opAppendCommand("ses", "echo a  "),
+				opAppendCommand("ses", "echo b \r\n"),
+				opExpectLogfile(`^[0-9]+\tses\techo a  \n[0-9]+\tses\t\techo b \\r\\n\n$`),
+			},
+			defaultFilters,
+		},
+		{"Logfile NUL bytes and invalid UTF-8 sanitized",
+			contentsForRemoval,
+			"",
+			[]opfunc{
+				opAppendLine("ses", "echo  a\x00b \xff\xfeä"),
+				opExpectLogfile(`^[0-9]+\tses\techo  ab \x{FFFD}ä\n$`),
+			},
+			defaultFilters,
+		},
 		{"Logfile create, add a very long line",
 			contentsForRemoval,
 			contentsForRemoval,
@@ -298,3 +341,40 @@ func TestLog(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendCommandRoundTrip(t *testing.T) {
+	testdir := "test-append-command"
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+	log := CreateLog(filepath.Join(testdir, "log"), "")
+
+	cmds := []string{"echo a  ", "echo b \r\n", "echo c", "echo d\t"}
+	for _, cmd := range cmds {
+		err = log.AppendCommand("ses", cmd)
+		if err != nil {
+			t.Fatal("AppendCommand failed:", err)
+		}
+	}
+
+	store, err := log.OpenStore("")
+	if err != nil {
+		t.Fatal("Opening the log failed:", err)
+	}
+	defer store.Close()
+	lr, err := store.Scan(false)
+	if err != nil {
+		t.Fatal("Scanning the log failed:", err)
+	}
+	got := make([]string, 0, len(cmds))
+	err = ScanCmdLog(lr, ParseArgs{}, func(e *Entry) error {
+		got = append(got, e.Command)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Reading the log failed:", err)
+	}
+	compare(t, "Commands differ", cmds, got)
+}
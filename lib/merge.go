@@ -0,0 +1,193 @@
+package cmdlib
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"strings"
+)
+
+// MergeInput is a single command log that is merged
+type MergeInput struct {
+	Reader LineReader
+
+	// The host where the log is from
+	Host string
+}
+
+// MergeArgs are the arguments for the MergeLogs function
+type MergeArgs struct {
+	Inputs []MergeInput
+
+	// Prefix the session of each entry with the host of the input
+	TagHost bool
+
+	Output io.Writer
+}
+
+type mergeItem struct {
+	line    string
+	timeint int64
+	input   int
+}
+
+// mergeHeap orders the items by time. Items with the same time are ordered
+// by the input index to keep the merge stable.
+type mergeHeap struct {
+	items   []mergeItem
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if a.timeint != b.timeint {
+		return (a.timeint < b.timeint) != h.reverse
+	}
+	return a.input < b.input
+}
+func (h *mergeHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
+
+// TagSession returns the session prefixed with the host.
+func TagSession(host, session string) string {
+	return host + ":" + session
+}
+
+// MergeReader is a LineReader that k-way merges several command logs by
+// time. Each input is expected to be in time order, or in reverse time order
+// if reverse is set. Only a single line per input is in memory at a time.
+// Exact duplicate entries are returned only once. Malformed lines are kept in
+// the position they were in the input.
+type MergeReader struct {
+	inputs  []MergeInput
+	tagHost bool
+
+	heap    mergeHeap
+	started bool
+
+	// The latest valid time of each input
+	latest []int64
+
+	// The lines returned with the current timestamp
+	seenTime int64
+	seen     map[string]struct{}
+
+	// Number of dropped duplicate entries
+	Duplicates int
+}
+
+func NewMergeReader(inputs []MergeInput, tagHost bool, reverse bool) *MergeReader {
+	return &MergeReader{
+		inputs:  inputs,
+		tagHost: tagHost,
+		heap:    mergeHeap{reverse: reverse},
+		latest:  make([]int64, len(inputs)),
+		seen:    make(map[string]struct{}),
+	}
+}
+
+func (m *MergeReader) readNext(input int) error {
+	var line string
+	var err error
+	for {
+		line, err = m.inputs[input].Reader.ReadLine()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// Skip empty lines
+		if line != "\n" || err == io.EOF {
+			break
+		}
+	}
+	if line == "" || line == "\n" {
+		return nil
+	}
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+
+	timeint, _, _, perr := SplitLogLine(line)
+	if perr == nil {
+		m.latest[input] = timeint
+	}
+	heap.Push(&m.heap, mergeItem{line, m.latest[input], input})
+	return nil
+}
+
+func (m *MergeReader) ReadLine() (string, error) {
+	if !m.started {
+		m.started = true
+		for i := range m.inputs {
+			err := m.readNext(i)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	for m.heap.Len() > 0 {
+		item := heap.Pop(&m.heap).(mergeItem)
+
+		err := m.readNext(item.input)
+		if err != nil {
+			return "", err
+		}
+
+		if item.timeint != m.seenTime {
+			m.seenTime = item.timeint
+			m.seen = make(map[string]struct{})
+		}
+
+		if _, ok := m.seen[item.line]; ok {
+			m.Duplicates++
+			continue
+		}
+		m.seen[item.line] = struct{}{}
+
+		line := item.line
+		if m.tagHost {
+			timeint, session, cmd, perr := SplitLogLine(line)
+			if perr == nil {
+				line = formatLogLine(timeint,
+					TagSession(m.inputs[item.input].Host, session), cmd)
+			}
+		}
+		return line, nil
+	}
+
+	return "", io.EOF
+}
+
+// MergeLogs k-way merges the given command logs by time to the output. See
+// MergeReader for details.
+//
+// Returns the number of written lines and dropped duplicates.
+func MergeLogs(arg MergeArgs) (written int, duplicates int, err error) {
+	out := bufio.NewWriter(arg.Output)
+	reader := NewMergeReader(arg.Inputs, arg.TagHost, false)
+
+	for {
+		var line string
+		line, err = reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, reader.Duplicates, err
+		}
+		_, err = out.WriteString(line)
+		if err != nil {
+			return written, reader.Duplicates, err
+		}
+		written++
+	}
+
+	return written, reader.Duplicates, out.Flush()
+}
@@ -0,0 +1,66 @@
+package cmdlib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMergeLogs(t *testing.T) {
+	type input struct {
+		data string
+		host string
+	}
+	tests := []struct {
+		name       string
+		inputs     []input
+		tag        bool
+		output     string
+		written    int
+		duplicates int
+	}{
+		{"No inputs", nil, false, "", 0, 0},
+		{"Single input", []input{{"1\ta\tx\n2\ta\ty\n", "h"}}, false,
+			"1\ta\tx\n2\ta\ty\n", 2, 0},
+		{"Missing newline at end", []input{{"1\ta\tx", "h"}}, false,
+			"1\ta\tx\n", 1, 0},
+		{"Interleaved", []input{
+			{"1\ta\tx\n3\ta\tz\n", "h1"},
+			{"2\tb\ty\n4\tb\tw\n", "h2"},
+		}, false, "1\ta\tx\n2\tb\ty\n3\ta\tz\n4\tb\tw\n", 4, 0},
+		{"Duplicates", []input{
+			{"1\ta\tx\n2\ta\ty\n", "h1"},
+			{"1\ta\tx\n2\tb\ty\n", "h2"},
+			{"2\ta\ty\n", "h3"},
+		}, false, "1\ta\tx\n2\ta\ty\n2\tb\ty\n", 3, 2},
+		{"Tag hosts", []input{
+			{"1\ta\tx\n", "h1"},
+			{"2\tb\ty\n", "h2"},
+		}, true, "1\th1:a\tx\n2\th2:b\ty\n", 2, 0},
+		{"Malformed lines keep position", []input{
+			{"1\ta\tx\ngarbage\n5\ta\tz\n", "h1"},
+			{"2\tb\ty\n", "h2"},
+		}, true, "1\th1:a\tx\ngarbage\n2\th2:b\ty\n5\th1:a\tz\n", 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			arg := MergeArgs{
+				TagHost: tt.tag,
+				Output:  buf,
+			}
+			for _, in := range tt.inputs {
+				arg.Inputs = append(arg.Inputs, MergeInput{
+					Reader: &testLineReader{buf: bytes.NewBufferString(in.data)},
+					Host:   in.host,
+				})
+			}
+			written, duplicates, err := MergeLogs(arg)
+			if err != nil {
+				t.Fatalf("MergeLogs() error = %v", err)
+			}
+			compare(t, "Outputs differ", tt.output, buf.String())
+			compare(t, "Written count differs", tt.written, written)
+			compare(t, "Duplicate count differs", tt.duplicates, duplicates)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package cmdlib
+
+import (
+	"path"
+	"strings"
+)
+
+// ShellCommand is a program run by a command line with its arguments.
+// Redirections, variable assignments and wrappers like sudo are removed.
+type ShellCommand struct {
+	// The base name of the program, e.g. git for /usr/bin/git
+	Program string
+
+	// The arguments with quotes and escapes removed
+	Args []string
+}
+
+// Pipeline is a list of commands connected with pipes
+type Pipeline []ShellCommand
+
+// shellWrapper describes a program that runs the command given in its
+// arguments
+type shellWrapper struct {
+	// The short options that take an argument
+	argOptions string
+
+	// The number of arguments before the command
+	positional int
+
+	// Variable assignments before the command are skipped
+	assignments bool
+}
+
+var shellWrappers = map[string]shellWrapper{
+	"sudo":    {argOptions: "CDghpRrTtUu"},
+	"doas":    {argOptions: "Cu"},
+	"env":     {argOptions: "CSu", assignments: true},
+	"time":    {argOptions: "fo"},
+	"nice":    {argOptions: "n"},
+	"ionice":  {argOptions: "cnp"},
+	"nohup":   {},
+	"exec":    {argOptions: "a"},
+	"command": {},
+	"builtin": {},
+	"noglob":  {},
+	"timeout": {argOptions: "ks", positional: 1},
+}
+
+// Reserved words that start a compound command. The words following them
+// are a command.
+var shellReservedWords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "elif": true,
+	"else": true, "while": true, "until": true, "do": true,
+}
+
+// Reserved words that start a line that is not a command
+var shellNonCommands = map[string]bool{
+	"for": true, "select": true, "case": true, "function": true,
+	"done": true, "fi": true, "esac": true,
+}
+
+// isShellAssignment returns true if the word is a variable assignment
+func isShellAssignment(tok shellToken) bool {
+	idx := strings.IndexByte(tok.Value, '=')
+	if tok.Quoted || tok.Operator || idx <= 0 {
+		return false
+	}
+	for i, c := range tok.Value[:idx] {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') &&
+			(i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// skipWrapperOptions returns the words after the options and the positional
+// arguments of the wrapper
+func skipWrapperOptions(w shellWrapper, words []shellToken) []shellToken {
+	for len(words) > 0 && strings.HasPrefix(words[0].Value, "-") &&
+		words[0].Value != "-" {
+		opt := words[0].Value
+		words = words[1:]
+		if opt == "--" {
+			break
+		}
+		if strings.HasPrefix(opt, "--") {
+			continue
+		}
+		for i := 1; i < len(opt); i++ {
+			if strings.IndexByte(w.argOptions, opt[i]) >= 0 {
+				// The argument is in the next word if the
+				// option is the last one
+				if i == len(opt)-1 && len(words) > 0 {
+					words = words[1:]
+				}
+				break
+			}
+		}
+	}
+	for i := 0; i < w.positional && len(words) > 0; i++ {
+		words = words[1:]
+	}
+	return words
+}
+
+// parseSimpleCommand returns the program run by the words of a simple
+// command. Returns false if the words do not run a program.
+func parseSimpleCommand(tokens []shellToken) (ShellCommand, bool) {
+	words := []shellToken{}
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].isRedirection() {
+			// Skip the target
+			i++
+			continue
+		}
+		words = append(words, tokens[i])
+	}
+
+	for len(words) > 0 && shellReservedWords[words[0].Value] && !words[0].Quoted {
+		words = words[1:]
+	}
+	if len(words) == 0 || shellNonCommands[words[0].Value] && !words[0].Quoted {
+		return ShellCommand{}, false
+	}
+
+	assignments := true
+	var wrapper *shellToken
+	for len(words) > 0 {
+		if assignments && isShellAssignment(words[0]) {
+			words = words[1:]
+			continue
+		}
+		w, ok := shellWrappers[path.Base(words[0].Value)]
+		if !ok || words[0].Quoted {
+			break
+		}
+		wrapper = &words[0]
+		assignments = w.assignments
+		words = skipWrapperOptions(w, words[1:])
+	}
+
+	// A wrapper without a command is the program itself, e.g. sudo -i
+	if len(words) == 0 {
+		if wrapper == nil {
+			return ShellCommand{}, false
+		}
+		words = []shellToken{*wrapper}
+	}
+
+	ret := ShellCommand{Program: path.Base(words[0].Value)}
+	for _, w := range words[1:] {
+		ret.Args = append(ret.Args, w.Value)
+	}
+	return ret, true
+}
+
+// ParsePipelines splits a command line to pipelines and the commands of each
+// pipeline. The pipelines are separated by ;, &&, ||, & and newlines.
+// Subshells and command substitutions are parsed as separate pipelines.
+func ParsePipelines(cmd string) []Pipeline {
+	var ret []Pipeline
+	var pipeline Pipeline
+	var words []shellToken
+
+	endCommand := func() {
+		if c, ok := parseSimpleCommand(words); ok {
+			pipeline = append(pipeline, c)
+		}
+		words = nil
+	}
+	endPipeline := func() {
+		endCommand()
+		if len(pipeline) > 0 {
+			ret = append(ret, pipeline)
+		}
+		pipeline = nil
+	}
+
+	for _, tok := range splitShell(cmd) {
+		switch {
+		case !tok.Operator || tok.isRedirection():
+			// The $ of a command substitution is not a word
+			if tok.Value == "$" && !tok.Quoted {
+				continue
+			}
+			words = append(words, tok)
+		case tok.Value == "|" || tok.Value == "|&":
+			endCommand()
+		default:
+			endPipeline()
+		}
+	}
+	endPipeline()
+
+	return ret
+}
+
+// ParseCommands returns the commands run by a command line in order
+func ParseCommands(cmd string) []ShellCommand {
+	var ret []ShellCommand
+	for _, p := range ParsePipelines(cmd) {
+		ret = append(ret, p...)
+	}
+	return ret
+}
+
+// RunsProgram returns true if the command line runs the program. The
+// program is compared to the base names of the programs.
+func RunsProgram(cmd string, program string) bool {
+	for _, c := range ParseCommands(cmd) {
+		if c.Program == program {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package cmdlib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// formatPipelines formats the pipelines with the programs in brackets,
+// pipes between the commands and ; between the pipelines
+func formatPipelines(pipelines []Pipeline) string {
+	parts := []string{}
+	for _, p := range pipelines {
+		cmds := []string{}
+		for _, c := range p {
+			cmds = append(cmds, strings.Join(append([]string{"[" + c.Program + "]"},
+				c.Args...), " "))
+		}
+		parts = append(parts, strings.Join(cmds, " | "))
+	}
+	return strings.Join(parts, " ; ")
+}
+
+func TestParsePipelines(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"", ""},
+		{"git status", "[git] status"},
+		{"/usr/bin/git log --oneline", "[git] log --oneline"},
+		{`git commit -m "a | b && c"`, "[git] commit -m a | b && c"},
+		{"make && make install || echo fail", "[make] ; [make] install ; [echo] fail"},
+		{"cat a | grep -v b |& sort > out 2>&1", "[cat] a | [grep] -v b | [sort]"},
+		{"FOO=1 BAR=2 go test", "[go] test"},
+		{"sudo -u root -E systemctl restart x", "[systemctl] restart x"},
+		{"sudo -- ls", "[ls]"},
+		{"sudo -i", "[sudo]"},
+		{"env -u X FOO=1 kubectl get pods", "[kubectl] get pods"},
+		{"time -p nice -n 5 make -j8", "[make] -j8"},
+		{"timeout -s KILL 10 curl x", "[curl] x"},
+		{"nohup command ls &", "[ls]"},
+		{"'sudo' x", "[sudo] x"},
+		{"echo FOO=1", "[echo] FOO=1"},
+		{"(cd src && make)", "[cd] src ; [make]"},
+		{"echo $(git rev-parse HEAD)", "[echo] ; [git] rev-parse HEAD"},
+		{"for f in *.go; do gofmt -l $f; done", "[gofmt] -l $f"},
+		{"if true; then ls; fi", "[true] ; [ls]"},
+		{"while read a\ndo\n  echo $a\ndone < x", "[read] a ; [echo] $a"},
+		{"! grep -q x y", "[grep] -q x y"},
+		{"ls # git", "[ls]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			compare(t, "Pipelines differ", tt.want, formatPipelines(ParsePipelines(tt.cmd)))
+		})
+	}
+}
+
+func TestRunsProgram(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		program string
+		want    bool
+	}{
+		{"git status", "git", true},
+		{"sudo git status", "git", true},
+		{"echo git", "git", false},
+		{"gitk", "git", false},
+		{"make | tee /tmp/git", "git", false},
+		{"ls && env A=b git log", "git", true},
+		{"ls", "git", false},
+		{`g\it status`, "git", true},
+		{`"git" status`, "git", true},
+	}
+	for _, tt := range tests {
+		compare(t, tt.cmd+" runs "+tt.program, tt.want, RunsProgram(tt.cmd, tt.program))
+	}
+}
+
+func TestReportProgram(t *testing.T) {
+	data := "1000\tz1\tsudo kubectl get pods\n" +
+		"1100\tz1\techo kubectl\n" +
+		"1200\tz2\tls | kubectl apply -f -\n"
+	out := &bytes.Buffer{}
+	err := ParseCmdLog(&testLineReader{buf: bytes.NewBufferString(data)},
+		ParseArgs{Program: "kubectl", Session: "z1", Output: out})
+	if err != nil {
+		t.Fatal("ParseCmdLog failed:", err)
+	}
+	if !strings.HasSuffix(out.String(), "\tsudo kubectl get pods\n") ||
+		strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("Unexpected report: %q", out.String())
+	}
+}
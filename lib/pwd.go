@@ -0,0 +1,474 @@
+package cmdlib
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	cdPath = os.Getenv("CDPATH")
+)
+
+const (
+	sessionStartCommand = "Started shell session"
+	sessionStartPrefix  = sessionStartCommand + ": "
+)
+
+// sessionStart returns the start directory of the session if the command
+// is the line logged at the start of the session. A start without the
+// directory is in the home directory.
+func sessionStart(cmd string) (dir string, ok bool) {
+	if cmd == sessionStartCommand {
+		return homeDir, true
+	}
+	if !strings.HasPrefix(cmd, sessionStartPrefix) {
+		return "", false
+	}
+	return filepath.Clean(strings.TrimSpace(strings.TrimPrefix(cmd, sessionStartPrefix))), true
+}
+
+// dirState is the directory state of a shell session
+type dirState struct {
+	cwd    string
+	oldpwd string
+
+	// The directory stack of pushd and popd without the cwd
+	stack []string
+
+	// Set if the previous directories were used
+	readHistory bool
+}
+
+func newDirState() dirState {
+	return dirState{cwd: homeDir}
+}
+
+// expandTilde expands ~ and ~user at the start of the path
+func expandTilde(path string) string {
+	name := strings.TrimPrefix(path, "~")
+	rest := ""
+	if idx := strings.IndexByte(name, '/'); idx >= 0 {
+		name, rest = name[:idx], name[idx:]
+	}
+
+	home := homeDir
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err == nil {
+			home = u.HomeDir
+		} else {
+			// Guess that the home directories are next to each other
+			home = filepath.Join(filepath.Dir(homeDir), name)
+		}
+	}
+	return home + rest
+}
+
+// resolve returns the directory where cd changes to. CDPATH is used for
+// relative paths that do not start with . or .. if the directory exists.
+func (s *dirState) resolve(dir string, useCdPath bool) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+
+	if useCdPath && cdPath != "" && dir != "." && dir != ".." &&
+		!strings.HasPrefix(dir, "./") && !strings.HasPrefix(dir, "../") {
+		for _, p := range filepath.SplitList(cdPath) {
+			// The historical cwd might not exist anymore, so it is
+			// not checked
+			if p == "" || p == "." {
+				break
+			}
+			candidate := filepath.Join(p, dir)
+			if !filepath.IsAbs(candidate) {
+				candidate = filepath.Join(s.cwd, candidate)
+			}
+			info, err := os.Stat(candidate)
+			if err == nil && info.IsDir() {
+				return filepath.Clean(candidate)
+			}
+		}
+	}
+
+	return filepath.Join(s.cwd, dir)
+}
+
+func (s *dirState) chdir(dir string) {
+	s.oldpwd, s.cwd = s.cwd, dir
+}
+
+// dirStackIndex parses the +N and -N arguments of pushd and popd to an index
+// of the stack including the cwd.
+func (s *dirState) dirStackIndex(arg string) (int, bool) {
+	if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') {
+		return 0, false
+	}
+	n, err := strconv.Atoi(arg[1:])
+	size := len(s.stack) + 1
+	if err != nil || n >= size {
+		return 0, false
+	}
+	if arg[0] == '-' {
+		n = size - 1 - n
+	}
+	return n, true
+}
+
+func (s *dirState) cd(args []string) {
+	// Skip options
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+
+	switch {
+	case len(args) == 0:
+		s.chdir(homeDir)
+	case args[0] == "-":
+		s.readHistory = true
+		if s.oldpwd != "" {
+			s.chdir(s.oldpwd)
+		}
+	case len(args) >= 2:
+		// zsh: replace the first occurrence of old with new in cwd
+		s.chdir(strings.Replace(s.cwd, args[0], args[1], 1))
+	default:
+		s.chdir(s.resolve(args[0], true))
+	}
+}
+
+func (s *dirState) pushd(args []string) {
+	s.readHistory = true
+	if len(args) == 0 {
+		if len(s.stack) > 0 {
+			prev := s.cwd
+			s.chdir(s.stack[0])
+			s.stack[0] = prev
+		}
+		return
+	}
+
+	if idx, ok := s.dirStackIndex(args[0]); ok {
+		// Rotate the stack so that the idx is at the top
+		all := append([]string{s.cwd}, s.stack...)
+		all = append(all[idx:], all[:idx]...)
+		s.chdir(all[0])
+		s.stack = all[1:]
+		return
+	}
+
+	prev := s.cwd
+	s.chdir(s.resolve(args[0], true))
+	s.stack = append([]string{prev}, s.stack...)
+}
+
+func (s *dirState) popd(args []string) {
+	s.readHistory = true
+	idx := 0
+	if len(args) > 0 {
+		var ok bool
+		idx, ok = s.dirStackIndex(args[0])
+		if !ok {
+			return
+		}
+	}
+	if len(s.stack) == 0 {
+		return
+	}
+
+	if idx == 0 {
+		s.chdir(s.stack[0])
+		s.stack = s.stack[1:]
+		return
+	}
+	s.stack = append(s.stack[:idx-1:idx-1], s.stack[idx:]...)
+}
+
+func (s *dirState) dirs(args []string) {
+	for _, arg := range args {
+		if arg == "-c" {
+			s.stack = nil
+		}
+	}
+}
+
+// runCommand updates the state according to a simple command
+func (s *dirState) runCommand(words []shellToken) {
+	args := []string{}
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w.isRedirection() {
+			// Skip the target
+			i++
+			continue
+		}
+		if w.Operator {
+			continue
+		}
+		value := w.Value
+		if w.Tilde {
+			value = expandTilde(value)
+		}
+		args = append(args, value)
+	}
+
+	// Skip variable assignments and builtin prefixes
+	for len(args) > 0 {
+		if !words[0].Quoted && strings.Contains(args[0], "=") &&
+			!strings.HasPrefix(args[0], "=") {
+			args = args[1:]
+			continue
+		}
+		if args[0] == "builtin" || args[0] == "command" {
+			args = args[1:]
+			continue
+		}
+		break
+	}
+	if len(args) == 0 {
+		return
+	}
+
+	switch args[0] {
+	case "cd", "chdir":
+		s.cd(args[1:])
+	case "pushd":
+		s.pushd(args[1:])
+	case "popd":
+		s.popd(args[1:])
+	case "dirs":
+		s.dirs(args[1:])
+	}
+}
+
+// apply updates the state according to the command line
+func (s *dirState) apply(cmd string) {
+	if dir, ok := sessionStart(cmd); ok {
+		*s = newDirState()
+		s.cwd = dir
+		return
+	}
+
+	// Shorthand for going up one directory
+	if cmd == "s" {
+		s.cd([]string{".."})
+		return
+	}
+
+	type simpleCommand struct {
+		words []shellToken
+		// Run in a subshell or in the background
+		subshell bool
+		// The operator before the command
+		prevOp string
+		// The operator after the command
+		nextOp string
+	}
+
+	cmds := []simpleCommand{}
+	cur := simpleCommand{}
+	depth := 0
+	prevOp := ""
+
+	for _, tok := range splitShell(cmd) {
+		switch {
+		case tok.Operator && tok.Value == "(":
+			depth++
+		case tok.Operator && tok.Value == ")":
+			if depth > 0 {
+				depth--
+			}
+		case tok.isSeparator():
+			cur.prevOp = prevOp
+			cur.nextOp = tok.Value
+			cmds = append(cmds, cur)
+			cur = simpleCommand{}
+			prevOp = tok.Value
+		default:
+			if depth > 0 {
+				cur.subshell = true
+			}
+			cur.words = append(cur.words, tok)
+		}
+	}
+	cur.prevOp = prevOp
+	cmds = append(cmds, cur)
+
+	skip := false
+	for _, c := range cmds {
+		// Assume that commands succeed, so commands after || are not
+		// run
+		if c.prevOp == "||" {
+			skip = true
+		} else if c.prevOp != "|" && c.prevOp != "|&" {
+			skip = false
+		}
+
+		pipeline := c.prevOp == "|" || c.prevOp == "|&" ||
+			c.nextOp == "|" || c.nextOp == "|&"
+		if skip || c.subshell || pipeline || c.nextOp == "&" {
+			continue
+		}
+		s.runCommand(c.words)
+	}
+}
+
+// Heuristic to determine the current directory
+func determineDirectory(previous string, cmd string) string {
+	s := newDirState()
+	s.cwd = previous
+	s.apply(cmd)
+	return s.cwd
+}
+
+// resetsDirectory returns true if the directory after the command does not
+// depend on the previous directory state.
+func resetsDirectory(cmd string) bool {
+	if _, ok := sessionStart(cmd); ok {
+		return true
+	}
+	a := dirState{cwd: "/reset-a/cwd", oldpwd: "/reset-a/old",
+		stack: []string{"/reset-a/stack"}}
+	b := dirState{cwd: "/reset-b/cwd", oldpwd: "/reset-b/old",
+		stack: []string{"/reset-b/stack"}}
+	a.apply(cmd)
+	b.apply(cmd)
+	return a.cwd == b.cwd
+}
+
+// readsDirHistory returns true if the command uses the previous directories
+// of the session, e.g. "cd -" or "popd".
+func readsDirHistory(cmd string) bool {
+	if _, ok := sessionStart(cmd); ok {
+		return false
+	}
+	s := newDirState()
+	s.apply(cmd)
+	return s.readHistory
+}
+
+// pwdTracker determines the working directories of the entries
+// incrementally per session. The entries are given in time order.
+type pwdTracker struct {
+	state map[string]*dirState
+}
+
+func newPwdTracker() *pwdTracker {
+	return &pwdTracker{state: make(map[string]*dirState)}
+}
+
+// Add sets the working directory of the entry. It is ready immediately.
+func (t *pwdTracker) Add(e *Entry) []*Entry {
+	s, ok := t.state[e.Session]
+	if !ok {
+		ns := newDirState()
+		s = &ns
+		t.state[e.Session] = s
+	}
+	s.apply(e.Command)
+	e.Pwd = s.cwd
+	return []*Entry{e}
+}
+
+// Finish returns the entries that are still waiting for their working
+// directory.
+func (t *pwdTracker) Finish() []*Entry {
+	return nil
+}
+
+// AddPwdsToReport Add working directories to the report. The items of the
+// report are the time, session, command and working directory.
+//
+// Deprecated: Use ScanCmdLog with ParseArgs.Pwd instead.
+func AddPwdsToReport(report *[][]string) {
+	pwds := newPwdTracker()
+	for _, item := range *report {
+		if item != nil && item[0] != "" {
+			e := &Entry{Session: item[1], Command: item[2]}
+			pwds.Add(e)
+			item[3] = e.Pwd
+		}
+	}
+}
+
+// reversePwdTracker determines the working directories of the entries that
+// are given in reverse time order. The directory of an entry is known only
+// after an earlier command of the same session resets the directory, e.g.
+// the session start or a cd to an absolute path. If a later command uses the
+// previous directories, e.g. "cd -", only the session start resets them.
+// Until then the entry, and all entries after it, wait in a queue to keep
+// the order.
+type reversePwdTracker struct {
+	queue        []*pwdEntry
+	pending      map[string][]*pwdEntry
+	readsHistory map[string]bool
+}
+
+type pwdEntry struct {
+	entry *Entry
+	done  bool
+}
+
+func newReversePwdTracker() *reversePwdTracker {
+	return &reversePwdTracker{
+		pending:      make(map[string][]*pwdEntry),
+		readsHistory: make(map[string]bool),
+	}
+}
+
+func (t *reversePwdTracker) resolve(session string) {
+	pending := t.pending[session]
+	s := newDirState()
+	for i := len(pending) - 1; i >= 0; i-- {
+		s.apply(pending[i].entry.Command)
+		pending[i].entry.Pwd = s.cwd
+		pending[i].done = true
+	}
+	delete(t.pending, session)
+	delete(t.readsHistory, session)
+}
+
+// ready returns the entries from the start of the queue that have their
+// working directory determined.
+func (t *reversePwdTracker) ready() []*Entry {
+	var ret []*Entry
+	i := 0
+	for ; i < len(t.queue) && t.queue[i].done; i++ {
+		ret = append(ret, t.queue[i].entry)
+	}
+	t.queue = t.queue[i:]
+	return ret
+}
+
+// Add queues the entry and returns the entries that are ready in order.
+func (t *reversePwdTracker) Add(e *Entry) []*Entry {
+	pe := &pwdEntry{entry: e}
+	t.queue = append(t.queue, pe)
+	t.pending[e.Session] = append(t.pending[e.Session], pe)
+
+	_, start := sessionStart(e.Command)
+	switch {
+	case start:
+		t.resolve(e.Session)
+	case resetsDirectory(e.Command) && !t.readsHistory[e.Session]:
+		t.resolve(e.Session)
+	case readsDirHistory(e.Command):
+		t.readsHistory[e.Session] = true
+	}
+	return t.ready()
+}
+
+// Finish resolves all waiting entries as if their sessions had started in
+// the home directory and returns them in order.
+func (t *reversePwdTracker) Finish() []*Entry {
+	for session := range t.pending {
+		t.resolve(session)
+	}
+	return t.ready()
+}
@@ -0,0 +1,349 @@
+package cmdlib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_determineDirectory(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		cmd      string
+		want     string
+	}{
+		{"Home", "/something", "cd", homeDir},
+		{"Go to subdir", "/something", "cd jeejee", "/something/jeejee"},
+		{"Go to absdir", "/something", "cd /abs", "/abs"},
+		{"Go up", "/something", "s", "/"},
+		{"Go up 2", "/something", "cd ..", "/"},
+		{"Start session", "/", "Started shell session: /here", "/here"},
+		{"Start session without directory", "/something", "Started shell session", homeDir},
+		{"Normal command", "/something", "ls", "/something"},
+		{"Command starting with cd", "/something", "cdfoo bar", "/something"},
+		{"Quoted", "/something", `cd "My Dir"`, "/something/My Dir"},
+		{"Single quoted", "/something", `cd 'My Dir'/sub`, "/something/My Dir/sub"},
+		{"Escaped space", "/something", `cd My\ Dir`, "/something/My Dir"},
+		{"Tilde", "/something", "cd ~/src", homeDir + "/src"},
+		{"Quoted tilde", "/something", `cd "~"`, "/something/~"},
+		{"Home variable", "/something", `cd "$HOME/src"`, homeDir + "/src"},
+		{"Other variable", "/something", `cd $OTHER`, "/something/$OTHER"},
+		{"Chain with semicolon", "/something", "cd ..; make", "/"},
+		{"Chain with and", "/something", "cd sub && make && cd other", "/something/sub/other"},
+		{"Or is not run", "/something", "make || cd other", "/something"},
+		{"Or after and", "/something", "cd a || cd b && cd c", "/something/a/c"},
+		{"Subshell", "/something", "(cd sub; make)", "/something"},
+		{"Subshell and cd", "/something", "(cd sub; make) && cd other", "/something/other"},
+		{"Pipeline", "/something", "cd sub | cat", "/something"},
+		{"Background", "/something", "cd sub &", "/something"},
+		{"Comment", "/something", "cd sub # cd other", "/something/sub"},
+		{"Options", "/something", "cd -P -- sub", "/something/sub"},
+		{"Builtin", "/something", "builtin cd sub", "/something/sub"},
+		{"Redirection", "/something", "cd sub 2>/dev/null", "/something/sub"},
+		{"Substitution", "/a/one/b", "cd one two", "/a/two/b"},
+		{"Multiple lines", "/something", "cd a\ncd b", "/something/a/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := determineDirectory(tt.previous, tt.cmd); got != tt.want {
+				t.Errorf("determineDirectory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dirState(t *testing.T) {
+	cdPathDir, err := ioutil.TempDir("", "cmdlog-cdpath")
+	if err != nil {
+		t.Fatal("Could not create temporary directory:", err)
+	}
+	defer os.RemoveAll(cdPathDir)
+	err = os.Mkdir(filepath.Join(cdPathDir, "project"), 0755)
+	if err != nil {
+		t.Fatal("Could not create directory:", err)
+	}
+
+	tests := []struct {
+		name   string
+		cdpath string
+		cmds   []string
+		cwd    string
+		stack  []string
+	}{
+		{"Cd minus", "", []string{"cd /a", "cd /b", "cd -"}, "/a", nil},
+		{"Cd minus twice", "", []string{"cd /a", "cd /b", "cd -", "cd -"}, "/b", nil},
+		{"Cd minus without previous", "", []string{"cd -"}, homeDir, nil},
+		{"Pushd", "", []string{"cd /a", "pushd /b", "pushd c"}, "/b/c",
+			[]string{"/b", "/a"}},
+		{"Pushd and popd", "", []string{"cd /a", "pushd /b", "pushd /c", "popd"}, "/b",
+			[]string{"/a"}},
+		{"Popd empty stack", "", []string{"cd /a", "popd"}, "/a", nil},
+		{"Pushd swap", "", []string{"cd /a", "pushd /b", "pushd"}, "/a",
+			[]string{"/b"}},
+		{"Pushd rotate", "", []string{"cd /a", "pushd /b", "pushd /c", "pushd +2"}, "/a",
+			[]string{"/c", "/b"}},
+		{"Pushd rotate from right", "", []string{"cd /a", "pushd /b", "pushd /c", "pushd -0"}, "/a",
+			[]string{"/c", "/b"}},
+		{"Popd index", "", []string{"cd /a", "pushd /b", "pushd /c", "popd +1"}, "/c",
+			[]string{"/a"}},
+		{"Dirs clear", "", []string{"cd /a", "pushd /b", "dirs -c"}, "/b", []string{}},
+		{"Session start resets", "", []string{"cd /a", "pushd /b",
+			"Started shell session: /c", "cd -"}, "/c", nil},
+		{"Cdpath", cdPathDir, []string{"cd /a", "cd project"},
+			filepath.Join(cdPathDir, "project"), nil},
+		{"Cdpath not found", cdPathDir, []string{"cd /a", "cd other"}, "/a/other", nil},
+		{"Cdpath not used for dot", cdPathDir, []string{"cd /a", "cd ./project"},
+			"/a/project", nil},
+		{"Cdpath with current directory", ":" + cdPathDir, []string{"cd /a", "cd project"},
+			"/a/project", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origCdPath := cdPath
+			cdPath = tt.cdpath
+			defer func() { cdPath = origCdPath }()
+
+			s := newDirState()
+			for _, cmd := range tt.cmds {
+				s.apply(cmd)
+			}
+			compare(t, "Directory differs", tt.cwd, s.cwd)
+			compare(t, "Stack differs", strings.Join(tt.stack, ":"),
+				strings.Join(s.stack, ":"))
+		})
+	}
+}
+
+func Test_expandTilde(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"~", homeDir},
+		{"~/src", homeDir + "/src"},
+		{"~cmdlog-nonexistent-user/src",
+			filepath.Join(filepath.Dir(homeDir), "cmdlog-nonexistent-user") + "/src"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			compare(t, "Expanded path differs", tt.want, expandTilde(tt.path))
+		})
+	}
+}
+
+func Test_resetsDirectory(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		resets bool
+		reads  bool
+	}{
+		{"ls", false, false},
+		{"cd", true, false},
+		{"cd /abs", true, false},
+		{"cd rel", false, false},
+		{"cd -", false, true},
+		{"cd /abs; cd -", false, true},
+		{"pushd /abs", true, true},
+		{"popd", false, true},
+		{"Started shell session: /abs", true, false},
+		{"Started shell session", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			compare(t, "Resetting differs", tt.resets, resetsDirectory(tt.cmd))
+			compare(t, "Reading history differs", tt.reads, readsDirHistory(tt.cmd))
+		})
+	}
+}
+
+var pwdTestData = `1	s1	Started shell session: /work
+2	s2	cd /tmp
+3	s1	cd project
+4	s2	ls
+5	s1	make
+6	s3	cd sub
+7	s1	s
+8	s2	cd /
+9	s1	cd /other
+10	s3	ls
+11	s2	pushd /var
+12	s1	cd -
+13	s2	cd log
+14	s2	popd
+`
+
+func TestPwdTrackers(t *testing.T) {
+	lines := strings.SplitAfter(strings.TrimSuffix(pwdTestData, "\n"), "\n")
+	entries := func() []*Entry {
+		ret := []*Entry{}
+		for _, line := range lines {
+			e := &Entry{}
+			if !ParseEntryLine(line, "", 0, nil, e) {
+				t.Fatal("Could not parse line:", line)
+			}
+			ret = append(ret, e)
+		}
+		return ret
+	}
+	pwds := func(entries []*Entry) string {
+		ret := []string{}
+		for _, e := range entries {
+			ret = append(ret, e.Command+": "+e.Pwd)
+		}
+		return strings.Join(ret, "\n")
+	}
+
+	expected := []string{
+		"Started shell session: /work: /work",
+		"cd /tmp: /tmp",
+		"cd project: /work/project",
+		"ls: /tmp",
+		"make: /work/project",
+		"cd sub: " + homeDir + "/sub",
+		"s: /work",
+		"cd /: /",
+		"cd /other: /other",
+		"ls: " + homeDir + "/sub",
+		"pushd /var: /var",
+		"cd -: /work",
+		"cd log: /var/log",
+		"popd: /",
+	}
+
+	forward := newPwdTracker()
+	got := []*Entry{}
+	for _, e := range entries() {
+		ready := forward.Add(e)
+		compare(t, "Forward tracking should be immediate", 1, len(ready))
+		got = append(got, ready...)
+	}
+	got = append(got, forward.Finish()...)
+	compare(t, "Forward directories differ", strings.Join(expected, "\n"), pwds(got))
+
+	reverse := newReversePwdTracker()
+	got = []*Entry{}
+	in := entries()
+	for i := len(in) - 1; i >= 0; i-- {
+		got = append(got, reverse.Add(in[i])...)
+	}
+	got = append(got, reverse.Finish()...)
+
+	reversed := []string{}
+	for i := len(expected) - 1; i >= 0; i-- {
+		reversed = append(reversed, expected[i])
+	}
+	compare(t, "Reverse directories differ", strings.Join(reversed, "\n"), pwds(got))
+}
+
+func TestReversePwdTrackerSessionStart(t *testing.T) {
+	// The session start line of the example zshrc before it logged the
+	// directory
+	lines := []string{
+		"1\ts1\tStarted shell session\n",
+		"2\ts1\tcd src\n",
+		"3\ts1\tmake\n",
+	}
+
+	reverse := newReversePwdTracker()
+	got := []*Entry{}
+	for i := len(lines) - 1; i >= 0; i-- {
+		e := &Entry{}
+		if !ParseEntryLine(lines[i], "", 0, nil, e) {
+			t.Fatal("Could not parse line:", lines[i])
+		}
+		got = append(got, reverse.Add(e)...)
+	}
+	compare(t, "All entries should be ready at the session start", 3, len(got))
+	compare(t, "Nothing should wait for Finish", 0, len(reverse.Finish()))
+	compare(t, "Directory differs", homeDir+"/src", got[0].Pwd)
+}
+
+func TestParseCmdLogPwdReverse(t *testing.T) {
+	arg := ParseArgs{Pwd: true, Control: controlArgs{Now: time.Unix(1000, 0)}}
+
+	forward := &bytes.Buffer{}
+	arg.Output = forward
+	err := ParseCmdLog(&testLineReader{buf: bytes.NewBufferString(pwdTestData)}, arg)
+	if err != nil {
+		t.Fatal("ParseCmdLog failed:", err)
+	}
+
+	r, err := NewReverseReader(strings.NewReader(pwdTestData), 1024)
+	if err != nil {
+		t.Fatal("Creating reverse reader failed:", err)
+	}
+	reverse := &bytes.Buffer{}
+	arg.Output = reverse
+	arg.Reverse = true
+	err = ParseCmdLog(r, arg)
+	if err != nil {
+		t.Fatal("ParseCmdLog failed:", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(reverse.String(), "\n"), "\n")
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	compare(t, "Reverse output differs", forward.String(), strings.Join(lines, "\n")+"\n")
+}
+
+func TestParseCmdLogDir(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    ParseArgs
+		output string
+	}{
+		{"Directory", ParseArgs{Dir: "/work"}, "Started shell session: /work\ns\ncd -\n"},
+		{"Recursive", ParseArgs{Dir: "/work", DirRecursive: true},
+			"Started shell session: /work\ncd project\nmake\ns\ncd -\n"},
+		{"Trailing slash", ParseArgs{Dir: "/work/", DirRecursive: true},
+			"Started shell session: /work\ncd project\nmake\ns\ncd -\n"},
+		{"Root", ParseArgs{Dir: "/", DirRecursive: true, Session: "s2"},
+			"cd /tmp\nls\ncd /\npushd /var\ncd log\npopd\n"},
+		{"Grep", ParseArgs{Dir: "/work/project", Grep: "make"}, "make\n"},
+		{"Since", ParseArgs{Dir: "/var", Since: time.Unix(12, 0).Format(timeFormat)}, ""},
+	}
+	for _, tt := range tests {
+		for _, reverse := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s reverse %v", tt.name, reverse), func(t *testing.T) {
+				arg := tt.arg
+				arg.Reverse = reverse
+				arg.Control = controlArgs{Now: time.Unix(1000, 0)}
+				buf := &bytes.Buffer{}
+				arg.Output = buf
+
+				var r LineReader = &testLineReader{buf: bytes.NewBufferString(pwdTestData)}
+				if reverse {
+					var err error
+					r, err = NewReverseReader(strings.NewReader(pwdTestData), 1024)
+					if err != nil {
+						t.Fatal("Creating reverse reader failed:", err)
+					}
+				}
+				err := ParseCmdLog(r, arg)
+				if err != nil {
+					t.Fatal("ParseCmdLog failed:", err)
+				}
+
+				got := []string{}
+				for _, line := range strings.SplitAfter(buf.String(), "\n") {
+					if i := strings.LastIndex(line, "\t"); i >= 0 {
+						got = append(got, line[i+1:])
+					}
+				}
+				if reverse {
+					for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+						got[i], got[j] = got[j], got[i]
+					}
+				}
+				compare(t, "Output differs", tt.output, strings.Join(got, ""))
+			})
+		}
+	}
+}
@@ -2,6 +2,7 @@ package cmdlib
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 )
 
@@ -20,3 +21,25 @@ func NewBufferedReader(f io.Reader, maximumLineLength int) (ret *BufferedReader)
 func (f *BufferedReader) ReadLine() (string, error) {
 	return f.reader.ReadString('\n')
 }
+
+// completeLinesEnd returns the end of the last complete line of r between
+// start and size, or start if there is no complete line
+func completeLinesEnd(r io.ReaderAt, start, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for end := size; end > start; {
+		pos := end - int64(len(buf))
+		if pos < start {
+			pos = start
+		}
+		data := buf[:end-pos]
+		_, err := r.ReadAt(data, pos)
+		if err != nil && err != io.EOF {
+			return start, err
+		}
+		if idx := bytes.LastIndexByte(data, '\n'); idx >= 0 {
+			return pos + int64(idx) + 1, nil
+		}
+		end = pos
+	}
+	return start, nil
+}
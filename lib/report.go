@@ -1,13 +1,13 @@
 package cmdlib
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,8 +21,40 @@ const (
 var (
 	homeDir    = os.Getenv("HOME")
 	timeFormat = "2006-01-02T15:04:05"
+
+	// Format of the displayed times that are not relative
+	displayTimeFormat = timeFormat
+
+	// Times more recent than this are displayed relative to the current
+	// time
+	relativeTimeLimit = day * 7
 )
 
+// SetTimeDisplay sets the format of the displayed times and the limit under
+// which times are displayed relative to the current time. An empty format or
+// a negative limit keeps the current value.
+func SetTimeDisplay(format string, relativeLimit time.Duration) {
+	if format != "" {
+		displayTimeFormat = format
+	}
+	if relativeLimit >= 0 {
+		relativeTimeLimit = relativeLimit
+	}
+}
+
+// ParseDuration parses a duration such as "7d" or a duration accepted by
+// time.ParseDuration.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration: \"%s\"", s)
+		}
+		return day * time.Duration(days), nil
+	}
+	return time.ParseDuration(s)
+}
+
 var magnitudes = []struct {
 	mag time.Duration
 	// If the given magnitude is above this, do not continue listing
@@ -36,14 +68,11 @@ var magnitudes = []struct {
 	{time.Second, 60, "s"},
 }
 
-// FormatRelativeTime converts a duration to a string according to magnitudes above
-func FormatRelativeTime(diff time.Duration) string {
+// FormatDuration converts a duration to a string according to magnitudes
+// above
+func FormatDuration(diff time.Duration) string {
 	var ret string
 
-	if diff.Seconds() < 1.0 {
-		return "Just now"
-	}
-
 	for _, mag := range magnitudes {
 		count := diff / mag.mag
 		diff %= mag.mag
@@ -55,7 +84,19 @@ func FormatRelativeTime(diff time.Duration) string {
 		}
 	}
 
-	return ret + "ago"
+	if ret == "" {
+		return "0s"
+	}
+	return strings.TrimSuffix(ret, " ")
+}
+
+// FormatRelativeTime converts a duration to a string according to magnitudes above
+func FormatRelativeTime(diff time.Duration) string {
+	if diff.Seconds() < 1.0 {
+		return "Just now"
+	}
+
+	return FormatDuration(diff) + " ago"
 }
 
 // FormatTime formats the given timestring (UNIX time) to human readable string
@@ -63,69 +104,120 @@ func FormatTime(timeint int64, now time.Time) string {
 	tm := time.Unix(timeint, 0)
 	diff := now.Sub(tm)
 
-	if diff.Hours() < 24.0*7 {
+	if diff < relativeTimeLimit {
 		return FormatRelativeTime(diff)
 	}
 
-	return tm.Format(timeFormat)
+	return tm.Format(displayTimeFormat)
 }
 
-// ParseCmdLogLineNoAlloc prepares a single line without unnecessary allocation.
-func ParseCmdLogLineNoAlloc(line string, session string, since int64, now time.Time, regex *regexp.Regexp,
-	out *[]string) {
-	var pos [2]int
+// ParseTime parses the given time string in the report time format, or in
+// the format of the displayed times, to UNIX time.
+func ParseTime(timestr string) (int64, error) {
+	tm, err := time.ParseInLocation(timeFormat, timestr, time.Local)
+	if err != nil && displayTimeFormat != timeFormat {
+		var err2 error
+		tm, err2 = time.ParseInLocation(displayTimeFormat, timestr, time.Local)
+		if err2 == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tm.Unix(), nil
+}
+
+// logFieldPositions returns the start positions of the session and command
+// fields of a log line. The ok is false if the format of the line is
+// improper.
+func logFieldPositions(line string) (pos [2]int, ok bool) {
 	start := 0
 	for i := range pos {
 		relpos := strings.Index(line[start:], "\t")
 
 		// The format of the line is improper
 		if relpos < 0 {
-			return
+			return pos, false
 		}
 
 		pos[i] = relpos + start + 1
 		start = pos[i] + 1
 	}
+	return pos, true
+}
+
+// ParseEntryLine parses a single log line to the given entry without
+// unnecessary allocation. Returns false if the line is malformed or it is
+// filtered out by the session, since or regex arguments.
+func ParseEntryLine(line string, session string, since int64, regex *regexp.Regexp,
+	out *Entry) bool {
+	pos, ok := logFieldPositions(line)
+	if !ok {
+		return false
+	}
 
 	// If session filtering is used and session does not match
 	if session != "" && session != line[pos[0]:pos[1]-1] {
-		return
+		return false
 	}
 
+	cmd := decodeLogCommand(strings.TrimSuffix(line[pos[1]:], "\n"))
+
 	// If regex is given and it does not match
-	if regex != nil && !regex.MatchString(line[pos[1]:]) {
-		return
+	if regex != nil && !regex.MatchString(cmd) {
+		return false
 	}
 
 	timeint, err := strconv.ParseInt(line[:pos[0]-1], 10, 64)
 	switch {
 	case err != nil:
-		(*out)[0] = "<invalid>"
+		out.Time = time.Time{}
 	case timeint < since:
-		return
+		return false
 	default:
-		(*out)[0] = FormatTime(timeint, now)
+		out.Time = time.Unix(timeint, 0)
+	}
+
+	out.Session = line[pos[0] : pos[1]-1]
+	out.Command = cmd
+	return true
+}
+
+// ParseCmdLogLineNoAlloc prepares a single line without unnecessary allocation.
+//
+// Deprecated: Use ParseEntryLine or ScanCmdLog instead.
+func ParseCmdLogLineNoAlloc(line string, session string, since int64, now time.Time, regex *regexp.Regexp,
+	out *[]string) {
+	e := Entry{}
+	if !ParseEntryLine(line, session, since, regex, &e) {
+		return
 	}
 
-	(*out)[1] = line[pos[0] : pos[1]-1]
-	(*out)[2] = line[pos[1]:]
+	(*out)[0] = "<invalid>"
+	if e.HasValidTime() {
+		(*out)[0] = FormatTime(e.Time.Unix(), now)
+	}
+	(*out)[1] = e.Session
+	(*out)[2] = e.Command
 }
 
 type controlArgs struct {
-	JobCount             int
-	Now                  time.Time
-	BufferLineCount      int
-	CompletionBufferSize int
-	ReportLen            int
+	JobCount        int
+	Now             time.Time
+	BufferLineCount int
+
+	// The number of lines read from a LineReader that are parsed
+	// together
+	ChunkLines int
 }
 
 func defaultControlArgs() controlArgs {
 	return controlArgs{
-		JobCount:             runtime.NumCPU(),
-		Now:                  time.Now(),
-		BufferLineCount:      24,
-		CompletionBufferSize: 1024,
-		ReportLen:            1024 * 128,
+		JobCount:        runtime.NumCPU(),
+		Now:             time.Now(),
+		BufferLineCount: 24,
+		ChunkLines:      512,
 	}
 }
 
@@ -140,11 +232,8 @@ func (ca *controlArgs) FillDefault() {
 	if ca.BufferLineCount == 0 {
 		ca.BufferLineCount = def.BufferLineCount
 	}
-	if ca.CompletionBufferSize == 0 {
-		ca.CompletionBufferSize = def.CompletionBufferSize
-	}
-	if ca.ReportLen == 0 {
-		ca.ReportLen = def.ReportLen
+	if ca.ChunkLines == 0 {
+		ca.ChunkLines = def.ChunkLines
 	}
 }
 
@@ -154,217 +243,461 @@ type ParseArgs struct {
 	Since   string
 	Grep    string
 	Pwd     bool
+
+	// The reader returns the log in reverse order
+	Reverse bool
+
+	// Display only entries with this tag
+	Tag string
+
+	// Display only entries that run this program, see RunsProgram
+	Program string
+
+	// Display the tags and notes of the entries
+	Notes bool
+
+	// Display the IDs of the entries
+	IDs bool
+
+	// Display the commands as they were typed. By default the newlines
+	// and tabs of the commands are escaped so that each entry is a single
+	// line.
+	Multiline bool
+
+	// Display at most Limit entries after skipping the first Offset
+	// entries. Reading of the log is stopped once the limit is reached.
+	// Zero Limit displays all entries.
+	Limit  int
+	Offset int
+
+	// Display only entries run in this directory, or also in its
+	// subdirectories if DirRecursive is set. The working directories are
+	// tracked as with Pwd.
+	Dir          string
+	DirRecursive bool
+
+	// Display this many entries of the same session before and after each
+	// entry matching Grep. The before entries are the earlier ones also in
+	// reverse order.
+	Before int
+	After  int
+
+	// The reader follows the log as it grows, see FollowReader. Only the
+	// entries logged after Control.Now are displayed, but the earlier ones
+	// are still read for tracking the working directories. Each displayed
+	// entry is written out immediately.
+	Follow bool
+
+	// Annotate the entries with tags and notes from their comments and
+	// this store. Entries are annotated if this is set or Tag or Notes are
+	// given.
+	Tags     *TagStore
+	Annotate bool
+
+	// Select the entries by their stars in this store. The Starred field
+	// of the entries is set if the store is given.
+	Stars   *StarStore
+	Starred StarFilter
+
 	Control controlArgs
 	Output  io.Writer
 }
 
-// ParseCmdLog Parses and prints out the command log from given
-// reader. Possibly filter by session.
-func ParseCmdLog(reader LineReader, arg ParseArgs) (err error) {
+// CompileGrep compiles the grep argument of the report. Whitespace in the
+// argument matches anything, also the newlines of multi-line commands.
+// Returns nil if grep is empty.
+func CompileGrep(grep string) (*regexp.Regexp, error) {
+	if grep == "" {
+		return nil, nil
+	}
+	grep = regexp.MustCompile(`\s+`).ReplaceAllString(grep, "(?s:.*)")
+	re, err := regexp.Compile(grep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regexp \"%s\": %s", grep, err)
+	}
+	return re, nil
+}
+
+// ScanCmdLog parses the command log from given reader and calls fn for each
+// entry that matches the arguments in the order they were read. The Output
+// of the arguments is not used. If fn returns an error, scanning is stopped
+// and the error is returned.
+func ScanCmdLog(reader LineReader, arg ParseArgs, fn func(e *Entry) error) (err error) {
 	arg.Control.FillDefault()
 
-	var filterRe *regexp.Regexp
-	if arg.Grep != "" {
-		filterRe = regexp.MustCompile(`\s+`)
-		arg.Grep = filterRe.ReplaceAllString(arg.Grep, ".*")
-		filterRe, err = regexp.Compile(arg.Grep)
-		if err != nil {
-			return fmt.Errorf("failed to compile regexp \"%s\": %s", arg.Grep, err)
-		}
+	filterRe, err := CompileGrep(arg.Grep)
+	if err != nil {
+		return err
 	}
 
 	var since int64
 	if arg.Since != "" {
-		sincetm, err := time.ParseInLocation(timeFormat, arg.Since, time.Local)
+		since, err = ParseTime(arg.Since)
 		if err != nil {
 			return fmt.Errorf("parsing given since failed: %s", err)
 		}
-		since = sincetm.Unix()
 	}
 
-	out := NewBufferedWriter(arg.Output, arg.Control.BufferLineCount)
+	annotate := arg.Tags != nil || arg.Tag != "" || arg.Notes
 
-	// The format for the report structure:
-	// for each element: timestring, session, command, [cwd]
-	// If the strings in the element are empty, it has been filtered out
-	// Tried to make this a [][4]string, but that was half the speed that
-	// this currently is.
-	report := make([][]string, arg.Control.ReportLen)
-	index := 0
-	reportLock := sync.RWMutex{}
+	// When tracking the working directories, the filtered entries are
+	// still passed to the tracker as hidden entries
+	tracking := arg.Pwd || arg.Dir != ""
+	parseSince, parseRe := since, filterRe
+	if tracking {
+		parseSince, parseRe = 0, nil
+	}
 
-	type reportLine struct {
-		line  string
-		index int
+	// Closing stop ends the reading of the log and the parsing of the
+	// remaining chunks
+	stop := make(chan struct{})
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
 	}
-	jobs := make(chan reportLine, arg.Control.JobCount)
-	completions := make(chan int, arg.Control.JobCount)
 
-	wg := sync.WaitGroup{}
+	// Parses a line to an entry. Returns nil if the entry is filtered out.
+	parseEntry := func(line string) *Entry {
+		e := &Entry{}
+		if !ParseEntryLine(line, arg.Session, parseSince, parseRe, e) {
+			return nil
+		}
+		filtered := false
+		if tracking {
+			filtered = (e.HasValidTime() && e.Time.Unix() < since) ||
+				(filterRe != nil && !filterRe.MatchString(e.Command))
+		}
+		if !filtered && arg.Program != "" {
+			filtered = !RunsProgram(e.Command, arg.Program)
+		}
+		if !filtered && annotate {
+			arg.Tags.Annotate(e)
+			filtered = arg.Tag != "" && !e.HasTag(arg.Tag)
+		}
+		if !filtered && arg.Stars != nil {
+			e.Starred = arg.Stars.IsStarred(e.ID())
+			filtered = (arg.Starred == StarredOnly && !e.Starred) ||
+				(arg.Starred == UnstarredOnly && e.Starred)
+		}
+		if filtered {
+			if !tracking {
+				return nil
+			}
+			e.hidden = true
+		}
+		return e
+	}
 
-	// Parses the report line strings to the report array
-	worker := func(jobs <-chan reportLine, completions chan<- int) {
-		for rl := range jobs {
-			reportLock.RLock()
-			report[rl.index] = make([]string, 4)
-			ParseCmdLogLineNoAlloc(rl.line, arg.Session,
-				since, arg.Control.Now, filterRe, &report[rl.index])
-			reportLock.RUnlock()
-			completions <- rl.index
+	// The working directories are tracked per session as the entries are
+	// handled in order
+	var pwds interface {
+		Add(e *Entry) []*Entry
+		Finish() []*Entry
+	}
+	if tracking {
+		if arg.Reverse {
+			pwds = newReversePwdTracker()
+		} else {
+			pwds = newPwdTracker()
 		}
-		wg.Done()
 	}
 
-	for i := 0; i < arg.Control.JobCount*2; i++ {
-		wg.Add(1)
-		go worker(jobs, completions)
-	}
-
-	// Print a single report line
-	printLine := func(pos int) {
-		reportLock.RLock()
-		if len(report[pos]) == 4 && report[pos][0] != "" {
-			// A stringbuilder was tried here, but that allocated
-			// 3MB more memory
-			line := ""
-			if arg.Session == "" {
-				line = report[pos][1] + " "
+	dir := filepath.Clean(arg.Dir)
+	inDir := func(pwd string) bool {
+		if pwd == dir {
+			return true
+		}
+		return arg.DirRecursive &&
+			strings.HasPrefix(pwd, strings.TrimSuffix(dir, "/")+"/")
+	}
+
+	// The error from fn. Stops the scanning.
+	var fnErr error
+
+	// Pass entries to fn
+	callFn := func(entries ...*Entry) {
+		for _, e := range entries {
+			if fnErr != nil {
+				return
+			}
+			if e.hidden || (arg.Dir != "" && !inDir(e.Pwd)) {
+				continue
 			}
-			line += report[pos][0]
-			if arg.Pwd {
-				line = line + "\t" + report[pos][3]
+			fnErr = fn(e)
+			if fnErr != nil {
+				close(stop)
 			}
-			line = line + "\t" + report[pos][2]
-			_, _ = out.Write([]byte(line))
 		}
-		reportLock.RUnlock()
 	}
 
-	printWg := sync.WaitGroup{}
+	// Handle a parsed entry. Called for the entries in order.
+	handleEntry := func(e *Entry) {
+		if fnErr != nil {
+			return
+		}
+		if pwds != nil {
+			callFn(pwds.Add(e)...)
+		} else {
+			callFn(e)
+		}
+	}
 
-	// Print the whole report as it gets parsed
-	printer := func(completions <-chan int) {
-		complete := make([]int, 0, arg.Control.CompletionBufferSize)
-		firstNotPrinted := 0
+	err = scanLog(reader, &arg.Control, parseEntry, handleEntry, stopped)
+	if err != nil {
+		return err
+	}
 
-		for idx := range completions {
-			complete = append(complete, idx)
-			sort.Ints(complete)
+	if pwds != nil {
+		callFn(pwds.Finish()...)
+	}
 
-			var limit = firstNotPrinted
-			var next = len(complete)
+	return fnErr
+}
 
-			// Get the number of sequential items that can be printed
-			for i := range complete {
-				if limit != complete[i] {
-					next = i
-					break
-				}
-				limit++
-			}
+// scanLog reads the log, parses the lines with parseEntry and calls
+// handleEntry for the entries in order. The benchmarks replace it with the
+// earlier ways of scanning the log.
+var scanLog = scanChunks
+
+// scanChunks reads the log in chunks of lines. Each chunk is parsed by a
+// single worker, and the entries are handled in order chunk by chunk.
+func scanChunks(reader LineReader, control *controlArgs,
+	parseEntry func(line string) *Entry, handleEntry func(e *Entry),
+	stopped func() bool) (err error) {
+
+	// The entries of the chunk are sent to result in the order they are
+	// displayed
+	type chunk struct {
+		lines  []string
+		result chan []*Entry
+	}
 
-			if limit != firstNotPrinted {
-				for i := firstNotPrinted; i < limit; i++ {
-					printLine(i)
-				}
+	jobs := make(chan *chunk, control.JobCount)
+
+	// The chunks in the order they were read
+	pending := make(chan *chunk, control.JobCount*2)
 
-				complete = complete[next:]
-				firstNotPrinted = limit
+	wg := sync.WaitGroup{}
+	worker := func() {
+		for c := range jobs {
+			entries := []*Entry{}
+			if !stopped() {
+				for _, line := range c.lines {
+					if e := parseEntry(line); e != nil {
+						entries = append(entries, e)
+					}
+				}
 			}
+			c.result <- entries
 		}
-		printWg.Done()
+		wg.Done()
+	}
+	for i := 0; i < control.JobCount; i++ {
+		wg.Add(1)
+		go worker()
 	}
 
-	// If PWD printing is enabled, it needs to be done after parsing
+	// Handle the entries of the chunks in order as they get parsed
+	printWg := sync.WaitGroup{}
 	printWg.Add(1)
-	if arg.Pwd {
-		// Drain the channel
-		go func(completions <-chan int) {
-			for range completions {
+	go func() {
+		for c := range pending {
+			for _, e := range <-c.result {
+				handleEntry(e)
 			}
-			printWg.Done()
-		}(completions)
-	} else {
-		go printer(completions)
-	}
+		}
+		printWg.Done()
+	}()
 
-	// Read lines from the log
-	for {
-		line, err := reader.ReadLine()
+	send := func(c *chunk) {
+		c.result = make(chan []*Entry, 1)
+		pending <- c
+		jobs <- c
+	}
 
-		if err == io.EOF {
+	lines := []string{}
+	for !stopped() {
+		line, rerr := reader.ReadLine()
+		if rerr == io.EOF {
 			break
 		}
-		if err != nil {
-			return fmt.Errorf("error reading log: %v", err)
+		if rerr != nil {
+			err = fmt.Errorf("error reading log: %v", rerr)
+			break
 		}
-		if index >= cap(report)-1 {
-			reportLock.Lock()
-
-			// Allocate to capacity
-			report = append(report, []string{})
-			report = append(report, make([][]string, cap(report)-len(report))...)
-			reportLock.Unlock()
+		lines = append(lines, line)
+		if len(lines) >= control.ChunkLines {
+			send(&chunk{lines: lines})
+			lines = []string{}
 		}
-		jobs <- reportLine{line, index}
-		index++
+	}
+	if len(lines) > 0 && err == nil {
+		send(&chunk{lines: lines})
 	}
 	close(jobs)
+	close(pending)
 	wg.Wait()
-	close(completions)
 	printWg.Wait()
 
-	if arg.Pwd {
-		AddPwdsToReport(&report)
-		for idx := range report {
-			printLine(idx)
-		}
+	return err
+}
+
+// FormatEntry formats the entry to a report line
+func FormatEntry(e *Entry, arg *ParseArgs) string {
+	timestr := "<invalid>"
+	if e.HasValidTime() {
+		timestr = FormatTime(e.Time.Unix(), arg.Control.Now)
 	}
 
-	return out.Close()
+	// A stringbuilder was tried here, but that allocated 3MB more
+	// memory
+	line := ""
+	if arg.Session == "" {
+		line = e.Session + " "
+	}
+	line += timestr
+	if arg.IDs {
+		line = line + "\t" + e.ID()
+	}
+	if arg.Pwd {
+		line = line + "\t" + e.Pwd
+	}
+	if arg.Notes {
+		line = line + "\t" + FormatAnnotation(e)
+	}
+	if arg.Multiline {
+		return line + "\t" + e.Command + "\n"
+	}
+	return line + "\t" + EscapeCommand(e.Command) + "\n"
 }
 
-// Heuristic to determine the current directory
-func determineDirectory(previous string, cmd string) string {
-	ret := ""
+var errLimitReached = errors.New("limit reached")
 
-	switch {
-	case cmd == "s":
-		ret = ".."
-	case strings.HasPrefix(cmd, "cd"):
-		parts := strings.SplitN(cmd, " ", 2)
-		if len(parts) == 1 {
-			ret = homeDir
-		} else {
-			ret = parts[1]
+// printCmdLog prints the entries of the log to out. The count is the number
+// of entries seen so far, including the ones skipped by the offset. Returns
+// errLimitReached if the limit of entries was printed.
+func printCmdLog(reader LineReader, arg *ParseArgs, out io.Writer, count *int) error {
+	start := arg.Control.Now.Truncate(time.Second)
+
+	// With context the matching is done after scanning, as the entries
+	// around the matches are needed
+	scanArg := *arg
+	var context *grepContext
+	if arg.Before > 0 || arg.After > 0 {
+		re, err := CompileGrep(arg.Grep)
+		if err != nil {
+			return err
+		}
+		if re != nil {
+			context = newGrepContext(re, arg.Before, arg.After, arg.Reverse)
+			scanArg.Grep = ""
 		}
-	case strings.HasPrefix(cmd, "Started shell session: "):
-		parts := strings.SplitN(cmd, " ", 4)
-		ret = parts[3]
 	}
 
-	if !filepath.IsAbs(ret) {
-		ret = filepath.Join(previous, ret)
+	printEntry := func(e *Entry, separator bool) error {
+		if arg.Follow {
+			if e.Time.Before(start) {
+				return nil
+			}
+			arg.Control.Now = time.Now()
+		}
+		*count++
+		if *count <= arg.Offset {
+			return nil
+		}
+		if separator && *count > arg.Offset+1 {
+			_, err := out.Write([]byte(contextSeparator))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := out.Write([]byte(FormatEntry(e, arg)))
+		if err != nil {
+			return err
+		}
+		if arg.Limit > 0 && *count >= arg.Offset+arg.Limit {
+			return errLimitReached
+		}
+		return nil
+	}
+
+	// A nil entry from the context is a separator between groups
+	printEntries := func(entries []*Entry) error {
+		separator := false
+		for _, e := range entries {
+			if e == nil {
+				separator = true
+				continue
+			}
+			err := printEntry(e, separator)
+			if err != nil {
+				return err
+			}
+			separator = false
+		}
+		return nil
 	}
 
-	return strings.TrimSpace(filepath.Clean(ret))
+	err := ScanCmdLog(reader, scanArg, func(e *Entry) error {
+		if context == nil {
+			return printEntry(e, false)
+		}
+		return printEntries(context.Add(e))
+	})
+	if err != nil || context == nil {
+		return err
+	}
+	return printEntries(context.Finish())
 }
 
-// AddPwdsToReport Add working directories to the report
-func AddPwdsToReport(report *[][]string) {
-	sessions := make(map[string][]*[]string)
+// ParseCmdLog Parses and prints out the command log from given
+// reader. Possibly filter by session.
+func ParseCmdLog(reader LineReader, arg ParseArgs) (err error) {
+	arg.Control.FillDefault()
 
-	for idx, item := range *report {
-		if item != nil && item[0] != "" {
-			sessions[item[1]] = append(sessions[item[1]], &(*report)[idx])
-		}
+	if arg.Follow {
+		arg.Control.BufferLineCount = 1
+		arg.Control.ChunkLines = 1
+	}
+	out := NewBufferedWriter(arg.Output, arg.Control.BufferLineCount)
+
+	count := 0
+	err = printCmdLog(reader, &arg, out, &count)
+	if err != nil && err != errLimitReached {
+		return err
 	}
 
-	for _, items := range sessions {
-		cwd := homeDir
-		for _, item := range items {
-			cwd = determineDirectory(cwd, (*item)[2])
-			(*item)[3] = cwd
+	return out.Close()
+}
+
+// ParseCmdLogStarredFirst prints out the starred entries of the command log
+// before the others. The log is read twice, so open is called for both
+// passes. The Starred of the arguments is not used.
+func ParseCmdLogStarredFirst(open func() (LineReader, error), arg ParseArgs) (err error) {
+	arg.Control.FillDefault()
+
+	out := NewBufferedWriter(arg.Output, arg.Control.BufferLineCount)
+
+	count := 0
+	for _, starred := range []StarFilter{StarredOnly, UnstarredOnly} {
+		var reader LineReader
+		reader, err = open()
+		if err != nil {
+			return err
+		}
+		arg.Starred = starred
+		err = printCmdLog(reader, &arg, out, &count)
+		if err == errLimitReached {
+			break
+		}
+		if err != nil {
+			return err
 		}
 	}
+
+	return out.Close()
 }
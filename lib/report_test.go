@@ -3,6 +3,7 @@ package cmdlib
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"regexp"
 	"strings"
@@ -21,14 +22,18 @@ func (l *testLineReader) ReadLine() (string, error) {
 	return l.buf.ReadString('\n')
 }
 
+// The values are dumped with the map keys sorted, so that maps compare the
+// same regardless of their iteration order
+var dumper = spew.ConfigState{Indent: " ", SortKeys: true}
+
 func structEquals(a, b interface{}) bool {
-	return spew.Sdump(a) == spew.Sdump(b)
+	return dumper.Sdump(a) == dumper.Sdump(b)
 }
 
 func diffStr(a, b interface{}) (ret string) {
 	diff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(spew.Sdump(a)),
-		B:        difflib.SplitLines(spew.Sdump(b)),
+		A:        difflib.SplitLines(dumper.Sdump(a)),
+		B:        difflib.SplitLines(dumper.Sdump(b)),
 		FromFile: "Expected",
 		ToFile:   "Received",
 		Context:  3,
@@ -69,6 +74,23 @@ func TestFormatRelativeTime(t *testing.T) {
 	}
 }
 
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		diff time.Duration
+		out  string
+	}{
+		{0, "0s"},
+		{time.Second * 90, "1m 30s"},
+		{time.Hour*2 + time.Minute*3, "2h 3m"},
+		{time.Hour * 24 * 3, "3d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.out, func(t *testing.T) {
+			compare(t, "Duration differs", tt.out, FormatDuration(tt.diff))
+		})
+	}
+}
+
 func TestParseCmdLog(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -179,6 +201,23 @@ func BenchmarkParseCmdLogLineNoAlloc_RegexpMatch(b *testing.B) {
 	}
 }
 
+func BenchmarkParseEntryLine(b *testing.B) {
+	out := Entry{}
+	for i := 0; i < b.N; i++ {
+		ParseEntryLine("1450120005	zsh-2755-20151214	go test",
+			"", 0, nil, &out)
+	}
+}
+
+func BenchmarkParseEntryLine_RegexpMatch(b *testing.B) {
+	out := Entry{}
+	re := regexp.MustCompile("go test")
+	for i := 0; i < b.N; i++ {
+		ParseEntryLine("1450120005	zsh-2755-20151214	go test",
+			"", 0, re, &out)
+	}
+}
+
 func BenchmarkFormatRelativeTime(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = FormatRelativeTime(time.Second * time.Duration(i))
@@ -210,26 +249,166 @@ func TestParseCmdLogLineNoAlloc(t *testing.T) {
 	}
 }
 
-func Test_determineDirectory(t *testing.T) {
+func TestParseEntryLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		session string
+		since   int64
+		regex   *regexp.Regexp
+		ok      bool
+		out     Entry
+	}{
+		{"Normal line", "1450120005	zsh-2755-20151214	go test\n", "", 0, nil,
+			true, Entry{Time: time.Unix(1450120005, 0), Session: "zsh-2755-20151214", Command: "go test"}},
+		{"Invalid time", "abc	zsh-2755-20151214	go test", "", 0, nil,
+			true, Entry{Session: "zsh-2755-20151214", Command: "go test"}},
+		{"Malformed line", "1450120005 zsh-2755-20151214 go test", "", 0, nil,
+			false, Entry{}},
+		{"Other session", "1450120005	zsh-2755-20151214	go test", "other", 0, nil,
+			false, Entry{}},
+		{"Too old", "1450120005	zsh-2755-20151214	go test", "", 1450120006, nil,
+			false, Entry{}},
+		{"Regexp mismatch", "1450120005	zsh-2755-20151214	go test", "", 0,
+			regexp.MustCompile("build"), false, Entry{}},
+		{"Escaped command", "1450120005	zsh-1		for a in b; do\\n\\tls\\ndone\n", "", 0,
+			regexp.MustCompile("(?s)do.*ls"), true,
+			Entry{Time: time.Unix(1450120005, 0), Session: "zsh-1",
+				Command: "for a in b; do\n\tls\ndone"}},
+		{"Unescaped command with escape sequences", "1450120005	zsh-1	printf 'a\\tb\\n\\\\'\n", "", 0,
+			nil, true,
+			Entry{Time: time.Unix(1450120005, 0), Session: "zsh-1",
+				Command: `printf 'a\tb\n\\'`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := Entry{}
+			ok := ParseEntryLine(tt.line, tt.session, tt.since, tt.regex, &out)
+			compare(t, "Return value differs", tt.ok, ok)
+			compare(t, "Entry differs", tt.out, out)
+		})
+	}
+}
+
+func TestScanCmdLog(t *testing.T) {
+	input := &testLineReader{buf: bytes.NewBufferString(testData)}
+	commands := []string{}
+	err := ScanCmdLog(input, ParseArgs{Session: "zsh-26914-20160504"},
+		func(e *Entry) error {
+			commands = append(commands, e.Command)
+			if len(commands) == 3 {
+				return io.EOF
+			}
+			return nil
+		})
+	if err != io.EOF {
+		t.Errorf("Expected the error from the callback, got: %v", err)
+	}
+	compare(t, "Commands differ", strings.Join([]string{
+		"gobu debug linux nocgo shrink trimpath race",
+		"ls -lh cmdlog",
+		"./cmdlog -version",
+	}, "\n"), strings.Join(commands, "\n"))
+}
+
+// countingLineReader counts the lines read from it
+type countingLineReader struct {
+	LineReader
+	count int
+}
+
+func (c *countingLineReader) ReadLine() (string, error) {
+	c.count++
+	return c.LineReader.ReadLine()
+}
+
+func TestParseCmdLogLimit(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, fmt.Sprintf("%d\ts%d\tcmd %d\n", 1000+i, i%2, i))
+	}
+	data := strings.Join(lines, "")
+
 	tests := []struct {
-		name     string
-		previous string
-		cmd      string
-		want     string
+		name    string
+		arg     ParseArgs
+		reverse bool
+		output  string
 	}{
-		{"Home", "/something", "cd", homeDir},
-		{"Go to subdir", "/something", "cd jeejee", "/something/jeejee"},
-		{"Go to absdir", "/something", "cd /abs", "/abs"},
-		{"Go up", "/something", "s", "/"},
-		{"Go up 2", "/something", "cd ..", "/"},
-		{"Start session", "/", "Started shell session: /here", "/here"},
-		{"Normal command", "/something", "ls", "/something"},
+		{"Limit", ParseArgs{Limit: 2}, false, "cmd 0\ncmd 1\n"},
+		{"Offset", ParseArgs{Limit: 2, Offset: 3}, false, "cmd 3\ncmd 4\n"},
+		{"Session", ParseArgs{Limit: 2, Offset: 1, Session: "s1"}, false, "cmd 3\ncmd 5\n"},
+		{"Reverse", ParseArgs{Limit: 3, Reverse: true}, true, "cmd 9999\ncmd 9998\ncmd 9997\n"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := determineDirectory(tt.previous, tt.cmd); got != tt.want {
-				t.Errorf("determineDirectory() = %v, want %v", got, tt.want)
+			var r LineReader = &testLineReader{buf: bytes.NewBufferString(data)}
+			if tt.reverse {
+				var err error
+				r, err = NewReverseReader(strings.NewReader(data), 1024)
+				if err != nil {
+					t.Fatal("Creating reverse reader failed:", err)
+				}
+			}
+			input := &countingLineReader{LineReader: r}
+
+			buf := &bytes.Buffer{}
+			tt.arg.Output = buf
+			err := ParseCmdLog(input, tt.arg)
+			if err != nil {
+				t.Fatal("ParseCmdLog failed:", err)
+			}
+
+			got := []string{}
+			for _, line := range strings.SplitAfter(buf.String(), "\n") {
+				if i := strings.LastIndex(line, "\t"); i >= 0 {
+					got = append(got, line[i+1:])
+				}
+			}
+			compare(t, "Output differs", tt.output, strings.Join(got, ""))
+			if input.count >= len(lines)/2 {
+				t.Error("Reading was not stopped early, lines read:", input.count)
 			}
 		})
 	}
 }
+
+func TestTimeDisplay(t *testing.T) {
+	defer SetTimeDisplay(timeFormat, 7*day)
+
+	now := time.Date(2021, 4, 8, 12, 0, 0, 0, time.Local)
+	compare(t, "Relative time differs", "2h ago",
+		FormatTime(now.Add(-2*time.Hour).Unix(), now))
+
+	SetTimeDisplay("2006/01/02 15:04", time.Hour)
+	compare(t, "Formatted time differs", "2021/04/08 10:00",
+		FormatTime(now.Add(-2*time.Hour).Unix(), now))
+	compare(t, "Relative time within limit differs", "30m ago",
+		FormatTime(now.Add(-30*time.Minute).Unix(), now))
+
+	tm, err := ParseTime("2021/04/08 10:00")
+	if err != nil {
+		t.Fatal("Parsing the display format failed:", err)
+	}
+	compare(t, "Parsed time differs", now.Add(-2*time.Hour).Unix(), tm)
+	tm, err = ParseTime("2021-04-08T10:00:00")
+	if err != nil {
+		t.Fatal("Parsing the report format failed:", err)
+	}
+	compare(t, "Parsed time differs", now.Add(-2*time.Hour).Unix(), tm)
+
+	for _, tt := range []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{"7d", 7 * day, false},
+		{"90m", 90 * time.Minute, false},
+		{"0", 0, false},
+		{"xd", 0, true},
+	} {
+		d, err := ParseDuration(tt.s)
+		compare(t, "Duration error of "+tt.s+" differs", tt.err, err != nil)
+		compare(t, "Duration of "+tt.s+" differs", tt.want, d)
+	}
+}
@@ -4,9 +4,64 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"strings"
+	"os"
 )
 
+// LongLinePolicy tells what ReverseReader does with lines longer than its
+// maximum line length
+type LongLinePolicy int
+
+const (
+	// LongLineError returns a *LineTooLongError. The next ReadLine
+	// continues from the line before the long one.
+	LongLineError LongLinePolicy = iota
+
+	// LongLineSkip skips the line
+	LongLineSkip
+
+	// LongLineTruncate returns the beginning of the line up to the
+	// maximum line length
+	LongLineTruncate
+)
+
+// LineTooLongError is returned for a line that is longer than the maximum
+// line length of the reader
+type LineTooLongError struct {
+	// Offset of the line in the file
+	Offset int64
+
+	// Length of the line without the newline
+	Length int64
+
+	// The maximum line length
+	Limit int
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("line at offset %d is %d bytes, longer than the maximum of %d bytes",
+		e.Offset, e.Length, e.Limit)
+}
+
+// ShortReadError is returned when the file ends before the data preceding
+// the read position, e.g. if the file is truncated while it is read
+type ShortReadError struct {
+	Offset int64
+	Want   int
+	Got    int
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("expected %d bytes at offset %d, but only %d could be read",
+		e.Want, e.Offset, e.Got)
+}
+
+// The initial size of the buffer of ReverseReader. The buffer grows up to
+// the maximum line length.
+const reverseBufferSize = 64 * 1024
+
+// errLineSkipped is returned by longLine when the line is skipped
+var errLineSkipped = fmt.Errorf("line skipped")
+
 type ReverseReader struct {
 	fp  io.ReadSeeker
 	buf []byte
@@ -16,48 +71,65 @@ type ReverseReader struct {
 
 	// Position in the buffer
 	bufpos int
+
+	maximumLineLength int
+
+	// What to do with lines longer than the maximum line length
+	LongLines LongLinePolicy
+
+	// Warn is called with a *LineTooLongError when a line is skipped or
+	// truncated
+	Warn func(err error)
 }
 
 func NewReverseReader(f io.ReadSeeker, maximumLineLength int) (ret *ReverseReader, err error) {
+	if maximumLineLength <= 0 {
+		return nil, fmt.Errorf("invalid maximum line length: %d", maximumLineLength)
+	}
+
+	// The buffer holds also the newline preceding the line
+	size := maximumLineLength + 1
+	if size > reverseBufferSize {
+		size = reverseBufferSize
+	}
+
 	ret = &ReverseReader{
-		fp:     f,
-		buf:    make([]byte, maximumLineLength),
-		pos:    -1,
-		bufpos: 0,
+		fp:                f,
+		buf:               make([]byte, size),
+		pos:               -1,
+		bufpos:            0,
+		maximumLineLength: maximumLineLength,
 	}
 
 	ret.pos, err = ret.fp.Seek(0, io.SeekEnd)
 	if err != nil {
-		return
+		return nil, err
 	}
 	return
 }
 
-func (r *ReverseReader) fillBuffer() error {
-	var err error
-	// No more data, return EOF
-	if r.pos == 0 && r.bufpos == 0 {
-		err = io.EOF
-		return err
-	}
-
-	// If all data has been read to the buffer
-	if r.pos == 0 {
-		return nil
+// grow doubles the size of the buffer, up to the maximum line length
+func (r *ReverseReader) grow() {
+	size := 2 * len(r.buf)
+	if size > r.maximumLineLength+1 {
+		size = r.maximumLineLength + 1
 	}
+	buf := make([]byte, size)
+	copy(buf, r.buf[:r.bufpos])
+	r.buf = buf
+}
 
+// fillBuffer reads the data preceding the buffer from the file to the free
+// space in the buffer
+func (r *ReverseReader) fillBuffer() error {
 	readlen := len(r.buf) - r.bufpos
 
 	// If less than buffer length of data is left in the file
 	if r.pos < int64(readlen) {
 		readlen = int(r.pos)
 	}
-
-	// If would need to read more bytes than there is space in the
-	// buffer
 	if readlen == 0 {
-		panic(fmt.Sprint("A line detected that is longer than ",
-			len(r.buf), "bytes"))
+		return nil
 	}
 
 	// If there is data still left in the buffer
@@ -65,57 +137,117 @@ func (r *ReverseReader) fillBuffer() error {
 		copy(r.buf[readlen:], r.buf[:r.bufpos])
 	}
 
-	// Set the read position to the new place
-	r.pos, err = r.fp.Seek(r.pos-int64(readlen), io.SeekStart)
+	pos, err := r.fp.Seek(r.pos-int64(readlen), io.SeekStart)
 	if err != nil {
 		return err
 	}
 
-	// Read data to the front part of the buffer
-	var n int
-	n, err = r.fp.Read(r.buf[:readlen])
+	// Short reads are retried until the data is read or the file ends
+	n, err := io.ReadFull(r.fp, r.buf[:readlen])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ShortReadError{Offset: pos, Want: readlen, Got: n}
+	}
 	if err != nil {
 		return err
 	}
-	if n != readlen {
-		// TODO proper error
-		panic(fmt.Sprint("There should have been", readlen,
-			"bytes of data, but only", n, "was read"))
-	}
-	r.bufpos = readlen + r.bufpos
+
+	r.pos = pos
+	r.bufpos += readlen
 	return nil
 }
 
-func (r *ReverseReader) ReadLine() (line string, err error) {
-	idx := bytes.LastIndex(r.buf[:r.bufpos], []byte{'\n'})
+// longLine handles a line that does not fit to the buffer. The rest of the
+// line is read to find its beginning.
+func (r *ReverseReader) longLine() (string, error) {
+	end := r.pos + int64(r.bufpos)
 
-	// if not found in the current buffer
-	if idx < 0 {
-		err = r.fillBuffer()
+	idx := -1
+	for idx < 0 && r.pos > 0 {
+		r.bufpos = 0
+		err := r.fillBuffer()
 		if err != nil {
 			return "", err
 		}
-		idx = bytes.LastIndex(r.buf[:r.bufpos], []byte{'\n'})
-		if idx == -1 {
-			if r.pos > 0 {
-				panic(fmt.Sprint("2ND A line detected that is longer than ",
-					len(r.buf), "bytes"))
-			}
-			idx = 0
-		}
+		idx = bytes.LastIndexByte(r.buf[:r.bufpos], '\n')
+	}
+
+	start := r.pos + int64(idx) + 1
+	r.bufpos = 0
+	if idx >= 0 {
+		r.bufpos = idx
+	}
+
+	lerr := &LineTooLongError{
+		Offset: start,
+		Length: end - start,
+		Limit:  r.maximumLineLength,
+	}
+	if r.LongLines == LongLineError {
+		return "", lerr
+	}
+	if r.Warn != nil {
+		r.Warn(lerr)
+	}
+	if r.LongLines == LongLineSkip {
+		return "", errLineSkipped
+	}
+
+	_, err := r.fp.Seek(start, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	line := make([]byte, r.maximumLineLength+1)
+	n, err := io.ReadFull(r.fp, line[:r.maximumLineLength])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", &ShortReadError{Offset: start, Want: r.maximumLineLength, Got: n}
 	}
-	if idx > 0 || (idx == 0 && r.buf[idx] == '\n') {
-		idx++
+	if err != nil {
+		return "", err
 	}
+	line[r.maximumLineLength] = '\n'
+	return string(line), nil
+}
+
+func (r *ReverseReader) ReadLine() (line string, err error) {
+	for {
+		idx := bytes.LastIndexByte(r.buf[:r.bufpos], '\n')
+
+		// Read more until the line start is found
+		for idx < 0 && r.pos > 0 && r.bufpos <= r.maximumLineLength {
+			if r.bufpos == len(r.buf) {
+				r.grow()
+			}
+			err = r.fillBuffer()
+			if err != nil {
+				return "", err
+			}
+			idx = bytes.LastIndexByte(r.buf[:r.bufpos], '\n')
+		}
+
+		if idx < 0 && r.bufpos > r.maximumLineLength {
+			line, err = r.longLine()
+			if err == errLineSkipped {
+				continue
+			}
+			return line, err
+		}
 
-	sb := strings.Builder{}
-	sb.Write(r.buf[idx:r.bufpos])
-	sb.WriteByte('\n')
+		// No more data
+		if idx < 0 && r.bufpos == 0 {
+			return "", io.EOF
+		}
 
-	r.bufpos = idx
-	if idx > 0 || (idx == 0 && r.buf[idx] == '\n') {
-		r.bufpos--
+		line = string(r.buf[idx+1:r.bufpos]) + "\n"
+		r.bufpos = 0
+		if idx >= 0 {
+			r.bufpos = idx
+		}
+		return line, nil
 	}
+}
 
-	return sb.String(), nil
+// warnLongLine prints a warning about a line that is truncated when the log
+// is read in reverse
+func warnLongLine(err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %v, truncated\n", err)
 }
@@ -2,7 +2,9 @@ package cmdlib
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -86,3 +88,157 @@ func BenchmarkReverseReader(b *testing.B) {
 		}
 	}
 }
+
+// readLines reads the lines of the reverse reader until EOF or an error
+func readLines(r *ReverseReader) (lines []string, err error) {
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestReverseReaderLongLines(t *testing.T) {
+	maximumLineLength := 10
+	data := "first\n" + strings.Repeat("x", 25) + "\nlast\n" + strings.Repeat("y", 11)
+
+	tests := []struct {
+		name     string
+		policy   LongLinePolicy
+		lines    []string
+		warnings int
+	}{
+		{"Skip", LongLineSkip, []string{"last\n", "first\n"}, 2},
+		{"Truncate", LongLineTruncate, []string{"yyyyyyyyyy\n", "last\n",
+			"xxxxxxxxxx\n", "first\n"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReverseReader(strings.NewReader(data), maximumLineLength)
+			if err != nil {
+				t.Fatal("Creating new reader failed:", err)
+			}
+			warnings := 0
+			r.LongLines = tt.policy
+			r.Warn = func(err error) {
+				if _, ok := err.(*LineTooLongError); !ok {
+					t.Errorf("Expected LineTooLongError, got %v", err)
+				}
+				warnings++
+			}
+
+			lines, err := readLines(r)
+			if err != nil {
+				t.Fatal("Reading failed:", err)
+			}
+			compare(t, "Lines differ", tt.lines, lines)
+			compare(t, "Warning count differs", tt.warnings, warnings)
+		})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		r, err := NewReverseReader(strings.NewReader(data), maximumLineLength)
+		if err != nil {
+			t.Fatal("Creating new reader failed:", err)
+		}
+
+		// The reading can be continued after the error
+		want := []struct {
+			line string
+			err  error
+		}{
+			{"", &LineTooLongError{Offset: 37, Length: 11, Limit: 10}},
+			{"last\n", nil},
+			{"", &LineTooLongError{Offset: 6, Length: 25, Limit: 10}},
+			{"first\n", nil},
+			{"", io.EOF},
+		}
+		for i, w := range want {
+			line, err := r.ReadLine()
+			compare(t, fmt.Sprintf("Line %d differs", i), w.line, line)
+			compare(t, fmt.Sprintf("Error %d differs", i), fmt.Sprint(w.err), fmt.Sprint(err))
+			if _, ok := w.err.(*LineTooLongError); ok {
+				if _, ok := err.(*LineTooLongError); !ok {
+					t.Errorf("Expected LineTooLongError, got %T", err)
+				}
+			}
+		}
+	})
+}
+
+func TestReverseReaderGrow(t *testing.T) {
+	long := strings.Repeat("z", 3*reverseBufferSize)
+	data := "first\n" + long + "\nlast\n"
+
+	r, err := NewReverseReader(strings.NewReader(data), 4*reverseBufferSize)
+	if err != nil {
+		t.Fatal("Creating new reader failed:", err)
+	}
+	lines, err := readLines(r)
+	if err != nil {
+		t.Fatal("Reading failed:", err)
+	}
+	compare(t, "Lines differ", []string{"\n", "last\n", long + "\n", "first\n"}, lines)
+}
+
+// shortReader returns at most n bytes on each read
+type shortReader struct {
+	io.ReadSeeker
+	n int
+}
+
+func (s *shortReader) Read(p []byte) (int, error) {
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	return s.ReadSeeker.Read(p)
+}
+
+// truncatedReader claims to be longer than its data, like a file that is
+// truncated while it is read
+type truncatedReader struct {
+	*bytes.Reader
+	size int64
+}
+
+func (s *truncatedReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		return s.size, nil
+	}
+	return s.Reader.Seek(offset, whence)
+}
+
+func TestReverseReaderShortReads(t *testing.T) {
+	data := "first\nsecond\nthird"
+
+	r, err := NewReverseReader(&shortReader{strings.NewReader(data), 2}, 10)
+	if err != nil {
+		t.Fatal("Creating new reader failed:", err)
+	}
+	lines, err := readLines(r)
+	if err != nil {
+		t.Fatal("Reading failed:", err)
+	}
+	compare(t, "Lines differ", "third\nsecond\nfirst\n", strings.Join(lines, ""))
+
+	r, err = NewReverseReader(&truncatedReader{bytes.NewReader([]byte(data)), 25}, 10)
+	if err != nil {
+		t.Fatal("Creating new reader failed:", err)
+	}
+	_, err = readLines(r)
+	serr, ok := err.(*ShortReadError)
+	if !ok {
+		t.Fatalf("Expected ShortReadError, got %v", err)
+	}
+	compare(t, "Error differs", ShortReadError{Offset: 14, Want: 11, Got: 4}, *serr)
+
+	_, err = NewReverseReader(strings.NewReader(data), 0)
+	if err == nil {
+		t.Error("Expected an error for zero maximum line length")
+	}
+}
@@ -0,0 +1,356 @@
+package cmdlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const rewriteBufferSize = 64 * 1024
+
+// ForEachLine calls fn for each line read from the reader. Unlike in
+// ParseCmdLog, a final line without a newline is also processed.
+func ForEachLine(r LineReader, fn func(line string) error) error {
+	for {
+		line, err := r.ReadLine()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line != "" {
+			ferr := fn(line)
+			if ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// linkOrCopy replaces dst with a hard link to src. If hard links are not
+// supported, src is copied instead. If src is a directory, its files are
+// linked or copied to the directory dst.
+func linkOrCopy(src, dst string) error {
+	err := os.RemoveAll(dst)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return linkOrCopyFile(src, dst)
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dst, info.Mode().Perm())
+	for _, file := range files {
+		if err != nil {
+			break
+		}
+		err = linkOrCopyFile(filepath.Join(src, file.Name()),
+			filepath.Join(dst, file.Name()))
+	}
+	if err != nil {
+		os.RemoveAll(dst)
+	}
+	return err
+}
+
+func linkOrCopyFile(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// replaceLog renames the new log over the log file. A directory, or a file
+// with a directory, can not be replaced with a single rename. Then the log
+// is first moved aside and moved back if the new log can not be moved in
+// its place.
+func (l *Log) replaceLog(newLog string) error {
+	err := os.Rename(newLog, l.LogFile)
+	if err == nil || !FileExists(l.LogFile) {
+		return err
+	}
+
+	previous := l.LogFile + ".previous"
+	err = os.RemoveAll(previous)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.LogFile, previous)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(newLog, l.LogFile)
+	if err != nil {
+		if rerr := os.Rename(previous, l.LogFile); rerr != nil {
+			return fmt.Errorf("%v, the previous log is in %s", err, previous)
+		}
+		return err
+	}
+	return os.RemoveAll(previous)
+}
+
+// rewrite replaces the contents of the log atomically. The filter function
+// reads the current log and writes the new contents. The new log is written
+// to a temporary file which is renamed over the log. If backup is not empty,
+// the previous log is hard linked or copied to that file.
+//
+// The log is locked exclusively during the rewrite so that concurrent
+// AppendLine calls wait until the new log is in place.
+func (l *Log) rewrite(filter func(r LineReader, w io.Writer) error, backup string) error {
+	unlock, err := l.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if StoreFormat(l.LogFile) == FormatBinary {
+		return l.rewriteBinary(filter, backup)
+	}
+
+	var in io.Reader = &bytes.Buffer{}
+	exists := FileExists(l.LogFile)
+	if exists {
+		fp, err := os.Open(l.LogFile)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.LogFile),
+		filepath.Base(l.LogFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	out := bufio.NewWriter(tmp)
+	err = filter(NewBufferedReader(in, rewriteBufferSize), out)
+	if err != nil {
+		return cleanup(err)
+	}
+	err = out.Flush()
+	if err != nil {
+		return cleanup(err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return cleanup(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return cleanup(err)
+	}
+
+	// The backup is made before the swap so that the log is replaced with
+	// a single rename
+	if exists && backup != "" {
+		err = linkOrCopy(l.LogFile, backup)
+		if err != nil {
+			return cleanup(err)
+		}
+	}
+
+	err = os.Rename(tmpName, l.LogFile)
+	if err != nil {
+		return cleanup(err)
+	}
+
+	return nil
+}
+
+// rewriteBinary is rewrite for the binary store. The new segments are
+// written to a temporary directory, which replaces the store. The lock must
+// be held by the caller.
+func (l *Log) rewriteBinary(filter func(r LineReader, w io.Writer) error, backup string) error {
+	from, err := openStore(l.LogFile, FormatBinary, nil)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	r, err := from.Scan(false)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(l.LogFile),
+		filepath.Base(l.LogFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	to, err := openStore(filepath.Join(tmpDir, "log"), FormatBinary, nil)
+	if err != nil {
+		return err
+	}
+	w := &storeWriter{store: to}
+	err = filter(r, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	cerr := to.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if backup != "" {
+		err = linkOrCopy(l.LogFile, backup)
+		if err != nil {
+			return err
+		}
+	}
+	return l.replaceLog(filepath.Join(tmpDir, "log"))
+}
+
+// storeWriter appends the log lines written to it to a store. Lines that
+// are not valid log lines are dropped.
+type storeWriter struct {
+	store Store
+	buf   []byte
+}
+
+func (w *storeWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		err := w.appendLine(string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush appends a final line without a newline
+func (w *storeWriter) Flush() error {
+	line := string(w.buf)
+	w.buf = nil
+	return w.appendLine(line)
+}
+
+func (w *storeWriter) appendLine(line string) error {
+	timeint, session, cmd, err := SplitLogLine(line)
+	if err != nil {
+		return nil
+	}
+	return w.store.Append(timeint, session, cmd)
+}
+
+// removeLines removes the lines for which matches returns true from the log.
+// If dryRun is set, the log is not modified and the lines that would be
+// removed are written to output instead. Returns the number of removed lines.
+//
+// Only the entries with timestamps in [since, until) may match, so the
+// others are not read when looking for the matches. If the range is limited
+// and nothing matches, the log is not rewritten. The lines in the range are
+// then passed to matches twice, so it must not keep state.
+func (l *Log) removeLines(matches func(line string) bool, since, until int64,
+	dryRun bool, backup bool, output io.Writer) (removed int, err error) {
+
+	filter := func(r LineReader, w io.Writer) error {
+		return ForEachLine(r, func(line string) error {
+			if !matches(line) {
+				_, err := io.WriteString(w, line)
+				return err
+			}
+			removed++
+			if dryRun && output != nil {
+				if !strings.HasSuffix(line, "\n") {
+					line += "\n"
+				}
+				_, err := io.WriteString(output, line)
+				return err
+			}
+			return nil
+		})
+	}
+
+	limited := since != minTime || until != maxTime
+	if dryRun || limited {
+		err = func() error {
+			unlock, err := l.lock(false)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+
+			if !FileExists(l.LogFile) {
+				return nil
+			}
+			store, err := openStore(l.LogFile, "", nil)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			r, err := store.Range(since, until, false)
+			if err != nil {
+				return err
+			}
+			return filter(r, ioutil.Discard)
+		}()
+		if dryRun || err != nil || removed == 0 {
+			return removed, err
+		}
+		removed = 0
+	}
+
+	backupFile := ""
+	if backup {
+		backupFile = l.BackupFile()
+	}
+
+	err = l.rewrite(filter, backupFile)
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,272 @@
+package cmdlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The initial sizes of the report and the completion buffer of scanLineJobs
+const (
+	lineJobsReportLen            = 1024 * 128
+	lineJobsCompletionBufferSize = 1024
+)
+
+// scanLineJobs reads the log line by line and parses each line in a
+// separate job. The parsed entries are collected to a report in the order
+// they were read and handled as soon as all the earlier entries are
+// parsed. This was how the log was scanned before scanChunks, and it is
+// kept as the baseline of the benchmarks. The report and the completion
+// buffer grow as needed.
+func scanLineJobs(reader LineReader, control *controlArgs,
+	parseEntry func(line string) *Entry, handleEntry func(e *Entry),
+	stopped func() bool) (err error) {
+
+	// The parsed entries in the order they were read. If an entry is nil,
+	// it has been filtered out.
+	report := make([]*Entry, lineJobsReportLen)
+	index := 0
+	reportLock := sync.RWMutex{}
+
+	type reportLine struct {
+		line  string
+		index int
+	}
+	jobs := make(chan reportLine, control.JobCount)
+	completions := make(chan int, control.JobCount)
+
+	wg := sync.WaitGroup{}
+
+	// Parses the report line strings to the report array
+	worker := func() {
+		for rl := range jobs {
+			var e *Entry
+			if !stopped() {
+				e = parseEntry(rl.line)
+			}
+			reportLock.RLock()
+			report[rl.index] = e
+			reportLock.RUnlock()
+			completions <- rl.index
+		}
+		wg.Done()
+	}
+	for i := 0; i < control.JobCount*2; i++ {
+		wg.Add(1)
+		go worker()
+	}
+
+	// Handle the whole report as it gets parsed
+	printWg := sync.WaitGroup{}
+	printWg.Add(1)
+	go func() {
+		complete := make([]int, 0, lineJobsCompletionBufferSize)
+		firstNotPrinted := 0
+
+		for idx := range completions {
+			complete = append(complete, idx)
+			sort.Ints(complete)
+
+			limit := firstNotPrinted
+			next := len(complete)
+
+			// Get the number of sequential items that can be handled
+			for i := range complete {
+				if limit != complete[i] {
+					next = i
+					break
+				}
+				limit++
+			}
+
+			for i := firstNotPrinted; i < limit; i++ {
+				reportLock.RLock()
+				e := report[i]
+				report[i] = nil
+				reportLock.RUnlock()
+				if e != nil {
+					handleEntry(e)
+				}
+			}
+			complete = complete[next:]
+			firstNotPrinted = limit
+		}
+		printWg.Done()
+	}()
+
+	for !stopped() {
+		line, rerr := reader.ReadLine()
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = fmt.Errorf("error reading log: %v", rerr)
+			break
+		}
+		if index >= cap(report)-1 {
+			reportLock.Lock()
+
+			// Allocate to capacity
+			report = append(report, nil)
+			report = append(report, make([]*Entry, cap(report)-len(report))...)
+			reportLock.Unlock()
+		}
+		jobs <- reportLine{line, index}
+		index++
+	}
+	close(jobs)
+	wg.Wait()
+	close(completions)
+	printWg.Wait()
+
+	return err
+}
+
+// withLineJobs calls fn with the log scanned by scanLineJobs
+func withLineJobs(fn func()) {
+	defer func() { scanLog = scanChunks }()
+	scanLog = scanLineJobs
+	fn()
+}
+
+// The same report is printed when the log is scanned in chunks and with
+// each line parsed in a separate job
+func TestParseCmdLogLineJobs(t *testing.T) {
+	data := benchmarkLog(2000)
+	lineReader := func(reverse bool) LineReader {
+		if reverse {
+			return &reverseLineReader{strings.SplitAfter(data, "\n")}
+		}
+		return &testLineReader{buf: bytes.NewBufferString(data)}
+	}
+	for _, arg := range []ParseArgs{
+		{},
+		{Reverse: true},
+		{Grep: "make", Pwd: true},
+		{Session: "zsh-2", Reverse: true, Pwd: true},
+		{Limit: 10, Offset: 3},
+	} {
+		arg.Control.Now = time.Unix(1600000000, 0)
+		arg.Control.ChunkLines = 100
+
+		want := &bytes.Buffer{}
+		arg.Output = want
+		err := ParseCmdLog(lineReader(arg.Reverse), arg)
+		if err != nil {
+			t.Fatal("ParseCmdLog in chunks failed:", err)
+		}
+		if want.Len() == 0 {
+			t.Error("Expected output")
+		}
+
+		got := &bytes.Buffer{}
+		arg.Output = got
+		withLineJobs(func() {
+			err = ParseCmdLog(lineReader(arg.Reverse), arg)
+		})
+		if err != nil {
+			t.Fatal("ParseCmdLog with line jobs failed:", err)
+		}
+		compare(t, "Outputs differ with line jobs", want.String(), got.String())
+	}
+}
+
+// reverseLineReader returns the lines in reverse order
+type reverseLineReader struct {
+	lines []string
+}
+
+func (r *reverseLineReader) ReadLine() (string, error) {
+	if len(r.lines) == 0 {
+		return "", io.EOF
+	}
+	line := r.lines[len(r.lines)-1]
+	r.lines = r.lines[:len(r.lines)-1]
+	return line, nil
+}
+
+// benchmarkLog creates a log with the given number of lines
+func benchmarkLog(count int) string {
+	cmds := []string{"git status", "make -j8 all", "cd /work/project",
+		"go test ./...", "vim main.go"}
+	sb := strings.Builder{}
+	for i := 0; i < count; i++ {
+		sb.WriteString(strconv.Itoa(1600000000 + i*7))
+		sb.WriteString("\tzsh-" + strconv.Itoa(i/500) + "\t")
+		sb.WriteString(cmds[i%len(cmds)] + " " + strconv.Itoa(i) + "\n")
+	}
+	return sb.String()
+}
+
+// benchmarkScan scans a large log in chunks or with each line parsed in a
+// separate job. If print is set, the report is also formatted.
+func benchmarkScan(b *testing.B, reverse bool, lineJobs bool, print bool) {
+	data := []byte(benchmarkLog(200000))
+	arg := ParseArgs{Output: ioutil.Discard, Reverse: reverse}
+
+	scan := func() {
+		for i := 0; i < b.N; i++ {
+			var r LineReader
+			if reverse {
+				r, _ = NewReverseReader(bytes.NewReader(data), 160*1024)
+			} else {
+				r = NewBufferedReader(bytes.NewReader(data), 160*1024)
+			}
+			var err error
+			if print {
+				err = ParseCmdLog(r, arg)
+			} else {
+				err = ScanCmdLog(r, arg, func(e *Entry) error { return nil })
+			}
+			if err != nil {
+				b.Fatal("Scanning failed:", err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	if lineJobs {
+		withLineJobs(scan)
+	} else {
+		scan()
+	}
+}
+
+func BenchmarkScanCmdLog_LineJobs(b *testing.B) {
+	benchmarkScan(b, false, true, false)
+}
+
+func BenchmarkScanCmdLog_Lines(b *testing.B) {
+	benchmarkScan(b, false, false, false)
+}
+
+func BenchmarkScanCmdLog_ReverseLineJobs(b *testing.B) {
+	benchmarkScan(b, true, true, false)
+}
+
+func BenchmarkScanCmdLog_ReverseLines(b *testing.B) {
+	benchmarkScan(b, true, false, false)
+}
+
+func BenchmarkParseCmdLog_LineJobs(b *testing.B) {
+	benchmarkScan(b, false, true, true)
+}
+
+func BenchmarkParseCmdLog_Lines(b *testing.B) {
+	benchmarkScan(b, false, false, true)
+}
+
+func BenchmarkParseCmdLog_ReverseLineJobs(b *testing.B) {
+	benchmarkScan(b, true, true, true)
+}
+
+func BenchmarkParseCmdLog_ReverseLines(b *testing.B) {
+	benchmarkScan(b, true, false, true)
+}
@@ -0,0 +1,361 @@
+package cmdlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CursorHeader is the HTTP header containing the cursor for the next
+	// incremental fetch.
+	CursorHeader = "X-Cmdlog-Cursor"
+
+	apiEntries = "/api/v1/entries"
+	apiSearch  = "/api/v1/search"
+)
+
+// maxAppendSize is the maximum size of the request body when appending
+var maxAppendSize int64 = 64 * 1024 * 1024
+
+// Server stores the command logs of several users. Each user has its own log
+// file in the directory Dir. Sessions of the entries are tagged with the
+// host they were pushed from.
+//
+// The API:
+//
+//	POST /api/v1/entries?host=HOST
+//	     Append the log lines in the request body.
+//	GET  /api/v1/entries?cursor=CURSOR&exclude-host=HOST
+//	     Get the log lines starting from the cursor. The cursor for the
+//	     next fetch is in the X-Cmdlog-Cursor header.
+//	GET  /api/v1/search?session=&since=&grep=&tag=&program=&dir=
+//	     &pwd=&reverse=&notes=&ids=&multiline=&recursive=
+//	     &limit=&offset=&before=&after=
+//	     Get a report of the log with the same options as the report
+//	     command.
+//
+// All requests are authenticated with "Authorization: Bearer TOKEN".
+type Server struct {
+	Dir string
+
+	// Tokens maps authentication tokens to users
+	Tokens map[string]string
+}
+
+// LoadTokens reads tokens from a file with lines of the form "TOKEN USER".
+// Empty lines and lines starting with # are ignored.
+func LoadTokens(r io.Reader) (map[string]string, error) {
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	linenum := 0
+	for scanner.Scan() {
+		linenum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid token on line %d", linenum)
+		}
+		ret[fields[0]] = fields[1]
+	}
+	return ret, scanner.Err()
+}
+
+func (s *Server) userLog(user string) *Log {
+	return CreateLog(SegmentFile(s.Dir, user), "")
+}
+
+func (s *Server) authenticate(r *http.Request) (user string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	for t, u := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			user, ok = u, true
+		}
+	}
+	return
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == apiEntries && r.Method == http.MethodPost:
+		s.append(w, r, user)
+	case r.URL.Path == apiEntries && r.Method == http.MethodGet:
+		s.fetch(w, r, user)
+	case r.URL.Path == apiSearch && r.Method == http.MethodGet:
+		s.search(w, r, user)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) append(w http.ResponseWriter, r *http.Request, user string) {
+	host := r.URL.Query().Get("host")
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAppendSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	count := 0
+	err = ForEachLine(NewBufferedReader(bytes.NewReader(body), rewriteBufferSize),
+		func(line string) error {
+			if strings.TrimSpace(line) == "" {
+				return nil
+			}
+			timeint, session, cmd, err := SplitLogLine(line)
+			if err != nil {
+				return err
+			}
+			if host != "" {
+				session = TagSession(host, session)
+			}
+			buf.WriteString(formatLogLine(timeint, session, cmd))
+			count++
+			return nil
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.userLog(user).appendData(buf.Bytes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"appended": count})
+}
+
+func (s *Server) fetch(w http.ResponseWriter, r *http.Request, user string) {
+	query := r.URL.Query()
+	var cursor int64
+	if c := query.Get("cursor"); c != "" {
+		var err error
+		cursor, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || cursor < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	excludeHost := query.Get("exclude-host")
+
+	log := s.userLog(user)
+	unlock, err := log.lock(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	var size int64
+	fp, err := os.Open(log.LogFile)
+	if err == nil {
+		defer fp.Close()
+		var info os.FileInfo
+		info, err = fp.Stat()
+		if err == nil {
+			size = info.Size()
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cursor > size {
+		cursor = size
+	}
+
+	// Only complete lines are returned
+	end := cursor
+	if size > cursor {
+		end, err = completeLinesEnd(fp, cursor, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(CursorHeader, strconv.FormatInt(end, 10))
+	if end == cursor {
+		return
+	}
+
+	out := bufio.NewWriter(w)
+	err = ForEachLine(NewBufferedReader(io.NewSectionReader(fp, cursor, end-cursor), rewriteBufferSize),
+		func(line string) error {
+			if excludeHost != "" {
+				_, session, _, err := SplitLogLine(line)
+				if err == nil && strings.HasPrefix(session, TagSession(excludeHost, "")) {
+					return nil
+				}
+			}
+			_, err := out.WriteString(line)
+			return err
+		})
+	if err == nil {
+		_ = out.Flush()
+	}
+}
+
+// searchFields returns the fields of the report arguments that are given
+// in the query of a search, by their query parameters
+func searchFields(arg *ParseArgs) (strs map[string]*string,
+	bools map[string]*bool, ints map[string]*int) {
+
+	strs = map[string]*string{
+		"session": &arg.Session,
+		"since":   &arg.Since,
+		"grep":    &arg.Grep,
+		"tag":     &arg.Tag,
+		"program": &arg.Program,
+		"dir":     &arg.Dir,
+	}
+	bools = map[string]*bool{
+		"pwd":       &arg.Pwd,
+		"reverse":   &arg.Reverse,
+		"notes":     &arg.Notes,
+		"ids":       &arg.IDs,
+		"multiline": &arg.Multiline,
+		"recursive": &arg.DirRecursive,
+	}
+	ints = map[string]*int{
+		"limit":  &arg.Limit,
+		"offset": &arg.Offset,
+		"before": &arg.Before,
+		"after":  &arg.After,
+	}
+	return
+}
+
+// searchQuery returns the query of a search with the report arguments
+func searchQuery(arg ParseArgs) url.Values {
+	query := url.Values{}
+	strs, bools, ints := searchFields(&arg)
+	for k, v := range strs {
+		if *v != "" {
+			query.Set(k, *v)
+		}
+	}
+	for k, v := range bools {
+		if *v {
+			query.Set(k, "t")
+		}
+	}
+	for k, v := range ints {
+		if *v != 0 {
+			query.Set(k, strconv.Itoa(*v))
+		}
+	}
+	return query
+}
+
+// searchArgs returns the report arguments of the query of a search
+func searchArgs(query url.Values) (arg ParseArgs, err error) {
+	strs, bools, ints := searchFields(&arg)
+	for k, v := range strs {
+		*v = query.Get(k)
+	}
+	for k, v := range bools {
+		*v = query.Get(k) != ""
+	}
+	for k, v := range ints {
+		if query.Get(k) == "" {
+			continue
+		}
+		*v, err = strconv.Atoi(query.Get(k))
+		if err != nil || *v < 0 {
+			return arg, fmt.Errorf("invalid %s: %q", k, query.Get(k))
+		}
+	}
+	return arg, nil
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request, user string) {
+	arg, err := searchArgs(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The arguments are checked before the report is started, as the
+	// errors cannot be returned once the report is being written
+	since := int64(minTime)
+	_, err = CompileGrep(arg.Grep)
+	if err == nil && arg.Since != "" {
+		since, err = ParseTime(arg.Since)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The entries older than since are needed for tracking the
+	// directories
+	if arg.Pwd || arg.Dir != "" {
+		since = minTime
+	}
+
+	log := s.userLog(user)
+	if arg.Tag != "" || arg.Notes {
+		arg.Tags, err = LoadTagStore(log.TagFile())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	unlock, err := log.lock(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !FileExists(log.LogFile) {
+		return
+	}
+	store, err := log.OpenStore("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer store.Close()
+	lr, err := store.Range(since, maxTime, arg.Reverse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	arg.Output = w
+	_ = ParseCmdLog(lr, arg)
+}
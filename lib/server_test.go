@@ -0,0 +1,247 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTokens(t *testing.T) {
+	tokens, err := LoadTokens(strings.NewReader("# comment\n\nabc user1\n  def user2  \n"))
+	if err != nil {
+		t.Fatal("Loading tokens failed:", err)
+	}
+	compare(t, "Token count differs", 2, len(tokens))
+	compare(t, "Token user differs", "user1", tokens["abc"])
+	compare(t, "Token user differs", "user2", tokens["def"])
+
+	_, err = LoadTokens(strings.NewReader("abc\n"))
+	if err == nil {
+		t.Error("Expected error from invalid token line")
+	}
+}
+
+func setupServer(t *testing.T, testdir string) *httptest.Server {
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(filepath.Join(testdir, "server"), 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+
+	return httptest.NewServer(&Server{
+		Dir: filepath.Join(testdir, "server"),
+		Tokens: map[string]string{
+			"token1": "user1",
+			"token2": "user2",
+		},
+	})
+}
+
+func TestServer(t *testing.T) {
+	testdir := "test-server"
+	ts := setupServer(t, testdir)
+	defer ts.Close()
+	defer os.RemoveAll(testdir)
+
+	c1 := &Client{URL: ts.URL, Token: "token1"}
+	c2 := &Client{URL: ts.URL, Token: "token2"}
+
+	// Authentication
+	err := (&Client{URL: ts.URL, Token: "wrong"}).Append("h", strings.NewReader("1\ts\tx\n"))
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Error("Expected unauthorized error, got:", err)
+	}
+	resp, err := http.Get(ts.URL + apiEntries)
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	resp.Body.Close()
+	compare(t, "Expected unauthorized", http.StatusUnauthorized, resp.StatusCode)
+
+	// Invalid data
+	err = c1.Append("h", strings.NewReader("garbage\n"))
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Error("Expected bad request error, got:", err)
+	}
+
+	// Too large request
+	func(size int64) {
+		defer func() { maxAppendSize = size }()
+		maxAppendSize = 16
+		err = c1.Append("h", strings.NewReader("1450120005\ts1\tgo test\n"))
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Error("Expected bad request error, got:", err)
+		}
+	}(maxAppendSize)
+
+	err = c1.Append("laptop", strings.NewReader("1450120005\ts1\tgo test\n"))
+	if err != nil {
+		t.Fatal("Append failed:", err)
+	}
+	err = c1.Append("desktop", strings.NewReader("1450120010\ts2\tgo build\n"))
+	if err != nil {
+		t.Fatal("Append failed:", err)
+	}
+
+	// Fetching from the start
+	buf := &bytes.Buffer{}
+	cursor, err := c1.Fetch(0, "", buf)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	compare(t, "Fetched data differs",
+		"1450120005\tlaptop:s1\tgo test\n1450120010\tdesktop:s2\tgo build\n",
+		buf.String())
+
+	// Nothing new after the cursor
+	buf.Reset()
+	next, err := c1.Fetch(cursor, "", buf)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	compare(t, "Cursor should not change", cursor, next)
+	compare(t, "Nothing should be fetched", "", buf.String())
+
+	// Excluding a host
+	buf.Reset()
+	_, err = c1.Fetch(0, "laptop", buf)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	compare(t, "Fetched data differs",
+		"1450120010\tdesktop:s2\tgo build\n", buf.String())
+
+	// Users are separated
+	buf.Reset()
+	_, err = c2.Fetch(0, "", buf)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	compare(t, "Other user should have no data", "", buf.String())
+
+	// Searching
+	buf.Reset()
+	err = c1.Search(ParseArgs{Grep: "build"}, buf)
+	if err != nil {
+		t.Fatal("Search failed:", err)
+	}
+	if !strings.HasSuffix(buf.String(), "\tgo build\n") ||
+		strings.Contains(buf.String(), "go test") {
+		t.Error("Unexpected search result:", buf.String())
+	}
+
+	buf.Reset()
+	err = c1.Search(ParseArgs{Session: "laptop:s1", Reverse: true}, buf)
+	if err != nil {
+		t.Fatal("Search failed:", err)
+	}
+	if !strings.HasSuffix(buf.String(), "\tgo test\n") ||
+		strings.Contains(buf.String(), "go build") {
+		t.Error("Unexpected search result:", buf.String())
+	}
+
+	err = c1.Search(ParseArgs{Grep: "["}, buf)
+	if err == nil {
+		t.Error("Expected error from invalid regexp")
+	}
+
+	// The other report options are also used
+	buf.Reset()
+	err = c1.Search(ParseArgs{Program: "go", Reverse: true, Limit: 1}, buf)
+	if err != nil {
+		t.Fatal("Search failed:", err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 ||
+		!strings.HasSuffix(buf.String(), "\tgo build\n") {
+		t.Error("Unexpected search result:", buf.String())
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	arg := ParseArgs{Session: "s", Grep: "go", Tag: "t", Program: "git",
+		Dir: "/tmp", Pwd: true, Reverse: true, Notes: true, IDs: true,
+		Multiline: true, DirRecursive: true, Limit: 3, Offset: 2,
+		Before: 1, After: 4}
+	got, err := searchArgs(searchQuery(arg))
+	if err != nil {
+		t.Fatal("Decoding the query failed:", err)
+	}
+	compare(t, "Arguments differ", arg, got)
+
+	_, err = searchArgs(url.Values{"limit": []string{"-1"}})
+	if err == nil {
+		t.Error("Expected error from negative limit")
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	testdir := "test-pushpull"
+	ts := setupServer(t, testdir)
+	defer ts.Close()
+	defer os.RemoveAll(testdir)
+
+	c := &Client{URL: ts.URL, Token: "token1"}
+	logfile := filepath.Join(testdir, "log")
+	remote := filepath.Join(testdir, "remote")
+	log := CreateLog(logfile, "")
+
+	write := func(data string) {
+		err := ioutil.WriteFile(logfile, []byte(data), 0600)
+		if err != nil {
+			t.Fatal("Could not write log:", err)
+		}
+	}
+	push := func(expected int) {
+		count, err := log.Push(c, "laptop")
+		if err != nil {
+			t.Fatal("Push failed:", err)
+		}
+		compare(t, "Pushed count differs", expected, count)
+	}
+	pull := func(excludeHost string, expected string) {
+		_, err := Pull(c, remote, excludeHost)
+		if err != nil {
+			t.Fatal("Pull failed:", err)
+		}
+		data, err := ioutil.ReadFile(remote)
+		if err != nil {
+			t.Fatal("Could not read pulled data:", err)
+		}
+		compare(t, "Pulled data differs", expected, string(data))
+	}
+
+	// Missing log
+	push(0)
+
+	// Partial and malformed lines are not pushed
+	write("1\ts\ta\ngarbage\n2\ts\tb\n3\ts\tpartial")
+	push(2)
+	push(0)
+
+	write("1\ts\ta\ngarbage\n2\ts\tb\n3\ts\tpartial\n4\ts\tc\n")
+	push(2)
+
+	// The log has been rewritten
+	write("2\ts\tb\n3\ts\tpartial\n4\ts\tc\n5\ts\td\n")
+	push(1)
+
+	all := "1\tlaptop:s\ta\n2\tlaptop:s\tb\n3\tlaptop:s\tpartial\n" +
+		"4\tlaptop:s\tc\n5\tlaptop:s\td\n"
+	pull("", all)
+	pull("", all)
+
+	err := c.Append("desktop", strings.NewReader("6\ts\te\n"))
+	if err != nil {
+		t.Fatal("Append failed:", err)
+	}
+	pull("laptop", all+"6\tdesktop:s\te\n")
+}
@@ -0,0 +1,141 @@
+package cmdlib
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const sessionExitCommand = "Exited shell session"
+
+// SessionInfo describes a single session in the command log
+type SessionInfo struct {
+	Session string    `json:"session"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+
+	// Duration from the first to the last command in seconds
+	Duration int64 `json:"duration"`
+
+	// Number of commands in the session
+	Commands int `json:"commands"`
+
+	// The working directory after the last command
+	Pwd string `json:"pwd,omitempty"`
+
+	// The session ended with the shell exit message
+	Exited bool `json:"exited"`
+}
+
+// SessionsArgs are the arguments for the ListSessions function
+type SessionsArgs struct {
+	Since string
+
+	// List only sessions with commands matching this
+	Grep string
+
+	// List the most recently active sessions first
+	Reverse bool
+
+	JSON   bool
+	Now    time.Time
+	Output io.Writer
+}
+
+// CollectSessions reads the command log and returns the sessions ordered by
+// the time of their last command.
+func CollectSessions(reader LineReader, arg SessionsArgs) ([]*SessionInfo, error) {
+	grepRe, err := CompileGrep(arg.Grep)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string]*SessionInfo)
+	matched := make(map[string]bool)
+
+	pa := ParseArgs{
+		Since: arg.Since,
+		Pwd:   true,
+	}
+	err = ScanCmdLog(reader, pa, func(e *Entry) error {
+		s, ok := sessions[e.Session]
+		if !ok {
+			s = &SessionInfo{Session: e.Session}
+			sessions[e.Session] = s
+		}
+
+		s.Commands++
+		s.Pwd = e.Pwd
+		s.Exited = e.Command == sessionExitCommand
+		if e.HasValidTime() {
+			if s.First.IsZero() || e.Time.Before(s.First) {
+				s.First = e.Time
+			}
+			if e.Time.After(s.Last) {
+				s.Last = e.Time
+			}
+			s.Duration = int64(s.Last.Sub(s.First) / time.Second)
+		}
+
+		if grepRe == nil || grepRe.MatchString(e.Command) {
+			matched[e.Session] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*SessionInfo{}
+	for name, s := range sessions {
+		if matched[name] {
+			ret = append(ret, s)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].Last.Equal(ret[j].Last) {
+			return ret[i].Last.Before(ret[j].Last) != arg.Reverse
+		}
+		return ret[i].Session < ret[j].Session
+	})
+	return ret, nil
+}
+
+// ListSessions prints the sessions of the command log. The output is either
+// a line per session or a JSON array.
+func ListSessions(reader LineReader, arg SessionsArgs) error {
+	if arg.Now == (time.Time{}) {
+		arg.Now = time.Now()
+	}
+
+	sessions, err := CollectSessions(reader, arg)
+	if err != nil {
+		return err
+	}
+
+	if arg.JSON {
+		enc := json.NewEncoder(arg.Output)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sessions)
+	}
+
+	out := bufio.NewWriter(arg.Output)
+	for _, s := range sessions {
+		line := s.Session + "\t" +
+			FormatTime(s.First.Unix(), arg.Now) + "\t" +
+			FormatTime(s.Last.Unix(), arg.Now) + "\t" +
+			FormatDuration(time.Duration(s.Duration)*time.Second) + "\t" +
+			strconv.Itoa(s.Commands) + "\t" + s.Pwd
+		if s.Exited {
+			line += "\texited"
+		}
+		_, err = out.WriteString(line + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
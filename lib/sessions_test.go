@@ -0,0 +1,66 @@
+package cmdlib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var sessionsTestData = `1000	z1	Started shell session: /work
+1100	z1	cd project
+1200	z2	make
+1300	z1	Exited shell session
+1400	z2	go test
+`
+
+func TestListSessions(t *testing.T) {
+	now := time.Unix(2000, 0)
+	tests := []struct {
+		name    string
+		arg     SessionsArgs
+		output  string
+		wantErr bool
+	}{
+		{"Invalid regexp", SessionsArgs{Grep: "["}, "", true},
+		{"All", SessionsArgs{},
+			"z1\t16m 40s ago\t11m 40s ago\t5m\t3\t/work/project\texited\n" +
+				"z2\t13m 20s ago\t10m ago\t3m 20s\t2\t" + homeDir + "\n",
+			false},
+		{"Reverse", SessionsArgs{Reverse: true},
+			"z2\t13m 20s ago\t10m ago\t3m 20s\t2\t" + homeDir + "\n" +
+				"z1\t16m 40s ago\t11m 40s ago\t5m\t3\t/work/project\texited\n",
+			false},
+		{"Grep", SessionsArgs{Grep: "go test"},
+			"z2\t13m 20s ago\t10m ago\t3m 20s\t2\t" + homeDir + "\n",
+			false},
+		{"Since", SessionsArgs{Since: time.Unix(1250, 0).Format(timeFormat)},
+			"z1\t11m 40s ago\t11m 40s ago\t0s\t1\t/work/project\texited\n" +
+				"z2\t10m ago\t10m ago\t0s\t1\t" + homeDir + "\n",
+			false},
+		{"JSON", SessionsArgs{JSON: true, Grep: "project"}, `[
+  {
+    "session": "z1",
+    "first": "` + time.Unix(1000, 0).Format(time.RFC3339) + `",
+    "last": "` + time.Unix(1300, 0).Format(time.RFC3339) + `",
+    "duration": 300,
+    "commands": 3,
+    "pwd": "/work/project",
+    "exited": true
+  }
+]
+`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &testLineReader{buf: bytes.NewBufferString(sessionsTestData)}
+			buf := &bytes.Buffer{}
+			tt.arg.Output = buf
+			tt.arg.Now = now
+			err := ListSessions(input, tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ListSessions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			compare(t, "Outputs differ", tt.output, buf.String())
+		})
+	}
+}
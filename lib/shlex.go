@@ -0,0 +1,229 @@
+package cmdlib
+
+import (
+	"strings"
+)
+
+// shellToken is a word or an operator of a shell command line
+type shellToken struct {
+	// The word with quotes and escapes removed, or the operator
+	Value string
+
+	// Operator is set if the token is a control or a redirection operator
+	Operator bool
+
+	// Quoted is set if any part of the word was quoted or escaped
+	Quoted bool
+
+	// Tilde is set if the word starts with an unquoted ~
+	Tilde bool
+}
+
+// isRedirection returns true if the token is a redirection operator. The
+// following word is the target of the redirection.
+func (t *shellToken) isRedirection() bool {
+	return t.Operator && strings.ContainsAny(t.Value, "<>")
+}
+
+// isSeparator returns true if the token separates simple commands.
+func (t *shellToken) isSeparator() bool {
+	switch {
+	case !t.Operator:
+		return false
+	case t.isRedirection():
+		return false
+	case t.Value == "(" || t.Value == ")":
+		return false
+	}
+	return true
+}
+
+var shellOperators = []string{
+	// The longest operators first
+	"&&", "||", ";;", "|&", ">>", "<<", ">&", "<&", "&>", ">|",
+	";", "&", "|", "(", ")", "<", ">", "\n",
+}
+
+func isShellBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// expandShellVariable expands the $HOME variable. Other variables are kept
+// as they are as their values are not known.
+func expandShellVariable(s string) (value string, length int) {
+	for _, v := range []string{"${HOME}", "$HOME"} {
+		if strings.HasPrefix(s, v) {
+			if v == "$HOME" && len(s) > len(v) {
+				c := s[len(v)]
+				if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+					c >= '0' && c <= '9' {
+					break
+				}
+			}
+			return homeDir, len(v)
+		}
+	}
+	return "$", 1
+}
+
+// splitShell splits a command line to words and operators like a POSIX
+// shell does. Quotes and escapes are removed from the words and comments are
+// dropped. Unterminated quotes extend to the end of the command line.
+func splitShell(cmd string) []shellToken {
+	var ret []shellToken
+
+	word := strings.Builder{}
+	inWord := false
+	tok := shellToken{}
+
+	endWord := func() {
+		if inWord {
+			tok.Value = word.String()
+			ret = append(ret, tok)
+		}
+		word.Reset()
+		inWord = false
+		tok = shellToken{}
+	}
+
+	for i := 0; i < len(cmd); {
+		c := cmd[i]
+
+		switch {
+		case isShellBlank(c):
+			endWord()
+			i++
+			continue
+		case c == '#' && !inWord:
+			// Comment until the end of the line
+			for i < len(cmd) && cmd[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '\\':
+			inWord = true
+			tok.Quoted = true
+			if i+1 < len(cmd) && cmd[i+1] != '\n' {
+				word.WriteByte(cmd[i+1])
+			}
+			i += 2
+			continue
+		case c == '\'':
+			inWord = true
+			tok.Quoted = true
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				end = len(cmd) - i - 1
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 2
+			continue
+		case c == '"':
+			inWord = true
+			tok.Quoted = true
+			i++
+			for i < len(cmd) && cmd[i] != '"' {
+				switch {
+				case cmd[i] == '\\' && i+1 < len(cmd) &&
+					strings.IndexByte("$`\"\\\n", cmd[i+1]) >= 0:
+					if cmd[i+1] != '\n' {
+						word.WriteByte(cmd[i+1])
+					}
+					i += 2
+				case cmd[i] == '$':
+					value, length := expandShellVariable(cmd[i:])
+					word.WriteString(value)
+					i += length
+				default:
+					word.WriteByte(cmd[i])
+					i++
+				}
+			}
+			i++
+			continue
+		case c == '$':
+			value, length := expandShellVariable(cmd[i:])
+			inWord = true
+			word.WriteString(value)
+			i += length
+			continue
+		case c == '~' && !inWord:
+			inWord = true
+			tok.Tilde = true
+			word.WriteByte(c)
+			i++
+			continue
+		}
+
+		op := ""
+		for _, o := range shellOperators {
+			if strings.HasPrefix(cmd[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			inWord = true
+			word.WriteByte(c)
+			i++
+			continue
+		}
+
+		// A file descriptor number before a redirection is part of it
+		fd := ""
+		if strings.ContainsAny(op, "<>") && inWord && !tok.Quoted &&
+			strings.Trim(word.String(), "0123456789") == "" {
+			fd = word.String()
+			word.Reset()
+			inWord = false
+			tok = shellToken{}
+		}
+		endWord()
+		ret = append(ret, shellToken{Value: fd + op, Operator: true})
+		i += len(op)
+	}
+	endWord()
+
+	return ret
+}
+
+// shellComment returns the text of the comment at the end of the command
+// line without the #. It is empty if there is no comment.
+func shellComment(cmd string) string {
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case isShellBlank(c) || c == '\n' || c == ';' || c == '&' ||
+			c == '|' || c == '(' || c == ')':
+			inWord = false
+		case c == '#' && !inWord:
+			end := strings.IndexByte(cmd[i:], '\n')
+			if end < 0 {
+				return strings.TrimSpace(cmd[i+1:])
+			}
+			i += end
+			inWord = false
+		case c == '\\':
+			inWord = true
+			i++
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return ""
+			}
+			i += end + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(cmd) && cmd[i] != '"'; i++ {
+				if cmd[i] == '\\' {
+					i++
+				}
+			}
+		default:
+			inWord = true
+		}
+	}
+	return ""
+}
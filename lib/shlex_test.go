@@ -0,0 +1,50 @@
+package cmdlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_splitShell(t *testing.T) {
+	// Operators are shown in brackets and quoted words with a Q prefix
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"", ""},
+		{"ls", "ls"},
+		{"  ls   -la  ", "ls -la"},
+		{`echo "a b" 'c d' e\ f`, "echo Qa b Qc d Qe f"},
+		{`echo "a \"b\" \$c"`, `echo Qa "b" $c`},
+		{`echo 'unterminated`, "echo Qunterminated"},
+		{"a;b&&c||d|e&f", "a [;] b [&&] c [||] d [|] e [&] f"},
+		{"(cd a; b)", "[(] cd a [;] b [)]"},
+		{"make 2>&1 >log", "make [2>&] 1 [>] log"},
+		{"cat <in >>out", "cat [<] in [>>] out"},
+		{"echo 2 > x", "echo 2 [>] x"},
+		{"ls # comment", "ls"},
+		{"echo a#b", "echo a#b"},
+		{"a\nb", "a [\n] b"},
+		{"cd ~/x ~ a~", "cd T~/x T~ a~"},
+		{"echo $HOME ${HOME} $HOMEX", "echo " + homeDir + " " + homeDir + " $HOMEX"},
+		{"echo '$HOME'", "echo Q$HOME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			parts := []string{}
+			for _, tok := range splitShell(tt.cmd) {
+				switch {
+				case tok.Operator:
+					parts = append(parts, "["+tok.Value+"]")
+				case tok.Quoted:
+					parts = append(parts, "Q"+tok.Value)
+				case tok.Tilde:
+					parts = append(parts, "T"+tok.Value)
+				default:
+					parts = append(parts, tok.Value)
+				}
+			}
+			compare(t, "Tokens differ", tt.want, strings.Join(parts, " "))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package cmdlib
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// StarFilter selects the entries of the report by their star
+type StarFilter int
+
+const (
+	// AllEntries displays both starred and unstarred entries
+	AllEntries StarFilter = iota
+
+	// StarredOnly displays only starred entries
+	StarredOnly
+
+	// UnstarredOnly displays only entries without a star
+	UnstarredOnly
+)
+
+// StarStore stores the IDs of starred entries in a sidecar file next to the
+// log. Each line of the file is an entry ID to star, or an ID prefixed with -
+// to remove the star. The file is only appended to. As the IDs depend only
+// on the time and the command, the stars stay valid when the log is
+// rewritten or rotated.
+type StarStore struct {
+	File string
+
+	stars map[string]bool
+}
+
+// StarFile returns the name of the file where the starred entries of the log
+// are stored.
+func (l *Log) StarFile() string {
+	return l.LogFile + ".stars"
+}
+
+// LoadStarStore loads the stars from the given file. A missing file is an
+// empty store.
+func LoadStarStore(file string) (*StarStore, error) {
+	ret := &StarStore{
+		File:  file,
+		stars: make(map[string]bool),
+	}
+
+	fp, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		ret.set(strings.TrimSpace(scanner.Text()))
+	}
+	return ret, scanner.Err()
+}
+
+func (s *StarStore) set(line string) {
+	switch {
+	case line == "":
+	case strings.HasPrefix(line, "-"):
+		delete(s.stars, line[1:])
+	default:
+		s.stars[line] = true
+	}
+}
+
+// Star adds or removes the star of the entry with the given ID.
+func (s *StarStore) Star(id string, star bool) error {
+	line := id
+	if !star {
+		line = "-" + id
+	}
+
+	fp, err := os.OpenFile(s.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = fp.WriteString(line + "\n")
+	if err != nil {
+		return err
+	}
+	s.set(line)
+	return fp.Close()
+}
+
+// IsStarred returns true if the entry with the given ID is starred. The
+// store can be nil.
+func (s *StarStore) IsStarred(id string) bool {
+	if s == nil {
+		return false
+	}
+	return s.stars[id]
+}
+
+// Keep returns a function for RetentionPolicy.Keep that keeps the starred
+// entries.
+func (s *StarStore) Keep() func(timeint int64, session, cmd string) bool {
+	return func(timeint int64, session, cmd string) bool {
+		return s.IsStarred(EntryID(timeint, cmd))
+	}
+}
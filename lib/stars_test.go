@@ -0,0 +1,137 @@
+package cmdlib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStarStore(t *testing.T) {
+	testdir := "test-stars"
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	file := filepath.Join(testdir, "stars")
+	store, err := LoadStarStore(file)
+	if err != nil {
+		t.Fatal("Loading a missing store failed:", err)
+	}
+
+	a := EntryID(1000, "make")
+	b := EntryID(1001, "go test")
+	for _, star := range []struct {
+		id   string
+		star bool
+	}{{a, true}, {b, true}, {a, false}, {a, true}, {b, false}} {
+		err = store.Star(star.id, star.star)
+		if err != nil {
+			t.Fatal("Starring failed:", err)
+		}
+	}
+	compare(t, "Star of a differs", true, store.IsStarred(a))
+	compare(t, "Star of b differs", false, store.IsStarred(b))
+
+	store, err = LoadStarStore(file)
+	if err != nil {
+		t.Fatal("Loading failed:", err)
+	}
+	compare(t, "Loaded star of a differs", true, store.IsStarred(a))
+	compare(t, "Loaded star of b differs", false, store.IsStarred(b))
+
+	keep := store.Keep()
+	compare(t, "Starred entry should be kept", true, keep(1000, "host:s1", "make"))
+	compare(t, "Unstarred entry should not be kept", false, keep(1001, "s1", "go test"))
+
+	var nilStore *StarStore
+	compare(t, "Nil store should not have stars", false, nilStore.IsStarred(a))
+}
+
+func TestParseCmdLogStarred(t *testing.T) {
+	data := "1000\ts1\tmake\n1001\ts1\tgo test\n1002\ts1\tls\n"
+	store := &StarStore{stars: map[string]bool{
+		EntryID(1001, "go test"): true,
+	}}
+
+	tests := []struct {
+		name    string
+		starred StarFilter
+		output  string
+	}{
+		{"All", AllEntries, "make\ngo test\nls\n"},
+		{"Starred only", StarredOnly, "go test\n"},
+		{"Unstarred only", UnstarredOnly, "make\nls\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := ScanCmdLog(&testLineReader{buf: bytes.NewBufferString(data)}, ParseArgs{
+				Stars:   store,
+				Starred: tt.starred,
+				Control: controlArgs{Now: time.Unix(1002, 0)},
+			}, func(e *Entry) error {
+				compare(t, "Starred differs", e.Command == "go test", e.Starred)
+				buf.WriteString(e.Command + "\n")
+				return nil
+			})
+			if err != nil {
+				t.Fatal("ScanCmdLog failed:", err)
+			}
+			compare(t, "Output differs", tt.output, buf.String())
+		})
+	}
+}
+
+func TestParseCmdLogStarredFirst(t *testing.T) {
+	data := "1000\ts1\tmake\n1001\ts1\tgo test\n1002\ts1\tls\n"
+	store := &StarStore{stars: map[string]bool{
+		EntryID(1001, "go test"): true,
+	}}
+	open := func() (LineReader, error) {
+		return &testLineReader{buf: bytes.NewBufferString(data)}, nil
+	}
+
+	tests := []struct {
+		name   string
+		limit  int
+		offset int
+		output string
+	}{
+		{"All", 0, 0, "go test,make,ls"},
+		{"Limit", 2, 0, "go test,make"},
+		{"Offset", 0, 1, "make,ls"},
+		{"Only starred", 1, 0, "go test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := ParseCmdLogStarredFirst(open, ParseArgs{
+				Session: "s1",
+				Stars:   store,
+				Limit:   tt.limit,
+				Offset:  tt.offset,
+				Control: controlArgs{Now: time.Unix(1002, 0)},
+				Output:  buf,
+			})
+			if err != nil {
+				t.Fatal("ParseCmdLogStarredFirst failed:", err)
+			}
+			got := []string{}
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				if i := strings.Index(line, "\t"); i >= 0 {
+					got = append(got, line[i+1:])
+				}
+			}
+			compare(t, "Output differs", tt.output, strings.Join(got, ","))
+		})
+	}
+}
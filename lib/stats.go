@@ -0,0 +1,123 @@
+package cmdlib
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsArgs are the arguments for the CountPrograms function
+type StatsArgs struct {
+	Session string
+	Since   string
+
+	// Count the subcommands of this program instead of the programs. The
+	// subcommand is the first argument that is not an option.
+	Program string
+
+	// Display at most this many programs. Zero displays all.
+	Limit int
+
+	Output io.Writer
+}
+
+// ProgramCount is the number of times a program was run
+type ProgramCount struct {
+	Name  string
+	Count int
+}
+
+// The options of common programs that take an argument before the
+// subcommand
+var subcommandArgOptions = map[string][]string{
+	"git":     {"-C", "-c", "--git-dir", "--work-tree", "--namespace"},
+	"kubectl": {"-n", "--namespace", "--context", "--cluster", "--kubeconfig", "-s", "--server"},
+	"docker":  {"-H", "--host", "-c", "--context", "--config", "-l", "--log-level"},
+	"go":      {"-C"},
+}
+
+// subcommand returns the program and its first argument that is not an
+// option
+func subcommand(c ShellCommand) string {
+	argOptions := subcommandArgOptions[c.Program]
+	for i := 0; i < len(c.Args); i++ {
+		arg := c.Args[i]
+		if !strings.HasPrefix(arg, "-") {
+			return c.Program + " " + arg
+		}
+		for _, opt := range argOptions {
+			if arg == opt {
+				// Skip the argument of the option
+				i++
+				break
+			}
+		}
+	}
+	return c.Program
+}
+
+// CountPrograms reads the command log and returns how many times each
+// program was run, the most common first. A program run many times on the
+// same command line is counted each time.
+func CountPrograms(reader LineReader, arg StatsArgs) ([]ProgramCount, error) {
+	counts := make(map[string]int)
+	pa := ParseArgs{
+		Session: arg.Session,
+		Since:   arg.Since,
+		Program: arg.Program,
+	}
+	err := ScanCmdLog(reader, pa, func(e *Entry) error {
+		// The lines logged at the start and exit of a session are not
+		// commands
+		if _, start := sessionStart(e.Command); start ||
+			e.Command == sessionExitCommand {
+			return nil
+		}
+		for _, c := range ParseCommands(e.Command) {
+			switch {
+			case arg.Program == "":
+				counts[c.Program]++
+			case c.Program == arg.Program:
+				counts[subcommand(c)]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]ProgramCount, 0, len(counts))
+	for name, count := range counts {
+		ret = append(ret, ProgramCount{Name: name, Count: count})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	if arg.Limit > 0 && len(ret) > arg.Limit {
+		ret = ret[:arg.Limit]
+	}
+	return ret, nil
+}
+
+// PrintStats prints the number of times each program was run
+func PrintStats(reader LineReader, arg StatsArgs) error {
+	counts, err := CountPrograms(reader, arg)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(arg.Output)
+	for _, c := range counts {
+		_, err = out.WriteString(strconv.Itoa(c.Count) + "\t" + c.Name + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,43 @@
+package cmdlib
+
+import (
+	"bytes"
+	"testing"
+)
+
+var statsTestData = `900	z1	Started shell session: /tmp
+1000	z1	git status
+1100	z1	sudo git -C src commit -m git
+1200	z2	make && git status | less
+1300	z2	git
+1400	z1	kubectl get pods
+1450	z2	g\it status
+1500	z1	Exited shell session
+`
+
+func TestPrintStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    StatsArgs
+		output string
+	}{
+		{"Programs", StatsArgs{},
+			"5\tgit\n1\tkubectl\n1\tless\n1\tmake\n"},
+		{"Limit", StatsArgs{Limit: 2}, "5\tgit\n1\tkubectl\n"},
+		{"Session", StatsArgs{Session: "z2"}, "3\tgit\n1\tless\n1\tmake\n"},
+		{"Subcommands", StatsArgs{Program: "git"},
+			"3\tgit status\n1\tgit\n1\tgit commit\n"},
+		{"Unknown program", StatsArgs{Program: "docker"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			tt.arg.Output = out
+			err := PrintStats(&testLineReader{buf: bytes.NewBufferString(statsTestData)}, tt.arg)
+			if err != nil {
+				t.Fatal("PrintStats failed:", err)
+			}
+			compare(t, "Output differs", tt.output, out.String())
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package cmdlib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The storage formats of the command log
+const (
+	// FormatText is a file of tab separated log lines
+	FormatText = "text"
+
+	// FormatBinary is a directory of binary segment files, see binstore.go
+	FormatBinary = "binary"
+)
+
+// StoreFormats are the supported storage formats
+var StoreFormats = []string{FormatText, FormatBinary}
+
+// The buffer size of the readers of the text store
+const storeLineLength = 160 * 1024
+
+// Store is a storage backend of the command log. The entries are read back
+// as log lines of the text format, so that they can be given to ParseCmdLog
+// and the other functions reading a LineReader.
+type Store interface {
+	// Append adds an entry to the end of the log
+	Append(timeint int64, session string, cmd string) error
+
+	// Scan returns a reader of the whole log in the order the entries
+	// were appended, or in the reverse order
+	Scan(reverse bool) (LineReader, error)
+
+	// Range is like Scan but returns only the entries with timestamps
+	// in [since, until). Lines that are not valid entries are returned
+	// as they are.
+	Range(since, until int64, reverse bool) (LineReader, error)
+
+	// Close closes the files opened by the store
+	Close() error
+}
+
+// lockFunc takes a lock on the log, see Log.lock. A nil lockFunc means that
+// the caller already holds an exclusive lock.
+type lockFunc func(exclusive bool) (unlock func() error, err error)
+
+// StoreFormat returns the format of the command log in the given file. The
+// binary store is a directory and anything else is a text log.
+func StoreFormat(file string) string {
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		return FormatBinary
+	}
+	return FormatText
+}
+
+// OpenStore opens the storage of the log in the given format. If format is
+// empty, it is detected with StoreFormat.
+func (l *Log) OpenStore(format string) (Store, error) {
+	return openStore(l.LogFile, format, l.lock)
+}
+
+func openStore(file, format string, lock lockFunc) (Store, error) {
+	if format == "" {
+		format = StoreFormat(file)
+	}
+	switch format {
+	case FormatText:
+		return &textStore{file: file, lock: lock}, nil
+	case FormatBinary:
+		return &binaryStore{dir: file, lock: lock}, nil
+	}
+	return nil, fmt.Errorf("unknown log format \"%s\", expected one of: %s",
+		format, strings.Join(StoreFormats, ", "))
+}
+
+// textStore is the log in a single file of tab separated lines
+type textStore struct {
+	file string
+	lock lockFunc
+
+	// The file opened for appending
+	out *os.File
+
+	// The files opened for reading
+	in []*os.File
+}
+
+func (s *textStore) Append(timeint int64, session string, cmd string) error {
+	// The log directory is created on the first append
+	err := os.MkdirAll(filepath.Dir(s.file), 0700)
+	if err != nil {
+		return err
+	}
+
+	if s.lock != nil {
+		unlock, err := s.lock(false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if s.out == nil {
+		s.out, err = os.OpenFile(s.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(s.out, formatLogLine(timeint, session, cmd))
+	return err
+}
+
+func (s *textStore) Scan(reverse bool) (LineReader, error) {
+	fp, err := os.Open(s.file)
+	if err != nil {
+		return nil, err
+	}
+	s.in = append(s.in, fp)
+
+	if reverse {
+		r, err := NewReverseReader(fp, storeLineLength)
+		if err != nil {
+			return nil, err
+		}
+		r.LongLines = LongLineTruncate
+		r.Warn = warnLongLine
+		return r, nil
+	}
+	return NewBufferedReader(fp, storeLineLength), nil
+}
+
+func (s *textStore) Range(since, until int64, reverse bool) (LineReader, error) {
+	r, err := s.Scan(reverse)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{reader: r, since: since, until: until}, nil
+}
+
+func (s *textStore) Close() error {
+	var ret error
+	for _, fp := range s.in {
+		if err := fp.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	s.in = nil
+	if s.out != nil {
+		if err := s.out.Close(); err != nil && ret == nil {
+			ret = err
+		}
+		s.out = nil
+	}
+	return ret
+}
+
+// rangeReader returns the lines of the reader whose timestamps are in
+// [since, until) and the lines that are not valid entries
+type rangeReader struct {
+	reader LineReader
+	since  int64
+	until  int64
+}
+
+func (r *rangeReader) ReadLine() (string, error) {
+	for {
+		line, err := r.reader.ReadLine()
+		if line != "" {
+			timeint, _, _, serr := SplitLogLine(line)
+			if serr != nil || timeint >= r.since && timeint < r.until {
+				return line, err
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// CopyStore appends the entries read from the reader to the store. Lines
+// that are not valid log lines are skipped. Returns the numbers of copied
+// and skipped lines.
+func CopyStore(to Store, from LineReader) (copied, skipped int, err error) {
+	err = ForEachLine(from, func(line string) error {
+		timeint, session, cmd, err := SplitLogLine(line)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		copied++
+		return to.Append(timeint, session, cmd)
+	})
+	return copied, skipped, err
+}
+
+// Convert copies the log to the given format. If output is empty, the log
+// is replaced with the converted one and the previous log is kept in
+// BackupFile. Otherwise the converted log is written to output, which must
+// not exist. Returns the numbers of copied and skipped lines.
+func (l *Log) Convert(format, output string) (copied, skipped int, err error) {
+	if output != "" && FileExists(output) {
+		return 0, 0, fmt.Errorf("file %s already exists", output)
+	}
+	if output == "" && format == StoreFormat(l.LogFile) {
+		return 0, 0, fmt.Errorf("the log is already in the %s format", format)
+	}
+
+	// Appending waits until the converted log is in place
+	unlock, err := l.lock(output == "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	from, err := openStore(l.LogFile, "", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer from.Close()
+	r, err := from.Scan(false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	target := output
+	tmpDir := ""
+	if output == "" {
+		tmpDir, err = ioutil.TempDir(filepath.Dir(l.LogFile),
+			filepath.Base(l.LogFile)+".tmp")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer os.RemoveAll(tmpDir)
+		target = filepath.Join(tmpDir, "log")
+	}
+
+	to, err := openStore(target, format, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	copied, skipped, err = CopyStore(to, r)
+	cerr := to.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if output != "" {
+			os.RemoveAll(output)
+		}
+		return 0, 0, err
+	}
+
+	if output == "" {
+		err = linkOrCopy(l.LogFile, l.BackupFile())
+		if err != nil {
+			return 0, 0, err
+		}
+		err = l.replaceLog(target)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return copied, skipped, nil
+}
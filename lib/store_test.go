@@ -0,0 +1,605 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readAll returns the lines of the reader. The empty line that
+// ReverseReader returns after the final newline is skipped.
+func readAll(t *testing.T, r LineReader) string {
+	sb := strings.Builder{}
+	err := ForEachLine(r, func(line string) error {
+		if line != "\n" {
+			sb.WriteString(line)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Reading failed:", err)
+	}
+	return sb.String()
+}
+
+func TestStores(t *testing.T) {
+	testdir := "test-store"
+
+	entries := []struct {
+		timeint int64
+		session string
+		cmd     string
+	}{
+		{1450120005, "zsh-1", "go test"},
+		{1450120010, "zsh-2", "cd /work\tdir"},
+		{1450119990, "zsh-1", ""},
+		{1450120020, "zsh-1", "make"},
+		{1450120030, "zsh-3", "ls -la"},
+	}
+	forward := "1450120005\tzsh-1\tgo test\n" +
+		"1450120010\tzsh-2\tcd /work\tdir\n" +
+		"1450119990\tzsh-1\t\n" +
+		"1450120020\tzsh-1\tmake\n" +
+		"1450120030\tzsh-3\tls -la\n"
+	reverse := "1450120030\tzsh-3\tls -la\n" +
+		"1450120020\tzsh-1\tmake\n" +
+		"1450119990\tzsh-1\t\n" +
+		"1450120010\tzsh-2\tcd /work\tdir\n" +
+		"1450120005\tzsh-1\tgo test\n"
+
+	// Small segments to test appending to several segments
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	segmentSize = 40
+
+	for _, format := range StoreFormats {
+		t.Run(format, func(t *testing.T) {
+			err := os.RemoveAll(testdir)
+			if err != nil {
+				t.Fatal("Could not remove test directory:", err)
+			}
+			defer os.RemoveAll(testdir)
+
+			log := CreateLog(filepath.Join(testdir, "log"), "")
+			// The first entries are appended with separate stores to
+			// test continuing an existing log
+			appendEntries := func(from, to int) {
+				store, err := log.OpenStore(format)
+				if err != nil {
+					t.Fatal("Could not open store:", err)
+				}
+				for _, e := range entries[from:to] {
+					err = store.Append(e.timeint, e.session, e.cmd)
+					if err != nil {
+						t.Fatal("Append failed:", err)
+					}
+				}
+				err = store.Close()
+				if err != nil {
+					t.Fatal("Close failed:", err)
+				}
+			}
+			appendEntries(0, 1)
+			appendEntries(1, 2)
+			appendEntries(2, len(entries))
+			compare(t, "Detected format differs", format, StoreFormat(log.LogFile))
+			if format == FormatBinary {
+				files, err := listSegments(log.LogFile)
+				if err != nil || len(files) < 2 {
+					t.Error("Expected several segments, got:", files, err)
+				}
+			}
+
+			store, err := log.OpenStore("")
+			if err != nil {
+				t.Fatal("Could not open store:", err)
+			}
+			defer store.Close()
+
+			for _, tt := range []struct {
+				name    string
+				since   int64
+				until   int64
+				reverse bool
+				want    string
+			}{
+				{"Forward", minTime, maxTime, false, forward},
+				{"Reverse", minTime, maxTime, true, reverse},
+				{"Range", 1450120000, 1450120020, false,
+					"1450120005\tzsh-1\tgo test\n" +
+						"1450120010\tzsh-2\tcd /work\tdir\n"},
+				{"Reverse range", 1450120010, 1450120031, true,
+					"1450120030\tzsh-3\tls -la\n" +
+						"1450120020\tzsh-1\tmake\n" +
+						"1450120010\tzsh-2\tcd /work\tdir\n"},
+				{"Empty range", 1450120031, maxTime, false, ""},
+			} {
+				var r LineReader
+				if tt.since == minTime && tt.until == maxTime {
+					r, err = store.Scan(tt.reverse)
+				} else {
+					r, err = store.Range(tt.since, tt.until, tt.reverse)
+				}
+				if err != nil {
+					t.Fatal("Scanning failed:", err)
+				}
+				compare(t, tt.name+" differs", tt.want, readAll(t, r))
+			}
+		})
+	}
+}
+
+func TestTextStoreRange(t *testing.T) {
+	r := &rangeReader{
+		reader: &testLineReader{buf: bytes.NewBufferString("garbage\n1\ts\ta\n5\ts\tb\n9\ts\tc\n")},
+		since:  2,
+		until:  9,
+	}
+	compare(t, "Range differs", "garbage\n5\ts\tb\n", readAll(t, r))
+}
+
+func TestBinaryStoreRangeSkipsSegments(t *testing.T) {
+	testdir := "test-binstore-range"
+	dir := filepath.Join(testdir, "log")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	segmentSize = 40
+
+	store := &binaryStore{dir: dir}
+	for i := int64(0); i < 10; i++ {
+		err = store.Append(1450120000+i*10, "zsh-1", "cmd "+strconv.FormatInt(i, 10))
+		if err != nil {
+			t.Fatal("Append failed:", err)
+		}
+	}
+	store.Close()
+
+	files, err := listSegments(dir)
+	if err != nil || len(files) < 3 {
+		t.Fatal("Expected several segments, got:", files, err)
+	}
+	index := readIndex(dir)
+	compare(t, "Index of the first segment differs",
+		[2]int64{1450120000, 1450120020}, index[filepath.Base(files[0])])
+	_, ok := index[filepath.Base(files[len(files)-1])]
+	compare(t, "The last segment should not be indexed", false, ok)
+
+	// An incomplete line of the index is ignored
+	fp, err := os.OpenFile(filepath.Join(dir, indexFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal("Could not open the index:", err)
+	}
+	_, err = fp.WriteString(filepath.Base(files[1]) + "\t0\t1")
+	fp.Close()
+	if err != nil {
+		t.Fatal("Could not write the index:", err)
+	}
+	compare(t, "Index differs", index, readIndex(dir))
+
+	// The first segment is not read if it is out of the range
+	err = ioutil.WriteFile(files[0], []byte("junk"), 0600)
+	if err != nil {
+		t.Fatal("Could not write segment:", err)
+	}
+	r, err := store.Scan(false)
+	if err == nil {
+		err = ForEachLine(r, func(string) error { return nil })
+	}
+	if err == nil {
+		t.Error("Expected an error from reading the corrupted segment")
+	}
+	r, err = store.Range(1450120030, 1450120050, true)
+	if err != nil {
+		t.Fatal("Range failed:", err)
+	}
+	compare(t, "Range differs",
+		"1450120040\tzsh-1\tcmd 4\n1450120030\tzsh-1\tcmd 3\n",
+		readAll(t, r))
+}
+
+func TestBinaryStoreRecovery(t *testing.T) {
+	testdir := "test-binstore"
+	dir := filepath.Join(testdir, "log")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	store := &binaryStore{dir: dir}
+	for _, cmd := range []string{"first", "second"} {
+		err = store.Append(1450120005, "zsh-1", cmd)
+		if err != nil {
+			t.Fatal("Append failed:", err)
+		}
+	}
+	store.Close()
+
+	// An append cut short leaves a partial record at the end
+	segment := segmentName(dir, 1)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal("Could not read segment:", err)
+	}
+	partial := append(data, recordSession, 10, 'z', 's')
+	err = ioutil.WriteFile(segment, partial, 0600)
+	if err != nil {
+		t.Fatal("Could not write segment:", err)
+	}
+
+	want := "1450120005\tzsh-1\tfirst\n1450120005\tzsh-1\tsecond\n"
+	r, err := store.Scan(false)
+	if err != nil {
+		t.Fatal("Scanning failed:", err)
+	}
+	compare(t, "Partial record was not skipped", want, readAll(t, r))
+
+	err = store.Append(1450120010, "zsh-2", "third")
+	if err != nil {
+		t.Fatal("Append failed:", err)
+	}
+	store.Close()
+	r, err = store.Scan(false)
+	if err != nil {
+		t.Fatal("Scanning failed:", err)
+	}
+	compare(t, "Append after a partial record differs",
+		want+"1450120010\tzsh-2\tthird\n", readAll(t, r))
+
+	// Corruption in the middle of the segment is an error
+	data, err = ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal("Could not read segment:", err)
+	}
+	data[len(segmentMagic)] = 'x'
+	err = ioutil.WriteFile(segment, data, 0600)
+	if err != nil {
+		t.Fatal("Could not write segment:", err)
+	}
+	r, err = store.Scan(false)
+	if err != nil {
+		t.Fatal("Scanning failed:", err)
+	}
+	_, err = r.ReadLine()
+	if err == nil || !strings.Contains(err.Error(), "corrupted record") {
+		t.Error("Expected a corruption error, got:", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	testdir := "test-convert"
+	logfile := filepath.Join(testdir, "log")
+
+	logData := "1450120005\tzsh-1\tgo test\n" +
+		"invalid line\n" +
+		"1450120010\tzsh-2\texport PASSWORD=secret\n" +
+		"1450120020\tzsh-1\tmake\n"
+	converted := "1450120005\tzsh-1\tgo test\n" +
+		"1450120010\tzsh-2\texport PASSWORD=secret\n" +
+		"1450120020\tzsh-1\tmake\n"
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+	err = ioutil.WriteFile(logfile, []byte(logData), 0600)
+	if err != nil {
+		t.Fatal("Could not write log:", err)
+	}
+
+	log := CreateLog(logfile, "")
+	readLog := func() string {
+		store, err := log.OpenStore("")
+		if err != nil {
+			t.Fatal("Could not open store:", err)
+		}
+		defer store.Close()
+		r, err := store.Scan(false)
+		if err != nil {
+			t.Fatal("Scanning failed:", err)
+		}
+		return readAll(t, r)
+	}
+
+	_, _, err = log.Convert(FormatText, "")
+	if err == nil {
+		t.Error("Expected an error when converting to the same format")
+	}
+
+	copied, skipped, err := log.Convert(FormatBinary, "")
+	if err != nil {
+		t.Fatal("Converting to binary failed:", err)
+	}
+	compare(t, "Copied count differs", 3, copied)
+	compare(t, "Skipped count differs", 1, skipped)
+	compare(t, "Format differs", FormatBinary, StoreFormat(logfile))
+	compare(t, "Converted log differs", converted, readLog())
+
+	data, err := ioutil.ReadFile(log.BackupFile())
+	if err != nil {
+		t.Fatal("Could not read backup:", err)
+	}
+	compare(t, "Backup differs", logData, string(data))
+
+	// Rewriting the binary store
+	removed, err := log.Forget(ForgetArgs{Grep: "PASSWORD", Backup: true})
+	if err != nil {
+		t.Fatal("Forget failed:", err)
+	}
+	compare(t, "Removed count differs", 1, removed)
+	compare(t, "Log after forget differs",
+		"1450120005\tzsh-1\tgo test\n1450120020\tzsh-1\tmake\n", readLog())
+	compare(t, "Backup format differs", FormatBinary, StoreFormat(log.BackupFile()))
+
+	output := filepath.Join(testdir, "output")
+	_, _, err = log.Convert(FormatText, output)
+	if err != nil {
+		t.Fatal("Converting to a text file failed:", err)
+	}
+	data, err = ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal("Could not read output:", err)
+	}
+	compare(t, "Output differs",
+		"1450120005\tzsh-1\tgo test\n1450120020\tzsh-1\tmake\n", string(data))
+
+	_, _, err = log.Convert(FormatText, output)
+	if err == nil {
+		t.Error("Expected an error when the output exists")
+	}
+
+	err = log.AppendLine("zsh-3", "go build")
+	if err != nil {
+		t.Fatal("AppendLine failed:", err)
+	}
+	if !strings.HasSuffix(readLog(), "\tzsh-3\tgo build\n") {
+		t.Error("AppendLine did not append to the binary store")
+	}
+}
+
+func TestReplaceLog(t *testing.T) {
+	testdir := "test-replace"
+	log := CreateLog(filepath.Join(testdir, "log"), "")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(log.LogFile, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+	err = ioutil.WriteFile(filepath.Join(log.LogFile, "data"), []byte("old"), 0600)
+	if err != nil {
+		t.Fatal("Could not write log:", err)
+	}
+
+	// The log is kept if the new log can not be moved in its place
+	err = log.replaceLog(filepath.Join(testdir, "missing"))
+	if err == nil {
+		t.Error("Expected an error when the new log is missing")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(log.LogFile, "data"))
+	if err != nil {
+		t.Fatal("The log was lost:", err)
+	}
+	compare(t, "Log differs", "old", string(data))
+
+	newLog := filepath.Join(testdir, "new")
+	err = ioutil.WriteFile(newLog, []byte("new"), 0600)
+	if err != nil {
+		t.Fatal("Could not write new log:", err)
+	}
+	err = log.replaceLog(newLog)
+	if err != nil {
+		t.Fatal("Replacing failed:", err)
+	}
+	data, err = ioutil.ReadFile(log.LogFile)
+	if err != nil {
+		t.Fatal("Could not read log:", err)
+	}
+	compare(t, "Replaced log differs", "new", string(data))
+	if FileExists(log.LogFile + ".previous") {
+		t.Error("The previous log was not removed")
+	}
+}
+
+func TestBinaryStoreState(t *testing.T) {
+	testdir := "test-binstore-state"
+	dir := filepath.Join(testdir, "log")
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	appendEntry := func(timeint int64, session, cmd string) {
+		store := &binaryStore{dir: dir}
+		err := store.Append(timeint, session, cmd)
+		if err != nil {
+			t.Fatal("Append failed:", err)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Fatal("Close failed:", err)
+		}
+	}
+	readStore := func() string {
+		store := &binaryStore{dir: dir}
+		r, err := store.Scan(false)
+		if err != nil {
+			t.Fatal("Scanning failed:", err)
+		}
+		return readAll(t, r)
+	}
+	state := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+		if err != nil {
+			t.Fatal("Could not read state:", err)
+		}
+		return string(data)
+	}
+
+	appendEntry(1450120005, "zsh-1", "first")
+	compare(t, "State differs", "00000001.seg\t28\t1450120005\nzsh-1\n", state())
+
+	// Appending uses the state instead of decoding the segment, so the
+	// session record is not repeated
+	appendEntry(1450120010, "zsh-1", "second")
+	compare(t, "State differs", "00000001.seg\t38\t1450120010\nzsh-1\n", state())
+	appendEntry(1450120020, "zsh-2", "third")
+	compare(t, "Entries differ",
+		"1450120005\tzsh-1\tfirst\n"+
+			"1450120010\tzsh-1\tsecond\n"+
+			"1450120020\tzsh-2\tthird\n", readStore())
+
+	// A state that does not match the segment is not used
+	err = ioutil.WriteFile(filepath.Join(dir, stateFile),
+		[]byte("00000001.seg\t38\t1450120010\nzsh-1\n"), 0600)
+	if err != nil {
+		t.Fatal("Could not write state:", err)
+	}
+	appendEntry(1450120030, "zsh-2", "fourth")
+	compare(t, "Entries after a stale state differ",
+		"1450120005\tzsh-1\tfirst\n"+
+			"1450120010\tzsh-1\tsecond\n"+
+			"1450120020\tzsh-2\tthird\n"+
+			"1450120030\tzsh-2\tfourth\n", readStore())
+
+	// More sessions than fit to the dictionary
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal("Could not remove store:", err)
+	}
+	want := ""
+	for i := 0; i < 2*maxRecentSessions; i++ {
+		session := "zsh-" + strconv.Itoa(i%(maxRecentSessions+3))
+		appendEntry(1450120005, session, "ls")
+		want += "1450120005\t" + session + "\tls\n"
+	}
+	compare(t, "Entries of many sessions differ", want, readStore())
+}
+
+// benchmarkStore creates a log in the given format with the given number of
+// commands from three interleaved sessions at a time. Returns the log and
+// its size in bytes.
+func benchmarkStore(b *testing.B, dir, format string, count int) (*Log, int64) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		b.Fatal("Could not remove test directory:", err)
+	}
+	log := CreateLog(filepath.Join(dir, "log"), "")
+	store, err := log.OpenStore(format)
+	if err != nil {
+		b.Fatal("Could not open store:", err)
+	}
+	cmds := []string{"git status", "make -j8 all", "cd /work/project",
+		"go test ./...", "vim main.go"}
+	for i := 0; i < count; i++ {
+		session := "zsh-" + strconv.Itoa(10000+i/500*3+i%3) + "-20210408"
+		err = store.Append(1600000000+int64(i)*7, session,
+			cmds[i%len(cmds)]+" "+strconv.Itoa(i))
+		if err != nil {
+			b.Fatal("Append failed:", err)
+		}
+	}
+	err = store.Close()
+	if err != nil {
+		b.Fatal("Close failed:", err)
+	}
+
+	var size int64
+	err = filepath.Walk(log.LogFile, func(path string, info os.FileInfo, err error) error {
+		name := filepath.Base(path)
+		if err == nil && !info.IsDir() && name != stateFile && name != indexFile {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		b.Fatal("Could not determine the size:", err)
+	}
+	return log, size
+}
+
+// benchmarkStoreScan scans the whole log with ScanCmdLog. The size of the
+// log is reported per command.
+func benchmarkStoreScan(b *testing.B, format string) {
+	const count = 200000
+	dir := "test-bench-scan-" + format
+	log, size := benchmarkStore(b, dir, format, count)
+	defer os.RemoveAll(dir)
+
+	b.ResetTimer()
+	b.ReportMetric(float64(size)/count, "B/cmd")
+	for i := 0; i < b.N; i++ {
+		store, err := log.OpenStore("")
+		if err != nil {
+			b.Fatal("Could not open store:", err)
+		}
+		r, err := store.Scan(false)
+		if err == nil {
+			err = ScanCmdLog(r, ParseArgs{}, func(e *Entry) error { return nil })
+		}
+		store.Close()
+		if err != nil {
+			b.Fatal("Scanning failed:", err)
+		}
+	}
+}
+
+// benchmarkStoreAppend appends to a log with a new store each time like the
+// log command does
+func benchmarkStoreAppend(b *testing.B, format string) {
+	dir := "test-bench-append-" + format
+	log, _ := benchmarkStore(b, dir, format, 50000)
+	defer os.RemoveAll(dir)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store, err := log.OpenStore("")
+		if err != nil {
+			b.Fatal("Could not open store:", err)
+		}
+		err = store.Append(1700000000+int64(i), "zsh-1-20210408", "go build")
+		if err == nil {
+			err = store.Close()
+		}
+		if err != nil {
+			b.Fatal("Append failed:", err)
+		}
+	}
+}
+
+func BenchmarkStoreScan_Text(b *testing.B) {
+	benchmarkStoreScan(b, FormatText)
+}
+
+func BenchmarkStoreScan_Binary(b *testing.B) {
+	benchmarkStoreScan(b, FormatBinary)
+}
+
+func BenchmarkStoreAppend_Text(b *testing.B) {
+	benchmarkStoreAppend(b, FormatText)
+}
+
+func BenchmarkStoreAppend_Binary(b *testing.B) {
+	benchmarkStoreAppend(b, FormatBinary)
+}
@@ -0,0 +1,58 @@
+package cmdlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SegmentSuffix is the file name suffix of the per-host segment files in a
+// sync directory.
+const SegmentSuffix = ".cmdlog"
+
+// DefaultHost returns the host name used to identify the segment of this
+// host in a sync directory.
+func DefaultHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}
+
+// SegmentFile returns the file name of the segment of the given host in the
+// sync directory. Each host only appends to its own segment, so syncing the
+// directory never causes write conflicts.
+func SegmentFile(dir, host string) string {
+	host = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(host)
+	return filepath.Join(dir, host+SegmentSuffix)
+}
+
+// SegmentHost returns the host of the given segment file.
+func SegmentHost(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), SegmentSuffix)
+}
+
+// SegmentFiles lists the segment files in the sync directory in sorted
+// order. Hidden files, such as temporary files of the syncing program, are
+// skipped.
+func SegmentFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") ||
+			!strings.HasSuffix(name, SegmentSuffix) {
+			continue
+		}
+		ret = append(ret, filepath.Join(dir, name))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
@@ -0,0 +1,100 @@
+package cmdlib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentFile(t *testing.T) {
+	tests := []struct {
+		dir  string
+		host string
+		want string
+	}{
+		{"dir", "laptop", filepath.Join("dir", "laptop.cmdlog")},
+		{"dir", "bad/host:name", filepath.Join("dir", "bad_host_name.cmdlog")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got := SegmentFile(tt.dir, tt.host)
+			compare(t, "Segment file differs", tt.want, got)
+		})
+	}
+}
+
+func TestSegmentFiles(t *testing.T) {
+	testdir := "test-sync"
+
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(filepath.Join(testdir, "subdir.cmdlog"), 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	for _, name := range []string{"b.cmdlog", "a.cmdlog", "a.cmdlog.lock",
+		".syncthing.c.cmdlog.tmp", ".hidden.cmdlog", "other"} {
+		err = ioutil.WriteFile(filepath.Join(testdir, name), nil, 0600)
+		if err != nil {
+			t.Fatal("Could not create file:", err)
+		}
+	}
+
+	files, err := SegmentFiles(testdir)
+	if err != nil {
+		t.Fatal("Listing segments failed:", err)
+	}
+	compare(t, "Segments differ", []string{
+		filepath.Join(testdir, "a.cmdlog"),
+		filepath.Join(testdir, "b.cmdlog"),
+	}, files)
+
+	compare(t, "Host differs", "a", SegmentHost(files[0]))
+}
+
+func TestMergeReaderReverse(t *testing.T) {
+	// A segment that arrived late contains older entries
+	segments := []struct {
+		data string
+		host string
+	}{
+		{"1\ts\ta1\n5\ts\ta5\n", "a"},
+		{"2\ts\tb2\n3\ts\tb3\n", "late"},
+	}
+
+	inputs := []MergeInput{}
+	for _, seg := range segments {
+		r, err := NewReverseReader(bytes.NewReader([]byte(seg.data)), 64)
+		if err != nil {
+			t.Fatal("Creating reverse reader failed:", err)
+		}
+		inputs = append(inputs, MergeInput{Reader: r, Host: seg.host})
+	}
+
+	r := NewMergeReader(inputs, true, true)
+	lines := []string{}
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Reading failed:", err)
+		}
+		lines = append(lines, line)
+	}
+
+	compare(t, "Lines differ", []string{
+		"5\ta:s\ta5\n",
+		"3\tlate:s\tb3\n",
+		"2\tlate:s\tb2\n",
+		"1\ta:s\ta1\n",
+	}, lines)
+}
@@ -0,0 +1,260 @@
+package cmdlib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EntryID returns an identifier of an entry with the given time and
+// command. It does not depend on the session, so it stays the same when the
+// log is rewritten or merged and when the session is tagged with a host.
+func EntryID(timeint int64, cmd string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(cmd))
+	return fmt.Sprintf("%d-%08x", timeint, h.Sum32())
+}
+
+// ID returns the identifier of the entry. See EntryID.
+func (e *Entry) ID() string {
+	return EntryID(e.Time.Unix(), e.Command)
+}
+
+// HasTag returns true if the entry has the given tag.
+func (e *Entry) HasTag(tag string) bool {
+	tag = strings.TrimPrefix(tag, "@")
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAnnotation parses the tags and the note from a trailing comment of
+// the command of the form "# @tag @other note text". The comment is an
+// annotation only if it starts with a tag.
+func ParseAnnotation(cmd string) (tags []string, note string) {
+	comment := shellComment(cmd)
+	if !strings.HasPrefix(comment, "@") {
+		return nil, ""
+	}
+
+	fields := strings.Fields(comment)
+	i := 0
+	for ; i < len(fields) && strings.HasPrefix(fields[i], "@"); i++ {
+		if tag := strings.TrimPrefix(fields[i], "@"); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, strings.Join(fields[i:], " ")
+}
+
+// annotation is the tags and the note of an entry
+type annotation struct {
+	tags []string
+	note string
+}
+
+// TagStore stores tags and notes of entries in a sidecar file next to the
+// log. Each line of the file has the entry ID, comma separated tags and the
+// note separated by tabs. The file is only appended to. Tags of the lines of
+// an entry are combined and the latest note is used.
+type TagStore struct {
+	File string
+
+	annotations map[string]*annotation
+}
+
+// TagFile returns the name of the file where the tags of the log entries are
+// stored.
+func (l *Log) TagFile() string {
+	return l.LogFile + ".tags"
+}
+
+// LoadTagStore loads the tags from the given file. A missing file is an
+// empty store.
+func LoadTagStore(file string) (*TagStore, error) {
+	ret := &TagStore{
+		File:        file,
+		annotations: make(map[string]*annotation),
+	}
+
+	fp, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		ret.add(fields[0], strings.Split(fields[1], ","), fields[2])
+	}
+	return ret, scanner.Err()
+}
+
+func (s *TagStore) add(id string, tags []string, note string) {
+	a, ok := s.annotations[id]
+	if !ok {
+		a = &annotation{}
+		s.annotations[id] = a
+	}
+	for _, tag := range tags {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "@")
+		if tag == "" {
+			continue
+		}
+		found := false
+		for _, t := range a.tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a.tags = append(a.tags, tag)
+		}
+	}
+	if note != "" {
+		a.note = note
+	}
+}
+
+// Add stores tags and a note for the entry with the given ID.
+func (s *TagStore) Add(id string, tags []string, note string) error {
+	for i := range tags {
+		tags[i] = strings.TrimPrefix(tags[i], "@")
+		if strings.ContainsAny(tags[i], ",\t\n") {
+			return fmt.Errorf("invalid tag: %q", tags[i])
+		}
+	}
+	note = strings.Join(strings.Fields(note), " ")
+
+	fp, err := os.OpenFile(s.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = fp.WriteString(id + "\t" + strings.Join(tags, ",") + "\t" + note + "\n")
+	if err != nil {
+		return err
+	}
+	s.add(id, tags, note)
+	return fp.Close()
+}
+
+// Annotate sets the tags and the note of the entry from its trailing comment
+// and the store. The store can be nil.
+func (s *TagStore) Annotate(e *Entry) {
+	e.Tags, e.Note = ParseAnnotation(e.Command)
+	if s == nil {
+		return
+	}
+	a, ok := s.annotations[e.ID()]
+	if !ok {
+		return
+	}
+	for _, tag := range a.tags {
+		if !e.HasTag(tag) {
+			e.Tags = append(e.Tags, tag)
+		}
+	}
+	if a.note != "" {
+		e.Note = a.note
+	}
+}
+
+// IDs returns the IDs of the entries that have the given tag in the store
+// in sorted order.
+func (s *TagStore) IDs(tag string) []string {
+	ret := []string{}
+	for id, a := range s.annotations {
+		for _, t := range a.tags {
+			if t == tag {
+				ret = append(ret, id)
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		ti, _ := strconv.ParseInt(strings.SplitN(ret[i], "-", 2)[0], 10, 64)
+		tj, _ := strconv.ParseInt(strings.SplitN(ret[j], "-", 2)[0], 10, 64)
+		if ti != tj {
+			return ti < tj
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// FormatAnnotation formats the tags and the note of the entry
+func FormatAnnotation(e *Entry) string {
+	parts := []string{}
+	for _, tag := range e.Tags {
+		parts = append(parts, "@"+tag)
+	}
+	if e.Note != "" {
+		parts = append(parts, e.Note)
+	}
+	return strings.Join(parts, " ")
+}
+
+// isCmdlogCommand returns true if the command runs cmdlog itself or is a
+// session start or exit marker
+func isCmdlogCommand(cmd string) bool {
+	if _, start := sessionStart(cmd); start || cmd == sessionExitCommand {
+		return true
+	}
+	for _, tok := range splitShell(cmd) {
+		if tok.Operator {
+			return false
+		}
+		if strings.Contains(tok.Value, "=") {
+			continue
+		}
+		return filepath.Base(tok.Value) == "cmdlog"
+	}
+	return false
+}
+
+var errEntryFound = errors.New("entry found")
+
+// FindEntry finds an entry from the log by its ID. If the id is "last", the
+// last entry of the session that does not run cmdlog itself is returned, and
+// the session must be given. Otherwise if session is empty, entries of all
+// sessions are searched. The reader should read the log in reverse to find
+// the last entries quickly.
+func FindEntry(reader LineReader, session string, id string) (*Entry, error) {
+	if id == "last" && session == "" {
+		return nil, fmt.Errorf("the session of the last command is not given")
+	}
+	var found *Entry
+	err := ScanCmdLog(reader, ParseArgs{Session: session}, func(e *Entry) error {
+		if id == "last" && !isCmdlogCommand(e.Command) || id == e.ID() {
+			found = e
+			return errEntryFound
+		}
+		return nil
+	})
+	if err != nil && err != errEntryFound {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("entry %s not found", id)
+	}
+	return found, nil
+}
@@ -0,0 +1,147 @@
+package cmdlib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAnnotation(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		tags string
+		note string
+	}{
+		{"make", "", ""},
+		{"make # plain comment", "", ""},
+		{"make # @deploy", "deploy", ""},
+		{"make #@deploy @prod  pushes   it", "deploy,prod", "pushes it"},
+		{"echo '# @notatag'", "", ""},
+		{`echo "# @notatag"`, "", ""},
+		{`echo \# @notatag`, "", ""},
+		{"echo a#@notatag", "", ""},
+		{"a; b # @tag", "tag", ""},
+		{"a # @first\nb # @second", "second", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			tags, note := ParseAnnotation(tt.cmd)
+			compare(t, "Tags differ", tt.tags, strings.Join(tags, ","))
+			compare(t, "Note differs", tt.note, note)
+		})
+	}
+}
+
+func TestEntryID(t *testing.T) {
+	a := Entry{Time: time.Unix(1000, 0), Session: "s1", Command: "make"}
+	b := Entry{Time: time.Unix(1000, 0), Session: "host:s1", Command: "make"}
+	c := Entry{Time: time.Unix(1000, 0), Session: "s1", Command: "make test"}
+
+	compare(t, "ID should not depend on the session", a.ID(), b.ID())
+	if a.ID() == c.ID() {
+		t.Error("IDs of different commands should differ")
+	}
+	if !strings.HasPrefix(a.ID(), "1000-") {
+		t.Error("ID should start with the time:", a.ID())
+	}
+}
+
+func TestTagStore(t *testing.T) {
+	testdir := "test-tags"
+	err := os.RemoveAll(testdir)
+	if err != nil {
+		t.Fatal("Could not remove test directory:", err)
+	}
+	err = os.MkdirAll(testdir, 0755)
+	if err != nil {
+		t.Fatal("Could not create test directory:", err)
+	}
+	defer os.RemoveAll(testdir)
+
+	file := filepath.Join(testdir, "tags")
+	store, err := LoadTagStore(file)
+	if err != nil {
+		t.Fatal("Loading a missing store failed:", err)
+	}
+
+	e := &Entry{Time: time.Unix(1000, 0), Command: "vpn-fix # @net"}
+	other := &Entry{Time: time.Unix(900, 0), Command: "other"}
+
+	err = store.Add(e.ID(), []string{"@vpn"}, "fixes  the VPN")
+	if err != nil {
+		t.Fatal("Adding failed:", err)
+	}
+	err = store.Add(e.ID(), []string{"vpn", "work"}, "")
+	if err != nil {
+		t.Fatal("Adding failed:", err)
+	}
+	err = store.Add(other.ID(), []string{"work"}, "")
+	if err != nil {
+		t.Fatal("Adding failed:", err)
+	}
+	err = store.Add(e.ID(), []string{"bad,tag"}, "")
+	if err == nil {
+		t.Error("Expected error from an invalid tag")
+	}
+
+	store, err = LoadTagStore(file)
+	if err != nil {
+		t.Fatal("Loading failed:", err)
+	}
+	store.Annotate(e)
+	compare(t, "Tags differ", "net,vpn,work", strings.Join(e.Tags, ","))
+	compare(t, "Note differs", "fixes the VPN", e.Note)
+	compare(t, "Annotation differs", "@net @vpn @work fixes the VPN", FormatAnnotation(e))
+	compare(t, "IDs differ", other.ID()+","+e.ID(), strings.Join(store.IDs("work"), ","))
+}
+
+func TestFindEntry(t *testing.T) {
+	data := `1000	s1	make
+1001	s2	go test
+1002	s1	cmdlog tag last x
+1003	s2	Exited shell session
+1004	s3	Started shell session: /tmp
+`
+	find := func(session, id string) string {
+		r, err := NewReverseReader(strings.NewReader(data), 1024)
+		if err != nil {
+			t.Fatal("Creating reverse reader failed:", err)
+		}
+		e, err := FindEntry(r, session, id)
+		if err != nil {
+			return "error"
+		}
+		return e.Command
+	}
+
+	compare(t, "Expected an error without a session", "error", find("", "last"))
+	compare(t, "Last entry of session differs", "make", find("s1", "last"))
+	compare(t, "Last entry of session differs", "go test", find("s2", "last"))
+	id := (&Entry{Time: time.Unix(1000, 0), Command: "make"}).ID()
+	compare(t, "Entry by ID differs", "make", find("", id))
+	compare(t, "Expected an error", "error", find("s3", "last"))
+}
+
+func TestParseCmdLogTags(t *testing.T) {
+	data := "1000\ts1\tmake # @build\n1001\ts1\tvpn-fix\n"
+	store := &TagStore{annotations: map[string]*annotation{}}
+	store.add((&Entry{Time: time.Unix(1001, 0), Command: "vpn-fix"}).ID(),
+		[]string{"vpn"}, "fixes the VPN")
+
+	buf := &bytes.Buffer{}
+	err := ParseCmdLog(&testLineReader{buf: bytes.NewBufferString(data)}, ParseArgs{
+		Tag:     "vpn",
+		Notes:   true,
+		Tags:    store,
+		Session: "s1",
+		Control: controlArgs{Now: time.Unix(1001, 0)},
+		Output:  buf,
+	})
+	if err != nil {
+		t.Fatal("ParseCmdLog failed:", err)
+	}
+	compare(t, "Output differs", "Just now\t@vpn fixes the VPN\tvpn-fix\n", buf.String())
+}